@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/fake_cloudflare"
+	log "github.com/sirupsen/logrus"
+)
+
+// runFakeCloudFlareCommand implements the "fake-cloudflare" subcommand, serving an in-memory Cloudflare DNS API to
+// point CLOUDFLARE_API_URL at.
+func runFakeCloudFlareCommand(args []string) int {
+	flags := flag.NewFlagSet("fake-cloudflare", flag.ContinueOnError)
+	bind := flags.String("bind", "127.0.0.1:8787", "address to listen on")
+	zones := flags.String("zones", "", "comma-separated list of zones to create")
+	seed := flags.String("seed", "", "JSON file with zones and records to create")
+	token := flags.String("token", "", "API token to require, any credentials are accepted if empty")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	server := fake_cloudflare.NewServer()
+	server.Token = *token
+
+	if *seed != "" {
+		if err := server.LoadSeed(*seed); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	for _, zone := range strings.Split(*zones, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			server.AddZone(zone)
+		}
+	}
+
+	for _, zone := range server.Zones() {
+		log.WithField("zone", zone.Name).WithField("id", zone.ID).Info("Serving zone")
+	}
+
+	log.Info(fmt.Sprintf("Serving fake Cloudflare API, set CLOUDFLARE_API_URL=http://%s/client/v4", *bind))
+
+	if err := http.ListenAndServe(*bind, server); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/history"
+	log "github.com/sirupsen/logrus"
+)
+
+func newHistoryJournal() *history.Journal {
+	path := os.Getenv("HISTORY_FILE")
+
+	if path == "" {
+		log.Info("Env HISTORY_FILE not found, disabling IP change history")
+		return nil
+	}
+
+	journal := history.NewJournal(path)
+
+	maxSize := os.Getenv("HISTORY_MAX_SIZE")
+
+	if maxSize != "" {
+		v, err := strconv.ParseInt(maxSize, 10, 64)
+
+		if err != nil {
+			log.WithError(err).Warn("Failed to parse HISTORY_MAX_SIZE, using defaults")
+		} else {
+			journal.MaxSize = v
+		}
+	}
+
+	maxAge := os.Getenv("HISTORY_MAX_AGE")
+
+	if maxAge != "" {
+		v, err := time.ParseDuration(maxAge)
+
+		if err != nil {
+			log.WithError(err).Warn("Failed to parse HISTORY_MAX_AGE, using defaults")
+		} else {
+			journal.MaxAge = v
+		}
+	}
+
+	if err := journal.Compact(); err != nil {
+		log.WithError(err).Warn("Failed to apply history retention")
+	}
+
+	return journal
+}
+
+// runHistoryCommand implements the "history" subcommand, querying the journal configured by HISTORY_FILE.
+func runHistoryCommand(args []string) int {
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	file := flags.String("file", os.Getenv("HISTORY_FILE"), "history journal file, defaults to env HISTORY_FILE")
+	from := flags.String("from", "", "only entries after this RFC 3339 time, date (2006-01-02) or duration ago (168h)")
+	to := flags.String("to", "", "only entries before this RFC 3339 time, date (2006-01-02) or duration ago (1h)")
+	family := flags.String("family", "", "only entries of this address family, ipv4 or ipv6")
+	record := flags.String("record", "", "only updates of this record")
+	format := flags.String("format", "table", "output format, table or json")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "No history journal configured, set env HISTORY_FILE or pass -file")
+		return 2
+	}
+
+	q, err := history.ParseQuery(*from, *to, *family, *record)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	entries, err := history.NewJournal(*file).Query(q)
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch *format {
+	case "table":
+		err = history.WriteTable(os.Stdout, entries)
+	case "json":
+		err = history.WriteJSON(os.Stdout, entries)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format %q, expected table or json\n", *format)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
@@ -14,15 +15,30 @@ import (
 	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/avm"
 	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/cloudflare"
 	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/dyndns"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/dyndns2"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/history"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/hooks"
 	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/http_requests"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/rfc2136"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/state"
 	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
 )
 
 type Updaters struct {
-	CloudFlare   *cloudflare.Updater
-	HttpRequests *http_requests.Updater
-	In           chan *net.IP
+	CloudFlare      []*cloudflare.Updater
+	CloudFlareLists *cloudflare.ListUpdater
+	CloudFlareKV    *cloudflare.KVUpdater
+	HttpRequests    *http_requests.Updater
+	Hooks           *hooks.Updater
+	Dyndns2         *dyndns2.Updater
+	Rfc2136         *rfc2136.Updater
+	History         *history.Journal
+	State           *state.Store
+	In              chan *events.IPUpdate
 }
 
 func main() {
@@ -35,6 +51,10 @@ func main() {
 
 	initLog()
 
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	ipv6LocalAddress := os.Getenv("DEVICE_LOCAL_ADDRESS_IPV6")
 	var localIp net.IP
 	if ipv6LocalAddress != "" {
@@ -46,13 +66,19 @@ func main() {
 		log.Info("Using the IPv6 prefix to construct the IPv6 address")
 	}
 
-	updaters := createAndStartUpdaters()
+	journal := newHistoryJournal()
+
+	retries := newOutbox()
+
+	store := newStateStore()
+
+	updaters := createAndStartUpdaters(journal, retries, store)
 	go spawnUpdateWorker(updaters)
 
 	startPollServer(updaters.In, &localIp)
-	startPushServer(updaters.In, &localIp)
+	startPushServer(updaters.In, &localIp, journal)
 
-	shutdown := make(chan os.Signal)
+	shutdown := make(chan os.Signal, 1)
 
 	signal.Notify(shutdown, syscall.SIGTERM)
 	signal.Notify(shutdown, syscall.SIGINT)
@@ -62,9 +88,25 @@ func main() {
 	log.Info("Shutdown detected")
 }
 
+// runCommand dispatches the CLI subcommands, returning the process exit code.
+func runCommand(command string, args []string) int {
+	switch command {
+	case "history":
+		return runHistoryCommand(args)
+	case "outbox":
+		return runOutboxCommand(args)
+	case "fake-cloudflare":
+		return runFakeCloudFlareCommand(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q, available commands: history, outbox, fake-cloudflare\n", command)
+		return 2
+	}
+}
+
 func initLog() {
 	// log timestamps & set log level
-	log.SetFormatter(&log.TextFormatter{TimestampFormat: "2006-01-02 15:04:05", FullTimestamp: true})
+	// secrets never show up in logs, whichever module logs them
+	log.SetFormatter(&secrets.Formatter{Formatter: &log.TextFormatter{TimestampFormat: "2006-01-02 15:04:05", FullTimestamp: true}})
 	logLevelEnv := os.Getenv("LOG_LEVEL")
 	logLevel, err := log.ParseLevel(logLevelEnv)
 	if err != nil {
@@ -111,52 +153,228 @@ func newFritzBox() *avm.FritzBox {
 	return fb
 }
 
-func createAndStartUpdaters() *Updaters {
-	CloudFlareUpdater := newCloudFlareUpdater()
-	CloudFlareUpdater.StartWorker()
+func createAndStartUpdaters(journal *history.Journal, retries *outbox.Outbox, store *state.Store) *Updaters {
+	dryRun, err := strconv.ParseBool(os.Getenv("DRY_RUN"))
+	if err != nil {
+		dryRun = false
+	}
+	if dryRun {
+		log.Warn("Env DRY_RUN enabled, updates will only be logged and not sent to any provider")
+	}
+
+	CloudFlareUpdaters := newCloudFlareUpdaters()
+	for _, CloudFlareUpdater := range CloudFlareUpdaters {
+		CloudFlareUpdater.DryRun = dryRun
+		CloudFlareUpdater.History = journal
+		CloudFlareUpdater.Outbox = retries
+		retries.Register(CloudFlareUpdater.Provider(), CloudFlareUpdater.Retry)
+		CloudFlareUpdater.StartWorker()
+	}
+
+	CloudFlareListUpdater := newCloudFlareListUpdater()
+	CloudFlareListUpdater.DryRun = dryRun
+	CloudFlareListUpdater.History = journal
+	CloudFlareListUpdater.Outbox = retries
+	retries.Register(cloudflare.ListProviderName, CloudFlareListUpdater.Retry)
+	CloudFlareListUpdater.StartWorker()
+
+	CloudFlareKVUpdater := newCloudFlareKVUpdater()
+	CloudFlareKVUpdater.Remember(store.LastAddress("ipv4"), nil)
+	CloudFlareKVUpdater.Remember(store.LastAddress("ipv6"), store.LastPrefix())
+	CloudFlareKVUpdater.DryRun = dryRun
+	CloudFlareKVUpdater.History = journal
+	CloudFlareKVUpdater.Outbox = retries
+	retries.Register(cloudflare.KVProviderName, CloudFlareKVUpdater.Retry)
+	CloudFlareKVUpdater.StartWorker()
 
 	HttpRequestsUpdater := newHttpRequestsUpdater()
+	HttpRequestsUpdater.Remember(store.LastAddress("ipv4"), nil)
+	HttpRequestsUpdater.Remember(store.LastAddress("ipv6"), store.LastPrefix())
+	HttpRequestsUpdater.DryRun = dryRun
+	HttpRequestsUpdater.History = journal
+	HttpRequestsUpdater.Outbox = retries
+	retries.Register(http_requests.ProviderName, HttpRequestsUpdater.Retry)
 	HttpRequestsUpdater.StartWorker()
 
+	HooksUpdater := newHooksUpdater()
+	HooksUpdater.DryRun = dryRun
+	HooksUpdater.History = journal
+	HooksUpdater.Outbox = retries
+	retries.Register(hooks.ProviderName, HooksUpdater.Retry)
+	HooksUpdater.StartWorker()
+
+	Dyndns2Updater := newDyndns2Updater()
+	Dyndns2Updater.DryRun = dryRun
+	Dyndns2Updater.History = journal
+	Dyndns2Updater.Outbox = retries
+	Dyndns2Updater.State = store
+	retries.Register(dyndns2.ProviderName, Dyndns2Updater.Retry)
+	Dyndns2Updater.StartWorker()
+
+	Rfc2136Updater := newRfc2136Updater()
+	Rfc2136Updater.DryRun = dryRun
+	Rfc2136Updater.History = journal
+	Rfc2136Updater.Outbox = retries
+	retries.Register(rfc2136.ProviderName, Rfc2136Updater.Retry)
+	Rfc2136Updater.StartWorker()
+
+	retries.StartWorker()
+
 	return &Updaters{
-		CloudFlare:   CloudFlareUpdater,
-		HttpRequests: HttpRequestsUpdater,
-		In:           make(chan *net.IP, 10),
+		CloudFlare:      CloudFlareUpdaters,
+		CloudFlareLists: CloudFlareListUpdater,
+		CloudFlareKV:    CloudFlareKVUpdater,
+		HttpRequests:    HttpRequestsUpdater,
+		Hooks:           HooksUpdater,
+		Dyndns2:         Dyndns2Updater,
+		Rfc2136:         Rfc2136Updater,
+		History:         journal,
+		State:           store,
+		In:              make(chan *events.IPUpdate, 10),
 	}
 }
 
+func newStateStore() *state.Store {
+	path := os.Getenv("STATE_FILE")
+
+	if path == "" {
+		log.Info("Env STATE_FILE not found, keeping the last known addresses in memory only")
+	}
+
+	store, err := state.NewStore(path)
+
+	if err != nil {
+		log.WithError(err).Warn("Failed to load the last known addresses from STATE_FILE, starting without them")
+	}
+
+	return store
+}
+
 func spawnUpdateWorker(updaters *Updaters) {
 	for {
 		select {
-		case ip := <-updaters.In:
-			log.WithField("ip", ip).Info("Received update request, sending to all updaters")
-			updaters.CloudFlare.In <- ip
-			updaters.HttpRequests.In <- ip
+		case update := <-updaters.In:
+			// the last known address of the family is handed to the updaters as the previous address
+			update.Previous = updaters.State.LastAddress(update.Family())
+
+			if err := updaters.State.SetLastAddress(update.Family(), update.IP, update.Prefix); err != nil {
+				log.WithError(err).Error("Failed to persist the last known address")
+			}
+
+			log.WithField("ip", update.IP).WithField("source", update.Source).Info("Received update request, sending to all updaters")
+			updaters.History.RecordAddress(update.IP)
+			for _, CloudFlareUpdater := range updaters.CloudFlare {
+				CloudFlareUpdater.In <- update
+			}
+			updaters.CloudFlareLists.In <- update
+			updaters.CloudFlareKV.In <- update
+			updaters.HttpRequests.In <- update
+			updaters.Hooks.In <- update
+			updaters.Dyndns2.In <- update
+			updaters.Rfc2136.In <- update
 		}
 	}
 }
 
-func newCloudFlareUpdater() *cloudflare.Updater {
-	u := cloudflare.NewUpdater()
+// cloudFlareCredentials returns the API token or the deprecated email / key pair found in the env variables with the
+// given prefix, ok is false if neither is set.
+func cloudFlareCredentials(prefix string) (token *secrets.Secret, email string, key *secrets.Secret, ok bool) {
+	token = secrets.Getenv(prefix + "API_TOKEN")
+	email = os.Getenv(prefix + "API_EMAIL")
+	key = secrets.Getenv(prefix + "API_KEY")
+
+	if !token.IsSet() && (email == "" || !key.IsSet()) {
+		return nil, "", nil, false
+	}
+
+	return token, email, key, true
+}
+
+// cloudFlareAPIOptions reads the client settings shared by all Cloudflare updaters, using the credentials on every call.
+func cloudFlareAPIOptions(token *secrets.Secret, key *secrets.Secret) cloudflare.APIOptions {
+	options := cloudflare.APIOptions{
+		BaseURL:    os.Getenv("CLOUDFLARE_API_URL"),
+		Timeout:    cloudflare.DefaultTimeout,
+		MaxRetries: cloudflare.DefaultMaxRetries,
+		Token:      token,
+		Key:        key,
+	}
+
+	if timeout := os.Getenv("CLOUDFLARE_TIMEOUT"); timeout != "" {
+		v, err := time.ParseDuration(timeout)
+
+		if err != nil || v <= 0 {
+			log.WithError(err).Warn("Failed to parse CLOUDFLARE_TIMEOUT, using defaults")
+		} else {
+			options.Timeout = v
+		}
+	}
 
-	token := os.Getenv("CLOUDFLARE_API_TOKEN")
-	email := os.Getenv("CLOUDFLARE_API_EMAIL")
-	key := os.Getenv("CLOUDFLARE_API_KEY")
+	if maxRetries := os.Getenv("CLOUDFLARE_MAX_RETRIES"); maxRetries != "" {
+		v, err := strconv.Atoi(maxRetries)
 
-	if token == "" {
-		if email == "" || key == "" {
-			log.Info("Env CLOUDFLARE_API_TOKEN or CLOUDFLARE_API_EMAIL/CLOUDFLARE_API_KEY not found, disabling CloudFlare updates")
-			return u
+		if err != nil || v < 0 {
+			log.WithError(err).Warn("Failed to parse CLOUDFLARE_MAX_RETRIES, using defaults")
 		} else {
-			log.Warn("Using deprecated credentials via the API key")
+			options.MaxRetries = v
 		}
 	}
 
-	ipv4Zone := os.Getenv("CLOUDFLARE_ZONES_IPV4")
-	ipv6Zone := os.Getenv("CLOUDFLARE_ZONES_IPV6")
+	return options
+}
+
+// newCloudFlareUpdaters creates the updater of the default CLOUDFLARE_* settings and one per record group defined by
+// CLOUDFLARE_GROUP_1_* ... CLOUDFLARE_GROUP_9_*, each with its own credentials and API client.
+func newCloudFlareUpdaters() []*cloudflare.Updater {
+	updaters := []*cloudflare.Updater{newCloudFlareUpdater("CLOUDFLARE_", "")}
+
+	for groupIndex := 1; groupIndex < 10; groupIndex++ {
+		prefix := fmt.Sprintf("CLOUDFLARE_GROUP_%d_", groupIndex)
+
+		if !secrets.IsSetInEnv(prefix+"API_TOKEN") && !secrets.IsSetInEnv(prefix+"API_KEY") {
+			continue
+		}
+
+		group := os.Getenv(prefix + "NAME")
+		if group == "" {
+			group = strconv.Itoa(groupIndex)
+		}
+
+		updaters = append(updaters, newCloudFlareUpdater(prefix, group))
+	}
+
+	return updaters
+}
+
+// newCloudFlareUpdater creates an updater from the credentials and zone lists of the env variables with the given
+// prefix. Record options, ownership and the API URL are shared by all groups.
+func newCloudFlareUpdater(prefix string, group string) *cloudflare.Updater {
+	u := cloudflare.NewUpdater()
+	ulog := log.NewEntry(log.StandardLogger())
+
+	if group != "" {
+		u.SetGroup(group)
+		ulog = ulog.WithField("group", group)
+	}
+
+	token, email, key, ok := cloudFlareCredentials(prefix)
 
-	if ipv4Zone == "" && ipv6Zone == "" {
-		log.Warn("Env CLOUDFLARE_ZONES_IPV4 and CLOUDFLARE_ZONES_IPV6 not found, disabling CloudFlare updates")
+	if !ok {
+		ulog.Info(fmt.Sprintf("Env %[1]sAPI_TOKEN or %[1]sAPI_EMAIL/%[1]sAPI_KEY not found, disabling CloudFlare updates", prefix))
+		return u
+	}
+
+	if !token.IsSet() {
+		ulog.Warn("Using deprecated credentials via the API key")
+	}
+
+	ipv4Zone := os.Getenv(prefix + "ZONES_IPV4")
+	ipv6Zone := os.Getenv(prefix + "ZONES_IPV6")
+	followZones := os.Getenv(prefix + "FOLLOW_ZONES")
+	hintRecords := setCloudFlareHintRecords(u, group)
+
+	if ipv4Zone == "" && ipv6Zone == "" && followZones == "" && hintRecords == 0 {
+		ulog.Warn(fmt.Sprintf("Env %[1]sZONES_IPV4, %[1]sZONES_IPV6, %[1]sFOLLOW_ZONES and CLOUDFLARE_HINT_RECORD_n_NAME not found, disabling CloudFlare updates", prefix))
 		return u
 	}
 
@@ -168,22 +386,271 @@ func newCloudFlareUpdater() *cloudflare.Updater {
 		u.SetIPv6Zones(ipv6Zone)
 	}
 
+	if followZones != "" {
+		u.SetFollowZones(followZones)
+		u.SetFollowPatterns(os.Getenv(prefix+"FOLLOW_INCLUDE"), os.Getenv(prefix+"FOLLOW_EXCLUDE"))
+	}
+
+	setCloudFlareRecordOptions(u)
+
+	u.APIOptions = cloudFlareAPIOptions(token, key)
+
+	if concurrency := os.Getenv("CLOUDFLARE_CONCURRENCY"); concurrency != "" {
+		v, err := strconv.Atoi(concurrency)
+
+		if err != nil || v < 1 {
+			ulog.WithError(err).Warn("Failed to parse CLOUDFLARE_CONCURRENCY, using defaults")
+		} else {
+			u.Concurrency = v
+		}
+	}
+
+	if cacheRefresh := os.Getenv("CLOUDFLARE_CACHE_REFRESH"); cacheRefresh != "" {
+		v, err := time.ParseDuration(cacheRefresh)
+
+		if err != nil || v < 0 {
+			ulog.WithError(err).Warn("Failed to parse CLOUDFLARE_CACHE_REFRESH, using defaults")
+		} else {
+			u.CacheRefresh = v
+		}
+	}
+
+	switch ownership := strings.ToLower(os.Getenv("CLOUDFLARE_OWNERSHIP")); ownership {
+	case "", cloudflare.OwnershipOff:
+	case cloudflare.OwnershipComment, cloudflare.OwnershipTag:
+		u.Ownership = ownership
+	default:
+		ulog.Warn("Failed to parse CLOUDFLARE_OWNERSHIP, expected off, comment or tag, turning ownership off")
+	}
+
+	adopt, err := strconv.ParseBool(os.Getenv("CLOUDFLARE_OWNERSHIP_ADOPT"))
+	if err == nil {
+		u.AdoptRecords = adopt
+	}
+
+	if token.IsSet() {
+		err = u.InitWithToken(token.Value())
+	} else {
+		err = u.InitWithKey(email, key.Value())
+	}
+
+	if err != nil {
+		ulog.WithError(err).Error("Failed to init Cloudflare updater, disabling CloudFlare updates")
+		return u
+	}
+
+	return u
+}
+
+func newCloudFlareListUpdater() *cloudflare.ListUpdater {
+	u := cloudflare.NewListUpdater()
+
+	accountId := os.Getenv("CLOUDFLARE_ACCOUNT_ID")
+	lists := os.Getenv("CLOUDFLARE_IP_LISTS")
+
+	if lists == "" {
+		log.Info("Env CLOUDFLARE_IP_LISTS not found, disabling CloudFlare IP list updates")
+		return u
+	}
+
+	if accountId == "" {
+		log.Warn("Env CLOUDFLARE_ACCOUNT_ID not found, disabling CloudFlare IP list updates")
+		return u
+	}
+
+	token, email, key, ok := cloudFlareCredentials("CLOUDFLARE_")
+
+	if !ok {
+		log.Warn("Env CLOUDFLARE_API_TOKEN or CLOUDFLARE_API_EMAIL/CLOUDFLARE_API_KEY not found, disabling CloudFlare IP list updates")
+		return u
+	}
+
+	u.SetLists(accountId, lists)
+	u.APIOptions = cloudFlareAPIOptions(token, key)
+
 	var err error
 
-	if token != "" {
-		err = u.InitWithToken(token)
+	if token.IsSet() {
+		err = u.InitWithToken(token.Value())
 	} else {
-		err = u.InitWithKey(email, key)
+		err = u.InitWithKey(email, key.Value())
 	}
 
 	if err != nil {
-		log.WithError(err).Error("Failed to init Cloudflare updater, disabling CloudFlare updates")
+		log.WithError(err).Error("Failed to init Cloudflare IP list updater, disabling CloudFlare IP list updates")
+	}
+
+	return u
+}
+
+func newCloudFlareKVUpdater() *cloudflare.KVUpdater {
+	u := cloudflare.NewKVUpdater()
+
+	accountId := os.Getenv("CLOUDFLARE_ACCOUNT_ID")
+	namespaceId := os.Getenv("CLOUDFLARE_KV_NAMESPACE_ID")
+
+	if namespaceId == "" {
+		log.Info("Env CLOUDFLARE_KV_NAMESPACE_ID not found, disabling CloudFlare Workers KV updates")
+		return u
+	}
+
+	if accountId == "" {
+		log.Warn("Env CLOUDFLARE_ACCOUNT_ID not found, disabling CloudFlare Workers KV updates")
+		return u
+	}
+
+	token, email, key, ok := cloudFlareCredentials("CLOUDFLARE_")
+
+	if !ok {
+		log.Warn("Env CLOUDFLARE_API_TOKEN or CLOUDFLARE_API_EMAIL/CLOUDFLARE_API_KEY not found, disabling CloudFlare Workers KV updates")
 		return u
 	}
 
+	kvKey := os.Getenv("CLOUDFLARE_KV_KEY")
+	if kvKey == "" {
+		kvKey = "addresses"
+	}
+
+	u.SetKey(accountId, namespaceId, kvKey)
+
+	recordKeys, err := strconv.ParseBool(os.Getenv("CLOUDFLARE_KV_RECORD_KEYS"))
+	if err == nil && recordKeys {
+		u.SetRecordKeys(os.Getenv("CLOUDFLARE_KV_RECORD_PREFIX"),
+			splitEnvList("CLOUDFLARE_ZONES_IPV4"), splitEnvList("CLOUDFLARE_ZONES_IPV6"))
+	}
+
+	u.APIOptions = cloudFlareAPIOptions(token, key)
+
+	if token.IsSet() {
+		err = u.InitWithToken(token.Value())
+	} else {
+		err = u.InitWithKey(email, key.Value())
+	}
+
+	if err != nil {
+		log.WithError(err).Error("Failed to init Cloudflare Workers KV updater, disabling CloudFlare Workers KV updates")
+	}
+
 	return u
 }
 
+// splitEnvList returns the non-empty values of a comma-separated env variable.
+func splitEnvList(name string) []string {
+	var values []string
+
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// setCloudFlareHintRecords reads the HTTPS / SVCB / SRV records of the group from CLOUDFLARE_HINT_RECORD_1_* ...
+// CLOUDFLARE_HINT_RECORD_9_*, returning the number of records added.
+func setCloudFlareHintRecords(u *cloudflare.Updater, group string) int {
+	count := 0
+
+	for recordIndex := 1; recordIndex < 10; recordIndex++ {
+		prefix := fmt.Sprintf("CLOUDFLARE_HINT_RECORD_%d_", recordIndex)
+
+		name := os.Getenv(prefix + "NAME")
+		if name == "" || os.Getenv(prefix+"GROUP") != group {
+			continue
+		}
+
+		rlog := log.WithField("record", name)
+		record := cloudflare.HintRecord{
+			Name: name,
+			Zone: os.Getenv(prefix + "ZONE"),
+			Type: strings.ToUpper(os.Getenv(prefix + "TYPE")),
+		}
+
+		switch record.Type {
+		case "":
+			record.Type = cloudflare.RecordTypeHTTPS
+		case cloudflare.RecordTypeHTTPS, cloudflare.RecordTypeSVCB, cloudflare.RecordTypeSRV:
+		default:
+			rlog.Warn(fmt.Sprintf("Failed to parse %sTYPE, expected HTTPS, SVCB or SRV, skipping record", prefix))
+			continue
+		}
+
+		hints := os.Getenv(prefix + "HINTS")
+		if hints == "" {
+			hints = "ipv4,ipv6"
+		}
+
+		for _, hint := range strings.Split(hints, ",") {
+			switch strings.ToLower(strings.TrimSpace(hint)) {
+			case "ipv4":
+				record.IPv4 = true
+			case "ipv6":
+				record.IPv6 = true
+			default:
+				rlog.Warn(fmt.Sprintf("Ignoring unknown family %q in %sHINTS, expected ipv4 or ipv6", hint, prefix))
+			}
+		}
+
+		u.AddHintRecord(record)
+		count++
+	}
+
+	return count
+}
+
+// setCloudFlareRecordOptions reads the per-record options from CLOUDFLARE_RECORD_1_* ... CLOUDFLARE_RECORD_9_*.
+func setCloudFlareRecordOptions(u *cloudflare.Updater) {
+	for recordIndex := 1; recordIndex < 10; recordIndex++ {
+		prefix := fmt.Sprintf("CLOUDFLARE_RECORD_%d_", recordIndex)
+
+		name := os.Getenv(prefix + "NAME")
+		if name == "" {
+			continue
+		}
+
+		rlog := log.WithField("record", name)
+		options := cloudflare.RecordOptions{
+			Zone: os.Getenv(prefix + "ZONE"),
+		}
+
+		if proxiedStr := os.Getenv(prefix + "PROXIED"); proxiedStr != "" {
+			proxied, err := strconv.ParseBool(proxiedStr)
+			if err != nil {
+				rlog.WithError(err).Warn(fmt.Sprintf("Failed to parse %sPROXIED, keeping existing value", prefix))
+			} else {
+				options.Proxied = &proxied
+			}
+		}
+
+		if ttlStr := os.Getenv(prefix + "TTL"); ttlStr != "" {
+			ttl, err := strconv.Atoi(ttlStr)
+			if err != nil || (ttl != 1 && (ttl < 60 || ttl > 86400)) {
+				if err == nil {
+					err = fmt.Errorf("value %d is neither 1 (automatic) nor inside bounds [60, 86400]", ttl)
+				}
+				rlog.WithError(err).Warn(fmt.Sprintf("Failed to parse %sTTL, keeping existing value", prefix))
+			} else {
+				options.TTL = ttl
+			}
+		}
+
+		if comment := os.Getenv(prefix + "COMMENT"); comment != "" {
+			options.Comment = &comment
+		}
+
+		if tags := os.Getenv(prefix + "TAGS"); tags != "" {
+			for _, tag := range strings.Split(tags, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					options.Tags = append(options.Tags, tag)
+				}
+			}
+		}
+
+		u.SetRecordOptions(name, options)
+	}
+}
+
 func newHttpRequestsUpdater() *http_requests.Updater {
 	u := http_requests.NewUpdater()
 
@@ -197,7 +664,46 @@ func newHttpRequestsUpdater() *http_requests.Updater {
 	return u
 }
 
-func startPushServer(out chan<- *net.IP, localIp *net.IP) {
+func newHooksUpdater() *hooks.Updater {
+	u := hooks.NewUpdater()
+
+	err := u.InitFromEnvironment()
+
+	if err != nil {
+		log.WithError(err).Error("Failed to init exec hooks updater, disabling exec hooks")
+		return u
+	}
+
+	return u
+}
+
+func newDyndns2Updater() *dyndns2.Updater {
+	u := dyndns2.NewUpdater()
+
+	err := u.InitFromEnvironment()
+
+	if err != nil {
+		log.WithError(err).Error("Failed to init dyndns2 updater, disabling dyndns2 updates")
+		return u
+	}
+
+	return u
+}
+
+func newRfc2136Updater() *rfc2136.Updater {
+	u := rfc2136.NewUpdater()
+
+	err := u.InitFromEnvironment()
+
+	if err != nil {
+		log.WithError(err).Error("Failed to init RFC 2136 updater, disabling RFC 2136 updates")
+		return u
+	}
+
+	return u
+}
+
+func startPushServer(out chan<- *events.IPUpdate, localIp *net.IP, journal *history.Journal) {
 	bind := os.Getenv("DYNDNS_SERVER_BIND")
 
 	if bind == "" {
@@ -207,13 +713,13 @@ func startPushServer(out chan<- *net.IP, localIp *net.IP) {
 
 	server := dyndns.NewServer(out, localIp)
 	server.Username = os.Getenv("DYNDNS_SERVER_USERNAME")
-	server.Password = os.Getenv("DYNDNS_SERVER_PASSWORD")
+	server.Password = secrets.Getenv("DYNDNS_SERVER_PASSWORD")
 
 	serverBasicAuth, err := strconv.ParseBool(os.Getenv("DYNDNS_SERVER_BASIC_AUTH"))
 	if err != nil {
 		serverBasicAuth = false
 	}
-	if serverBasicAuth && (server.Username == "" || server.Password == "") {
+	if serverBasicAuth && (server.Username == "" || !server.Password.IsSet()) {
 		serverBasicAuth = false
 	}
 	server.BasicAuth = serverBasicAuth
@@ -224,12 +730,16 @@ func startPushServer(out chan<- *net.IP, localIp *net.IP) {
 
 	http.HandleFunc("/ip", server.Handler)
 
+	if journal != nil {
+		http.HandleFunc("/history", server.Protect(journal.Handler))
+	}
+
 	go func() {
 		log.Fatal(s.ListenAndServe())
 	}()
 }
 
-func startPollServer(out chan<- *net.IP, localIp *net.IP) {
+func startPollServer(out chan<- *events.IPUpdate, localIp *net.IP) {
 	fritzbox := newFritzBox()
 
 	if fritzbox == nil {
@@ -269,7 +779,7 @@ func startPollServer(out chan<- *net.IP, localIp *net.IP) {
 			} else {
 				if !lastV4.Equal(ipv4) {
 					log.WithField("ipv4", ipv4).Info("New WAN IPv4 found")
-					out <- &ipv4
+					out <- &events.IPUpdate{IP: ipv4, Source: events.SourcePoll}
 					lastV4 = ipv4
 				}
 
@@ -283,7 +793,7 @@ func startPollServer(out chan<- *net.IP, localIp *net.IP) {
 				} else {
 					if !lastV6.Equal(ipv6) {
 						log.WithField("ipv6", ipv6).Info("New WAN IPv6 found")
-						out <- &ipv6
+						out <- &events.IPUpdate{IP: ipv6, Source: events.SourcePoll}
 						lastV6 = ipv6
 					}
 				}
@@ -304,7 +814,7 @@ func startPollServer(out chan<- *net.IP, localIp *net.IP) {
 
 						log.WithField("prefix", prefix).WithField("ipv6", constructedIp).Info("New IPv6 Prefix found")
 
-						out <- &constructedIp
+						out <- &events.IPUpdate{IP: constructedIp, Prefix: prefix, Source: events.SourcePoll}
 						lastV6 = prefix.IP
 					}
 				}
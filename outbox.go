@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+	log "github.com/sirupsen/logrus"
+)
+
+func newOutbox() *outbox.Outbox {
+	path := os.Getenv("OUTBOX_FILE")
+
+	if path == "" {
+		log.Info("Env OUTBOX_FILE not found, disabling retries of failed updates")
+		return nil
+	}
+
+	o := outbox.NewOutbox(path)
+
+	maxAttempts := os.Getenv("OUTBOX_MAX_ATTEMPTS")
+
+	if maxAttempts != "" {
+		v, err := strconv.Atoi(maxAttempts)
+
+		if err != nil || v < 1 {
+			log.WithError(err).Warn("Failed to parse OUTBOX_MAX_ATTEMPTS, using defaults")
+		} else {
+			o.MaxAttempts = v
+		}
+	}
+
+	minBackoff := os.Getenv("OUTBOX_MIN_BACKOFF")
+
+	if minBackoff != "" {
+		v, err := time.ParseDuration(minBackoff)
+
+		if err != nil {
+			log.WithError(err).Warn("Failed to parse OUTBOX_MIN_BACKOFF, using defaults")
+		} else {
+			o.MinBackoff = v
+		}
+	}
+
+	maxBackoff := os.Getenv("OUTBOX_MAX_BACKOFF")
+
+	if maxBackoff != "" {
+		v, err := time.ParseDuration(maxBackoff)
+
+		if err != nil {
+			log.WithError(err).Warn("Failed to parse OUTBOX_MAX_BACKOFF, using defaults")
+		} else {
+			o.MaxBackoff = v
+		}
+	}
+
+	return o
+}
+
+// runOutboxCommand implements the "outbox list" and "outbox retry" subcommands on the file configured by OUTBOX_FILE.
+func runOutboxCommand(args []string) int {
+	usage := "Usage: outbox list [-state pending|dead] | outbox retry [-all] [id]"
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("outbox "+args[0], flag.ContinueOnError)
+	file := flags.String("file", os.Getenv("OUTBOX_FILE"), "outbox file, defaults to env OUTBOX_FILE")
+
+	switch args[0] {
+	case "list":
+		state := flags.String("state", "", "only operations in this state, pending or dead")
+
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+
+		if *file == "" {
+			fmt.Fprintln(os.Stderr, "No outbox configured, set env OUTBOX_FILE or pass -file")
+			return 2
+		}
+
+		ops, err := outbox.NewOutbox(*file).List()
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tPROVIDER\tTARGET\tADDRESS\tSTATE\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+
+		for _, op := range ops {
+			if *state != "" && op.State != *state {
+				continue
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+				op.Id, op.Provider, op.Target, op.Address, op.State, op.Attempts,
+				op.NextAttempt.Format("2006-01-02 15:04:05"), op.LastError)
+		}
+
+		_ = tw.Flush()
+
+		return 0
+	case "retry":
+		all := flags.Bool("all", false, "retry all pending and dead operations")
+
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+
+		if *file == "" {
+			fmt.Fprintln(os.Stderr, "No outbox configured, set env OUTBOX_FILE or pass -file")
+			return 2
+		}
+
+		if *all == (flags.NArg() == 1) || flags.NArg() > 1 {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+
+		scheduled, err := outbox.NewOutbox(*file).Retry(flags.Arg(0))
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		fmt.Printf("Scheduled %d operation(s) for an immediate retry\n", scheduled)
+
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
@@ -0,0 +1,158 @@
+package cloudflare
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheRefresh is the age after which the cached records of a zone are fetched again
+const DefaultCacheRefresh = 10 * time.Minute
+
+// recordCache keeps all records of a zone, so the actions of a zone need a single list call. Successful writes are
+// applied to the cache, a failed write drops the zone as its state is unknown.
+type recordCache struct {
+	mu      sync.Mutex
+	refresh time.Duration
+	zones   map[string]*zoneRecords
+}
+
+type zoneRecords struct {
+	// mu is held while fetching, so concurrent lookups of a zone wait for a single list call
+	mu      sync.Mutex
+	fetched time.Time
+	records []dnsRecord
+}
+
+func newRecordCache(refresh time.Duration) *recordCache {
+	return &recordCache{
+		refresh: refresh,
+		zones:   make(map[string]*zoneRecords),
+	}
+}
+
+func (c *recordCache) zone(zoneId string) *zoneRecords {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	zone, ok := c.zones[zoneId]
+
+	if !ok {
+		zone = &zoneRecords{}
+		c.zones[zoneId] = zone
+	}
+
+	return zone
+}
+
+// listRecords returns the records of the zone matching the record type, name and content, empty filters match all.
+// Without caching the filters are passed to the API instead.
+func (u *Updater) listRecords(zoneId string, recordType string, name string, content string) ([]dnsRecord, error) {
+	if u.cache == nil || u.cache.refresh <= 0 {
+		return listRecords(u.api, zoneId, recordType, name, content)
+	}
+
+	zone := u.cache.zone(zoneId)
+
+	zone.mu.Lock()
+	defer zone.mu.Unlock()
+
+	if zone.records == nil || time.Since(zone.fetched) > u.cache.refresh {
+		records, err := listRecords(u.api, zoneId, "", "", "")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if records == nil {
+			records = []dnsRecord{}
+		}
+
+		zone.records = records
+		zone.fetched = time.Now()
+		u.log.WithField("zone-id", zoneId).WithField("records", len(records)).Debug("Refreshed cached DNS records")
+	}
+
+	name = normalizeName(toASCII(name))
+	contentIp := net.ParseIP(content)
+
+	var matches []dnsRecord
+
+	for _, record := range zone.records {
+		if recordType != "" && !strings.EqualFold(record.Type, recordType) {
+			continue
+		}
+		if name != "" && normalizeName(record.Name) != name {
+			continue
+		}
+		if content != "" && record.Content != content && (contentIp == nil || !contentIp.Equal(net.ParseIP(record.Content))) {
+			continue
+		}
+
+		matches = append(matches, record)
+	}
+
+	return matches, nil
+}
+
+// cacheWrite applies the outcome of a write to the cache. A nil record removes the one with the ID, an error drops
+// the zone.
+func (u *Updater) cacheWrite(zoneId string, id string, record *dnsRecord, err error) {
+	if u.cache == nil {
+		return
+	}
+
+	zone := u.cache.zone(zoneId)
+
+	zone.mu.Lock()
+	defer zone.mu.Unlock()
+
+	if zone.records == nil {
+		return
+	}
+
+	if err != nil {
+		zone.records = nil
+		return
+	}
+
+	for i := range zone.records {
+		if zone.records[i].ID != id {
+			continue
+		}
+
+		if record == nil {
+			zone.records = append(zone.records[:i], zone.records[i+1:]...)
+		} else {
+			zone.records[i] = *record
+		}
+
+		return
+	}
+
+	if record != nil {
+		zone.records = append(zone.records, *record)
+	}
+}
+
+func (u *Updater) createRecord(zoneId string, record dnsRecord) error {
+	created, err := createRecord(u.api, zoneId, record)
+	u.cacheWrite(zoneId, created.ID, &created, err)
+
+	return err
+}
+
+func (u *Updater) updateRecord(zoneId string, recordId string, update dnsRecordUpdate) error {
+	updated, err := updateRecord(u.api, zoneId, recordId, update)
+	u.cacheWrite(zoneId, recordId, &updated, err)
+
+	return err
+}
+
+func (u *Updater) deleteRecord(zoneId string, recordId string) error {
+	err := deleteRecord(u.api, zoneId, recordId)
+	u.cacheWrite(zoneId, recordId, nil, err)
+
+	return err
+}
@@ -0,0 +1,174 @@
+package cloudflare
+
+import (
+	"net"
+	"path"
+	"strings"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+)
+
+// followTargetPrefix marks outbox targets of followed zones, the rest of the target is the zone name
+const followTargetPrefix = "follow:"
+
+// SetFollowZones sets the zones in which all A / AAAA records pointing at the previous address are moved to the new one.
+func (u *Updater) SetFollowZones(zones string) {
+	u.followZones = splitList(zones)
+}
+
+// SetFollowPatterns limits the followed records to names matching any include pattern and no exclude pattern.
+// Patterns use the syntax of path.Match, an empty include list matches all names.
+func (u *Updater) SetFollowPatterns(include string, exclude string) {
+	u.followInclude = splitList(include)
+	u.followExclude = splitList(exclude)
+}
+
+func splitList(list string) []string {
+	var values []string
+
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// followsRecord tells if the record name is within the configured include / exclude patterns.
+func (u *Updater) followsRecord(name string) bool {
+	name = normalizeName(name)
+
+	for _, pattern := range u.followExclude {
+		if ok, _ := path.Match(normalizeName(pattern), name); ok {
+			return false
+		}
+	}
+
+	if len(u.followInclude) == 0 {
+		return true
+	}
+
+	for _, pattern := range u.followInclude {
+		if ok, _ := path.Match(normalizeName(pattern), name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// processFollow moves the records of a followed zone from the previous to the new address.
+func (u *Updater) processFollow(zone string, zoneId string, update *events.IPUpdate, sum *summary) {
+	applies, err := u.runFollow(zone, zoneId, update, sum)
+	if !applies || u.DryRun {
+		return
+	}
+
+	if err != nil {
+		u.Outbox.Enqueue(u.Provider(), followTargetPrefix+zone, update, err)
+	} else {
+		u.Outbox.Complete(u.Provider(), followTargetPrefix+zone, update.IP)
+	}
+}
+
+// runFollow updates every A / AAAA record of the zone whose content equals the previous address, keeping its TTL
+// and proxy setting. Ownership applies per record name like for configured records, unmarked records are skipped or
+// adopted. Returns false if there is no previous address of the same family to follow.
+func (u *Updater) runFollow(zone string, zoneId string, update *events.IPUpdate, sum *summary) (bool, error) {
+	previous := update.Previous
+
+	if previous == nil || previous.Equal(update.IP) || ipVersion(previous) != ipVersion(update.IP) {
+		return false, nil
+	}
+
+	recordType := "A"
+	if ipVersion(update.IP) == 6 {
+		recordType = "AAAA"
+	}
+
+	content := update.IP.String()
+	zoneAction := &Action{DnsRecord: zone, CfZoneId: zoneId, IpVersion: ipVersion(update.IP)}
+
+	records, err := u.listRecords(zoneId, recordType, "", previous.String())
+
+	if err != nil {
+		result := ActionResult{zoneAction, OperationResearch, "", "", u.DryRun, err}
+		u.logActionResult(result)
+		sum.add(result)
+		return true, err
+	}
+
+	var names []string
+	byName := make(map[string][]dnsRecord)
+
+	for _, record := range records {
+		if !previous.Equal(net.ParseIP(record.Content)) {
+			continue
+		}
+
+		if !u.followsRecord(record.Name) {
+			u.log.WithField("domain", record.Name).Debug("Not following DNS record excluded by the name patterns")
+			continue
+		}
+
+		name := normalizeName(record.Name)
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], record)
+	}
+
+	report := func(result ActionResult) {
+		u.logActionResult(result)
+		sum.add(result)
+
+		if result.Operation == OperationSkip {
+			return
+		}
+
+		u.History.RecordUpdate(u.Provider(), result.Action.DnsRecord, update.IP, result.DryRun, result.Error)
+
+		if result.Error != nil {
+			err = result.Error
+		}
+	}
+
+	for _, name := range names {
+		managed, unmanaged := u.partitionRecords(byName[name])
+		action := &Action{DnsRecord: byName[name][0].Name, CfZoneId: zoneId, IpVersion: zoneAction.IpVersion}
+
+		// Records without the ownership marker were created by hand and are left alone, unless adoption is allowed
+		adopt := false
+
+		if len(managed) == 0 {
+			if !u.AdoptRecords {
+				for _, record := range unmanaged {
+					report(ActionResult{action, OperationSkip, record.ID, record.Content, u.DryRun, nil})
+				}
+				continue
+			}
+
+			managed = unmanaged[:1]
+			adopt = true
+		}
+
+		operation := OperationUpdate
+		if adopt {
+			operation = OperationAdopt
+		}
+
+		// only records still pointing at the previous address are seen here, so duplicates are not collapsed
+		for _, record := range managed {
+			result := ActionResult{action, operation, record.ID, content, u.DryRun, nil}
+
+			if !u.DryRun {
+				result.Error = u.updateRecord(zoneId, record.ID, u.recordUpdate(action, record, content, adopt))
+			}
+
+			report(result)
+		}
+	}
+
+	return true, err
+}
@@ -0,0 +1,337 @@
+package cloudflare
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Record types whose address hints or targets can be maintained
+const (
+	RecordTypeHTTPS = "HTTPS"
+	RecordTypeSVCB  = "SVCB"
+	RecordTypeSRV   = "SRV"
+)
+
+// HintRecord is an existing HTTPS or SVCB record whose ipv4hint / ipv6hint params follow the current addresses, or an
+// SRV record whose targets are moved to the current addresses.
+type HintRecord struct {
+	Name string
+	// Zone name or ID the record belongs to, looked up by the longest matching zone of the account if empty
+	Zone string
+	// Type is RecordTypeHTTPS, RecordTypeSVCB or RecordTypeSRV
+	Type string
+	// IPv4 and IPv6 select the hints to inject, or the A / AAAA records of SRV targets to update
+	IPv4 bool
+	IPv6 bool
+}
+
+// AddHintRecord adds an HTTPS, SVCB or SRV record that is kept up to date.
+func (u *Updater) AddHintRecord(record HintRecord) {
+	u.hintRecords = append(u.hintRecords, record)
+}
+
+// svcbData is the structured content of HTTPS and SVCB records
+type svcbData struct {
+	Priority int    `json:"priority"`
+	Target   string `json:"target"`
+	Value    string `json:"value"`
+}
+
+// srvData is the structured content of SRV records
+type srvData struct {
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Port     int    `json:"port"`
+	Target   string `json:"target"`
+}
+
+// recordData decodes the structured content of the record into data.
+func recordData(record dnsRecord, data interface{}) error {
+	raw, err := json.Marshal(record.Data)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw, data)
+}
+
+// svcParam is a single key=value pair of the SvcParams, the value keeps its quotes
+type svcParam struct {
+	Key   string
+	Value string
+}
+
+// svcParamKeys maps the named keys of RFC 9460 to their numbers, defining the order of the params
+var svcParamKeys = map[string]int{
+	"mandatory":       0,
+	"alpn":            1,
+	"no-default-alpn": 2,
+	"port":            3,
+	"ipv4hint":        4,
+	"ech":             5,
+	"ipv6hint":        6,
+}
+
+func svcParamKeyNumber(key string) int {
+	if number, ok := svcParamKeys[key]; ok {
+		return number
+	}
+
+	if number, err := strconv.Atoi(strings.TrimPrefix(key, "key")); err == nil {
+		return number
+	}
+
+	return 65535
+}
+
+// parseSvcParams splits the SvcParams presentation format into its params, keeping quoted values intact.
+func parseSvcParams(value string) []svcParam {
+	var params []svcParam
+	var token strings.Builder
+
+	quoted := false
+
+	flush := func() {
+		if token.Len() == 0 {
+			return
+		}
+
+		parts := strings.SplitN(token.String(), "=", 2)
+		param := svcParam{Key: strings.ToLower(parts[0])}
+
+		if len(parts) == 2 {
+			param.Value = parts[1]
+		}
+
+		params = append(params, param)
+		token.Reset()
+	}
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		switch {
+		case c == '\\' && i+1 < len(value):
+			token.WriteByte(c)
+			token.WriteByte(value[i+1])
+			i++
+		case c == '"':
+			quoted = !quoted
+			token.WriteByte(c)
+		case (c == ' ' || c == '\t') && !quoted:
+			flush()
+		default:
+			token.WriteByte(c)
+		}
+	}
+
+	flush()
+
+	return params
+}
+
+func formatSvcParams(params []svcParam) string {
+	parts := make([]string, 0, len(params))
+
+	for _, param := range params {
+		if param.Value == "" {
+			parts = append(parts, param.Key)
+		} else {
+			parts = append(parts, param.Key+"="+param.Value)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// replaceAddressHint sets the ipv4hint or ipv6hint param to the address, keeping all other params. The record owns the
+// whole hint of the family, a list of several addresses is replaced by the current one. A hint naming just the address
+// already, quoted or not, leaves the value as it is.
+func replaceAddressHint(value string, ip net.IP) string {
+	key := "ipv6hint"
+	if ip.To4() != nil {
+		key = "ipv4hint"
+	}
+
+	params := parseSvcParams(value)
+	hint := svcParam{Key: key, Value: `"` + ip.String() + `"`}
+	found, changed := false, false
+
+	for i := range params {
+		if params[i].Key != key {
+			continue
+		}
+
+		found = true
+
+		if !hintIsAddress(params[i].Value, ip) {
+			params[i] = hint
+			changed = true
+		}
+	}
+
+	if found && !changed {
+		return value
+	}
+
+	if !found {
+		params = append(params, hint)
+	}
+
+	sort.SliceStable(params, func(i, j int) bool {
+		return svcParamKeyNumber(params[i].Key) < svcParamKeyNumber(params[j].Key)
+	})
+
+	return formatSvcParams(params)
+}
+
+// hintIsAddress tells if the comma-separated addresses of a hint value consist of the address alone.
+func hintIsAddress(value string, ip net.IP) bool {
+	addresses := strings.Split(strings.Trim(value, `"`), ",")
+
+	return len(addresses) == 1 && ip.Equal(net.ParseIP(strings.TrimSpace(addresses[0])))
+}
+
+// doHintAction replaces the address hint of all HTTPS / SVCB records of the action, keeping priority, target and
+// all other params. Records are never created.
+func (u *Updater) doHintAction(action *Action, ip *net.IP, actionResults chan<- ActionResult) {
+	records, err := u.listRecords(action.CfZoneId, action.RecordType, action.DnsRecord, "")
+
+	if err != nil {
+		actionResults <- ActionResult{action, OperationResearch, "", "", u.DryRun, err}
+		return
+	}
+
+	if len(records) == 0 {
+		u.log.WithField("domain", action.DnsRecord).Warn(
+			"No " + action.RecordType + " record found, address hints are only maintained in existing records")
+		return
+	}
+
+	for _, record := range records {
+		var data svcbData
+
+		if err := recordData(record, &data); err != nil {
+			actionResults <- ActionResult{action, OperationResearch, record.ID, "", u.DryRun, err}
+			continue
+		}
+
+		value := replaceAddressHint(data.Value, *ip)
+		content := strconv.Itoa(data.Priority) + " " + data.Target + " " + value
+
+		if value == data.Value {
+			actionResults <- ActionResult{action, OperationUnchanged, record.ID, content, u.DryRun, nil}
+			continue
+		}
+
+		data.Value = value
+
+		if u.DryRun {
+			actionResults <- ActionResult{action, OperationUpdate, record.ID, content, true, nil}
+			continue
+		}
+
+		err := u.updateRecord(action.CfZoneId, record.ID, dnsRecordUpdate{Data: data})
+
+		actionResults <- ActionResult{action, OperationUpdate, record.ID, content, false, err}
+	}
+}
+
+// doSrvAction updates the A / AAAA records of the targets of all SRV records of the action, which keep their priority,
+// weight, port and target. Targets are looked up in the zone of the SRV record. Ownership applies to the target
+// records like to configured ones, they are never created.
+func (u *Updater) doSrvAction(action *Action, ip *net.IP, actionResults chan<- ActionResult) {
+	records, err := u.listRecords(action.CfZoneId, RecordTypeSRV, action.DnsRecord, "")
+
+	if err != nil {
+		actionResults <- ActionResult{action, OperationResearch, "", "", u.DryRun, err}
+		return
+	}
+
+	if len(records) == 0 {
+		u.log.WithField("domain", action.DnsRecord).Warn("No SRV record found, targets are only maintained for existing records")
+		return
+	}
+
+	recordType := "A"
+	if ip.To4() == nil {
+		recordType = "AAAA"
+	}
+
+	content := ip.String()
+	seen := make(map[string]bool)
+
+	for _, record := range records {
+		var data srvData
+
+		if err := recordData(record, &data); err != nil {
+			actionResults <- ActionResult{action, OperationResearch, record.ID, "", u.DryRun, err}
+			continue
+		}
+
+		// "." tells that the service is not available
+		target := normalizeName(data.Target)
+		if target == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		targetAction := &Action{DnsRecord: target, CfZoneId: action.CfZoneId, IpVersion: action.IpVersion}
+		targets, err := u.listRecords(action.CfZoneId, recordType, target, "")
+
+		if err != nil {
+			actionResults <- ActionResult{targetAction, OperationResearch, "", "", u.DryRun, err}
+			continue
+		}
+
+		if len(targets) == 0 {
+			u.log.WithField("domain", target).WithField("srv", action.DnsRecord).Warn(
+				"No " + recordType + " record of the SRV target found in the zone of the SRV record")
+			continue
+		}
+
+		managed, unmanaged := u.partitionRecords(targets)
+
+		// Records without the ownership marker were created by hand and are left alone, unless adoption is allowed
+		adopt := false
+
+		if len(managed) == 0 {
+			if !u.AdoptRecords {
+				for _, targetRecord := range unmanaged {
+					actionResults <- ActionResult{targetAction, OperationSkip, targetRecord.ID, targetRecord.Content, u.DryRun, nil}
+				}
+				continue
+			}
+
+			managed = unmanaged[:1]
+			adopt = true
+		}
+
+		operation := OperationUpdate
+		if adopt {
+			operation = OperationAdopt
+		}
+
+		for _, targetRecord := range managed {
+			update := u.recordUpdate(targetAction, targetRecord, content, adopt)
+
+			if update.unchanged(targetRecord) {
+				actionResults <- ActionResult{targetAction, OperationUnchanged, targetRecord.ID, targetRecord.Content, u.DryRun, nil}
+				continue
+			}
+
+			if u.DryRun {
+				actionResults <- ActionResult{targetAction, operation, targetRecord.ID, content, true, nil}
+				continue
+			}
+
+			err := u.updateRecord(action.CfZoneId, targetRecord.ID, update)
+
+			actionResults <- ActionResult{targetAction, operation, targetRecord.ID, content, false, err}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package cloudflare
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/fake_cloudflare"
+)
+
+func TestReplaceAddressHint(t *testing.T) {
+	tests := []struct {
+		value string
+		ip    string
+		want  string
+	}{
+		{`alpn="h2,h3"`, "192.0.2.1", `alpn="h2,h3" ipv4hint="192.0.2.1"`},
+		{`alpn=h2 ipv4hint="192.0.2.1" ipv6hint="2001:db8::1"`, "192.0.2.2", `alpn=h2 ipv4hint="192.0.2.2" ipv6hint="2001:db8::1"`},
+		{`ipv6hint="2001:db8::1" port=8443`, "2001:db8::2", `port=8443 ipv6hint="2001:db8::2"`},
+		// the hint naming the address already is left alone, whatever its quoting and spacing
+		{`alpn=h2  ipv4hint=192.0.2.1`, "192.0.2.1", `alpn=h2  ipv4hint=192.0.2.1`},
+		{`ipv6hint="2001:0db8::0001"`, "2001:db8::1", `ipv6hint="2001:0db8::0001"`},
+		// the record owns the whole hint of the family
+		{`ipv4hint="192.0.2.1,192.0.2.9"`, "192.0.2.1", `ipv4hint="192.0.2.1"`},
+		{`ipv4hint=192.0.2.8,192.0.2.9`, "192.0.2.1", `ipv4hint="192.0.2.1"`},
+	}
+
+	for _, test := range tests {
+		if got := replaceAddressHint(test.value, net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("%s with %s is %s, want %s", test.value, test.ip, got, test.want)
+		}
+	}
+}
+
+func TestUpdaterHintRecords(t *testing.T) {
+	fake, zone, baseURL := newFakeAPI(t)
+
+	for _, record := range []fake_cloudflare.Record{
+		{Type: "HTTPS", Name: "example.com", Data: map[string]interface{}{"priority": 1, "target": ".", "value": `alpn="h2" ipv4hint=192.0.2.1`}},
+		{Type: "SRV", Name: "_sip._udp.example.com", Data: map[string]interface{}{"priority": 10, "weight": 5, "port": 5060, "target": "sip.example.com"}},
+		{Type: "SRV", Name: "_sip._udp.example.com", Data: map[string]interface{}{"priority": 20, "weight": 5, "port": 5060, "target": "sip.example.com."}},
+		{Type: "A", Name: "sip.example.com", Content: "192.0.2.1", Tags: []string{ownerMarker}},
+		{Type: "A", Name: "www.example.com", Content: "192.0.2.1"},
+	} {
+		if _, err := fake.AddRecord(zone.ID, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u := newTestUpdater(t, baseURL, testToken, 0)
+	u.ipv4Zones, u.ipv6Zones = nil, nil
+	u.Ownership = OwnershipTag
+	u.AddHintRecord(HintRecord{Name: "example.com", Type: RecordTypeHTTPS, IPv4: true})
+	u.AddHintRecord(HintRecord{Name: "_sip._udp.example.com", Type: RecordTypeSRV, IPv4: true})
+
+	tests := []struct {
+		ip         string
+		operations string
+		content    map[string]string
+	}{
+		// the unquoted hint and the target are up to date already
+		{"192.0.2.1", "unchanged,unchanged", map[string]string{
+			"example.com":     `1 . alpn="h2" ipv4hint=192.0.2.1`,
+			"sip.example.com": "192.0.2.1",
+			"www.example.com": "192.0.2.1",
+		}},
+		{"192.0.2.2", "update,update", map[string]string{
+			"example.com":     `1 . alpn="h2" ipv4hint="192.0.2.2"`,
+			"sip.example.com": "192.0.2.2",
+			"www.example.com": "192.0.2.1",
+		}},
+		{"2001:db8::1", "", nil},
+	}
+
+	srv := make(map[string]string)
+	for _, record := range fake.Records(zone.ID) {
+		if record.Type == RecordTypeSRV {
+			srv[record.ID] = record.Content
+		}
+	}
+
+	for _, test := range tests {
+		operations, err := runUpdate(t, u, test.ip)
+		if err != nil {
+			t.Fatalf("update to %s: %v", test.ip, err)
+		}
+
+		if got := strings.Join(operations, ","); got != test.operations {
+			t.Errorf("update to %s reported %s, want %s", test.ip, got, test.operations)
+		}
+
+		for _, record := range fake.Records(zone.ID) {
+			if want, ok := test.content[record.Name]; ok && record.Content != want {
+				t.Errorf("after the update to %s %s %s is %q, want %q", test.ip, record.Type, record.Name, record.Content, want)
+			}
+
+			// SRV records keep priority, weight, port and target
+			if want, ok := srv[record.ID]; ok && record.Content != want {
+				t.Errorf("SRV record %s changed to %q", record.ID, record.Content)
+			}
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/history"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+	cf "github.com/cloudflare/cloudflare-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// KVProviderName identifies the Workers KV updater in the history and the outbox
+const KVProviderName = "cloudflare_kv"
+
+// KVDocument is the JSON value written to the Workers KV key on every change
+type KVDocument struct {
+	IPv4      string    `json:"ipv4,omitempty"`
+	IPv6      string    `json:"ipv6,omitempty"`
+	Prefix    string    `json:"prefix,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Source    string    `json:"source,omitempty"`
+}
+
+// KVRecordDocument is the JSON value written to the key of a record name, holding the addresses of its families
+type KVRecordDocument struct {
+	Name      string    `json:"name"`
+	IPv4      string    `json:"ipv4,omitempty"`
+	IPv6      string    `json:"ipv6,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// KVUpdater publishes the current addresses as a JSON document to a Workers KV namespace, optionally along with one
+// key per record name.
+type KVUpdater struct {
+	log *log.Entry
+
+	accountId   string
+	namespaceId string
+	key         string
+
+	// records per family that get their own key, named by the prefix and the record name
+	recordPrefix string
+	ipv4Records  []string
+	ipv6Records  []string
+
+	mu       sync.Mutex
+	document KVDocument
+
+	isInit bool
+	api    *cf.API
+
+	// APIOptions configure the client, if set before the init
+	APIOptions APIOptions
+
+	In chan *events.IPUpdate
+
+	// DryRun only logs the documents instead of writing them
+	DryRun bool
+
+	// History journals the outcome of every write, if set
+	History *history.Journal
+
+	// Outbox stores failed writes for a later retry, if set
+	Outbox *outbox.Outbox
+}
+
+func NewKVUpdater() *KVUpdater {
+	return &KVUpdater{
+		log:        log.WithField("module", "cloudflare_kv"),
+		APIOptions: APIOptions{Timeout: DefaultTimeout, MaxRetries: DefaultMaxRetries},
+		isInit:     false,
+		In:         make(chan *events.IPUpdate, 10),
+	}
+}
+
+// SetKey sets the account, namespace ID and key the document is written to.
+func (u *KVUpdater) SetKey(accountId string, namespaceId string, key string) {
+	u.accountId = accountId
+	u.namespaceId = namespaceId
+	u.key = key
+}
+
+// SetRecordKeys writes a key per record name in addition to the document, named by the prefix and the record name.
+func (u *KVUpdater) SetRecordKeys(prefix string, ipv4Records []string, ipv6Records []string) {
+	u.recordPrefix = prefix
+	u.ipv4Records = ipv4Records
+	u.ipv6Records = ipv6Records
+}
+
+// Remember sets an address known from before the start, along with the prefix of an IPv6 address, so the first write
+// does not drop the other family.
+func (u *KVUpdater) Remember(ip net.IP, prefix *net.IPNet) {
+	if ip == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if ip.To4() != nil {
+		u.document.IPv4 = ip.String()
+	} else {
+		u.document.IPv6 = ip.String()
+
+		if prefix != nil {
+			u.document.Prefix = prefix.String()
+		}
+	}
+}
+
+func (u *KVUpdater) InitWithToken(token string) error {
+	api, err := cf.NewWithAPIToken(token, append(u.APIOptions.options(), cf.UsingAccount(u.accountId))...)
+
+	if err != nil {
+		return err
+	}
+
+	return u.init(api)
+}
+
+func (u *KVUpdater) InitWithKey(email string, key string) error {
+	api, err := cf.New(key, email, append(u.APIOptions.options(), cf.UsingAccount(u.accountId))...)
+
+	if err != nil {
+		return err
+	}
+
+	return u.init(api)
+}
+
+func (u *KVUpdater) init(api *cf.API) error {
+	u.api = api
+	u.isInit = true
+
+	return nil
+}
+
+func (u *KVUpdater) StartWorker() {
+	go u.spawnWorker()
+}
+
+func (u *KVUpdater) spawnWorker() {
+	for {
+		select {
+		case update := <-u.In:
+			if !u.isInit {
+				continue
+			}
+
+			u.log.WithField("ip", update.IP).Info("Received update request")
+
+			u.apply(update)
+			err := u.write(update.IP)
+
+			if u.DryRun {
+				continue
+			}
+
+			if err != nil {
+				u.Outbox.Enqueue(KVProviderName, u.key, update, err)
+			} else {
+				u.Outbox.Complete(KVProviderName, u.key, update.IP)
+			}
+		}
+	}
+}
+
+// Retry writes the current document again, applying the address of the operation if none is known for its family.
+func (u *KVUpdater) Retry(op *outbox.Operation) error {
+	if !u.isInit {
+		return errors.New("cloudflare kv updater is not initialized")
+	}
+
+	update := op.Update()
+
+	u.mu.Lock()
+	known := u.document.IPv4
+	if update.IP.To4() == nil {
+		known = u.document.IPv6
+	}
+	u.mu.Unlock()
+
+	// a newer address received since the failure takes precedence
+	if known == "" {
+		u.apply(update)
+	}
+
+	return u.write(update.IP)
+}
+
+func (u *KVUpdater) apply(update *events.IPUpdate) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if update.IP.To4() != nil {
+		u.document.IPv4 = update.IP.String()
+	} else {
+		u.document.IPv6 = update.IP.String()
+
+		if update.Prefix != nil {
+			u.document.Prefix = update.Prefix.String()
+		} else {
+			u.document.Prefix = ""
+		}
+	}
+
+	u.document.UpdatedAt = time.Now().UTC()
+	u.document.Source = update.Source
+}
+
+// write stores the document and the record keys in a single bulk write.
+func (u *KVUpdater) write(ip net.IP) error {
+	u.mu.Lock()
+	document := u.document
+	u.mu.Unlock()
+
+	pairs, err := u.pairs(document)
+
+	if err != nil {
+		return err
+	}
+
+	klog := u.log.WithField("namespace", u.namespaceId).WithField("key", u.key).WithField("keys", len(pairs))
+
+	if u.DryRun {
+		for _, pair := range pairs {
+			klog.WithField("key", pair.Key).WithField("value", pair.Value).Info("Dry run, would write Workers KV value")
+		}
+
+		u.History.RecordUpdate(KVProviderName, u.key, ip, true, nil)
+		return nil
+	}
+
+	_, err = u.api.WriteWorkersKVBulk(context.Background(), u.namespaceId, pairs)
+
+	if err != nil {
+		klog.WithError(err).Error("Failed to write Workers KV values")
+	} else {
+		klog.Info("Wrote Workers KV values")
+	}
+
+	u.History.RecordUpdate(KVProviderName, u.key, ip, false, err)
+
+	return err
+}
+
+func (u *KVUpdater) pairs(document KVDocument) (cf.WorkersKVBulkWriteRequest, error) {
+	value, err := json.Marshal(document)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := cf.WorkersKVBulkWriteRequest{{Key: u.key, Value: string(value)}}
+
+	records := make(map[string]*KVRecordDocument)
+	var names []string
+
+	add := func(name string) *KVRecordDocument {
+		if record, ok := records[name]; ok {
+			return record
+		}
+
+		records[name] = &KVRecordDocument{Name: name, UpdatedAt: document.UpdatedAt}
+		names = append(names, name)
+
+		return records[name]
+	}
+
+	for _, name := range u.ipv4Records {
+		add(name).IPv4 = document.IPv4
+	}
+
+	for _, name := range u.ipv6Records {
+		add(name).IPv6 = document.IPv6
+	}
+
+	for _, name := range names {
+		value, err := json.Marshal(records[name])
+
+		if err != nil {
+			return nil, err
+		}
+
+		pairs = append(pairs, &cf.WorkersKVPair{Key: u.recordPrefix + name, Value: string(value)})
+	}
+
+	return pairs, nil
+}
@@ -0,0 +1,305 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/history"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+	cf "github.com/cloudflare/cloudflare-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// ListProviderName identifies the IP list updater in the history and the outbox
+const ListProviderName = "cloudflare_lists"
+
+// listPrefixLength is used for IPv6 items if the address was not constructed from a prefix
+const listPrefixLength = 64
+
+// ListUpdater keeps the items of account level IP lists, as used by WAF rules and Access policies, equal to the
+// current IPv4 address and IPv6 prefix. Items without the ownership marker in their comment are left alone.
+type ListUpdater struct {
+	log *log.Entry
+
+	accountId string
+	lists     []string
+
+	mu      sync.Mutex
+	listIds map[string]string
+	// current list item per family
+	current map[string]string
+
+	isInit bool
+	api    *cf.API
+
+	// APIOptions configure the client, if set before the init
+	APIOptions APIOptions
+
+	In chan *events.IPUpdate
+
+	// DryRun only logs the replacements instead of sending them
+	DryRun bool
+
+	// History journals the outcome of every replacement, if set
+	History *history.Journal
+
+	// Outbox stores failed replacements for a later retry, if set
+	Outbox *outbox.Outbox
+}
+
+func NewListUpdater() *ListUpdater {
+	return &ListUpdater{
+		log:        log.WithField("module", "cloudflare_lists"),
+		current:    make(map[string]string),
+		APIOptions: APIOptions{Timeout: DefaultTimeout, MaxRetries: DefaultMaxRetries},
+		isInit:     false,
+		In:         make(chan *events.IPUpdate, 10),
+	}
+}
+
+// SetLists sets the account and the comma-separated names or IDs of its IP lists to keep in sync.
+func (u *ListUpdater) SetLists(accountId string, lists string) {
+	u.accountId = accountId
+	u.lists = splitList(lists)
+}
+
+func (u *ListUpdater) InitWithToken(token string) error {
+	api, err := cf.NewWithAPIToken(token, u.APIOptions.options()...)
+
+	if err != nil {
+		return err
+	}
+
+	return u.init(api)
+}
+
+func (u *ListUpdater) InitWithKey(email string, key string) error {
+	api, err := cf.New(key, email, u.APIOptions.options()...)
+
+	if err != nil {
+		return err
+	}
+
+	return u.init(api)
+}
+
+// init only stores the client, the list IDs are resolved lazily on the first update.
+func (u *ListUpdater) init(api *cf.API) error {
+	u.api = api
+	u.isInit = true
+
+	return nil
+}
+
+func (u *ListUpdater) StartWorker() {
+	go u.spawnWorker()
+}
+
+func (u *ListUpdater) spawnWorker() {
+	for {
+		select {
+		case update := <-u.In:
+			if !u.isInit {
+				continue
+			}
+
+			u.log.WithField("ip", update.IP).Info("Received update request")
+
+			u.mu.Lock()
+			u.current[update.Family()] = listItem(update)
+			u.mu.Unlock()
+
+			for _, list := range u.lists {
+				err := u.syncList(list)
+
+				if u.DryRun {
+					continue
+				}
+
+				if err != nil {
+					u.Outbox.Enqueue(ListProviderName, list, update, err)
+				} else {
+					u.Outbox.Complete(ListProviderName, list, update.IP)
+				}
+			}
+		}
+	}
+}
+
+// Retry synchronizes the list of an operation stored in the outbox again.
+func (u *ListUpdater) Retry(op *outbox.Operation) error {
+	if !u.isInit {
+		return errors.New("cloudflare list updater is not initialized")
+	}
+
+	update := op.Update()
+
+	u.mu.Lock()
+	// a newer address received since the failure takes precedence
+	if _, ok := u.current[update.Family()]; !ok {
+		u.current[update.Family()] = listItem(update)
+	}
+	u.mu.Unlock()
+
+	return u.syncList(op.Target)
+}
+
+// listItem returns the IPv4 address or the IPv6 prefix of the update, as IP lists do not take single IPv6 addresses.
+func listItem(update *events.IPUpdate) string {
+	if update.IP.To4() != nil {
+		return update.IP.String()
+	}
+
+	if update.Prefix != nil {
+		if ones, _ := update.Prefix.Mask.Size(); ones <= listPrefixLength {
+			return update.Prefix.String()
+		}
+	}
+
+	prefix := net.IPNet{IP: update.IP.Mask(net.CIDRMask(listPrefixLength, 128)), Mask: net.CIDRMask(listPrefixLength, 128)}
+
+	return prefix.String()
+}
+
+// itemFamily returns the family of an address or prefix list item.
+func itemFamily(item string) string {
+	ip, _, err := net.ParseCIDR(item)
+
+	if err != nil {
+		ip = net.ParseIP(item)
+	}
+
+	if ip == nil {
+		return ""
+	}
+
+	return events.Family(ip)
+}
+
+// resolveListId returns the ID of a list given by name or ID.
+func (u *ListUpdater) resolveListId(list string) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.listIds == nil {
+		lists, err := u.api.ListIPLists(context.Background(), u.accountId)
+
+		if err != nil {
+			return "", err
+		}
+
+		u.listIds = make(map[string]string, len(lists))
+
+		for _, l := range lists {
+			u.listIds[l.Name] = l.ID
+			u.listIds[l.ID] = l.ID
+		}
+	}
+
+	id, ok := u.listIds[list]
+
+	if !ok {
+		// the list may be created later on, look it up again next time
+		u.listIds = nil
+		return "", fmt.Errorf("IP list %s not found in account %s", list, u.accountId)
+	}
+
+	return id, nil
+}
+
+// syncList replaces the managed items of the list with the current addresses in a single bulk operation.
+// Managed items of a family without a current address yet are kept.
+func (u *ListUpdater) syncList(list string) error {
+	llog := u.log.WithField("list", list)
+
+	id, err := u.resolveListId(list)
+
+	if err != nil {
+		llog.WithError(err).Error("Failed to resolve IP list")
+		return err
+	}
+
+	items, err := u.api.ListIPListItems(context.Background(), u.accountId, id)
+
+	if err != nil {
+		llog.WithError(err).Error("Failed to list IP list items")
+		return err
+	}
+
+	u.mu.Lock()
+	current := make(map[string]string, len(u.current))
+	for family, item := range u.current {
+		current[family] = item
+	}
+	u.mu.Unlock()
+
+	var replacement []cf.IPListItemCreateRequest
+	var removed []string
+
+	for _, item := range items {
+		if !strings.Contains(item.Comment, ownerMarker) {
+			replacement = append(replacement, cf.IPListItemCreateRequest{IP: item.IP, Comment: item.Comment})
+			continue
+		}
+
+		if _, ok := current[itemFamily(item.IP)]; ok {
+			removed = append(removed, item.IP)
+			continue
+		}
+
+		replacement = append(replacement, cf.IPListItemCreateRequest{IP: item.IP, Comment: item.Comment})
+	}
+
+	var added []string
+
+	for family, item := range current {
+		added = append(added, item)
+		replacement = append(replacement, cf.IPListItemCreateRequest{IP: item, Comment: fmt.Sprintf("%s %s", ownerMarker, family)})
+	}
+
+	sort.Strings(removed)
+	sort.Strings(added)
+
+	if strings.Join(removed, ",") == strings.Join(added, ",") {
+		llog.WithField("items", added).Info("IP list is up to date")
+		return nil
+	}
+
+	llog = llog.WithField("removed", removed).WithField("added", added)
+
+	if u.DryRun {
+		llog.Info("Dry run, would replace IP list items")
+		u.recordHistory(list, current, true, nil)
+		return nil
+	}
+
+	_, err = u.api.ReplaceIPListItems(context.Background(), u.accountId, id, replacement)
+
+	if err != nil {
+		llog.WithError(err).Error("Failed to replace IP list items")
+	} else {
+		llog.Info("Replaced IP list items")
+	}
+
+	u.recordHistory(list, current, false, err)
+
+	return err
+}
+
+func (u *ListUpdater) recordHistory(list string, current map[string]string, dryRun bool, err error) {
+	for _, item := range current {
+		ip, _, parseErr := net.ParseCIDR(item)
+
+		if parseErr != nil {
+			ip = net.ParseIP(item)
+		}
+
+		u.History.RecordUpdate(ListProviderName, list, ip, dryRun, err)
+	}
+}
@@ -0,0 +1,79 @@
+package cloudflare
+
+import (
+	"sort"
+	"strings"
+)
+
+// Ownership modes, deciding how records created by this service are marked
+const (
+	OwnershipOff     = "off"
+	OwnershipComment = "comment"
+	OwnershipTag     = "tag"
+)
+
+// ownerMarker is added to the comment or the tags of every managed record
+const ownerMarker = "managed-by:router-dyndns-helper"
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isManaged tells if the record carries the ownership marker, all records are managed with ownership turned off.
+func (u *Updater) isManaged(record dnsRecord) bool {
+	switch u.Ownership {
+	case OwnershipComment:
+		return strings.Contains(record.Comment, ownerMarker)
+	case OwnershipTag:
+		return hasTag(record.Tags, ownerMarker)
+	default:
+		return true
+	}
+}
+
+// partitionRecords splits records into managed (oldest first) and unmanaged ones.
+func (u *Updater) partitionRecords(records []dnsRecord) ([]dnsRecord, []dnsRecord) {
+	var managed, unmanaged []dnsRecord
+
+	for _, record := range records {
+		if u.isManaged(record) {
+			managed = append(managed, record)
+		} else {
+			unmanaged = append(unmanaged, record)
+		}
+	}
+
+	sort.SliceStable(managed, func(i, j int) bool {
+		return managed[i].CreatedOn.Before(managed[j].CreatedOn)
+	})
+
+	return managed, unmanaged
+}
+
+// markComment adds the ownership marker to a comment, if ownership is tracked by comments.
+func (u *Updater) markComment(comment string) string {
+	if u.Ownership != OwnershipComment || strings.Contains(comment, ownerMarker) {
+		return comment
+	}
+
+	if comment == "" {
+		return ownerMarker
+	}
+
+	return comment + " " + ownerMarker
+}
+
+// markTags adds the ownership marker to the tags, if ownership is tracked by tags.
+func (u *Updater) markTags(tags []string) []string {
+	if u.Ownership != OwnershipTag || hasTag(tags, ownerMarker) {
+		return tags
+	}
+
+	return append(append([]string{}, tags...), ownerMarker)
+}
@@ -0,0 +1,171 @@
+package cloudflare
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	cf "github.com/cloudflare/cloudflare-go"
+	"golang.org/x/net/idna"
+)
+
+// dnsRecord extends the cloudflare-go record with the comment and tags fields the vendored version does not
+// know about yet. All record calls go through API.Raw, so these fields survive the round trip.
+type dnsRecord struct {
+	cf.DNSRecord
+	Comment string   `json:"comment,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// dnsRecordUpdate is the PATCH body of a record update, only non-nil fields are changed.
+type dnsRecordUpdate struct {
+	Type    string    `json:"type,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Content string    `json:"content,omitempty"`
+	TTL     int       `json:"ttl,omitempty"`
+	Proxied *bool     `json:"proxied,omitempty"`
+	Comment *string   `json:"comment,omitempty"`
+	Tags    *[]string `json:"tags,omitempty"`
+	// Data is the structured content of record types like HTTPS / SVCB
+	Data interface{} `json:"data,omitempty"`
+}
+
+const recordsPerPage = 100
+
+func toASCII(name string) string {
+	if ascii, err := idna.Lookup.ToASCII(name); err == nil {
+		return ascii
+	}
+
+	return name
+}
+
+// listRecords fetches all records of a zone matching the record type, name and content, empty filters match all.
+func listRecords(api *cf.API, zoneId string, recordType string, name string, content string) ([]dnsRecord, error) {
+	v := url.Values{}
+	v.Set("per_page", strconv.Itoa(recordsPerPage))
+
+	if recordType != "" {
+		v.Set("type", recordType)
+	}
+
+	if name != "" {
+		v.Set("name", toASCII(name))
+	}
+
+	if content != "" {
+		v.Set("content", content)
+	}
+
+	var records []dnsRecord
+
+	for page := 1; ; page++ {
+		v.Set("page", strconv.Itoa(page))
+
+		res, err := api.Raw(http.MethodGet, fmt.Sprintf("/zones/%s/dns_records?%s", zoneId, v.Encode()), nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var result []dnsRecord
+
+		if err := json.Unmarshal(res, &result); err != nil {
+			return nil, err
+		}
+
+		records = append(records, result...)
+
+		// Raw drops the result_info, a short page is the last one
+		if len(result) < recordsPerPage {
+			return records, nil
+		}
+	}
+}
+
+func createRecord(api *cf.API, zoneId string, record dnsRecord) (dnsRecord, error) {
+	record.Name = toASCII(record.Name)
+
+	res, err := api.Raw(http.MethodPost, fmt.Sprintf("/zones/%s/dns_records", zoneId), record)
+
+	if err != nil {
+		return dnsRecord{}, err
+	}
+
+	var created dnsRecord
+	err = json.Unmarshal(res, &created)
+
+	return created, err
+}
+
+func updateRecord(api *cf.API, zoneId string, recordId string, update dnsRecordUpdate) (dnsRecord, error) {
+	res, err := api.Raw(http.MethodPatch, fmt.Sprintf("/zones/%s/dns_records/%s", zoneId, recordId), update)
+
+	if err != nil {
+		return dnsRecord{}, err
+	}
+
+	var updated dnsRecord
+	err = json.Unmarshal(res, &updated)
+
+	return updated, err
+}
+
+// unchanged tells if the update would leave the record as it is.
+func (update dnsRecordUpdate) unchanged(record dnsRecord) bool {
+	if update.Content != "" && update.Content != record.Content {
+		ip := net.ParseIP(update.Content)
+
+		if ip == nil || !ip.Equal(net.ParseIP(record.Content)) {
+			return false
+		}
+	}
+
+	if update.TTL != 0 && update.TTL != record.TTL {
+		return false
+	}
+
+	if update.Proxied != nil && (record.Proxied == nil || *update.Proxied != *record.Proxied) {
+		return false
+	}
+
+	if update.Comment != nil && *update.Comment != record.Comment {
+		return false
+	}
+
+	if update.Tags != nil && !sameTags(*update.Tags, record.Tags) {
+		return false
+	}
+
+	return update.Data == nil
+}
+
+// sameTags tells if both lists hold the same tags, the API does not keep their order.
+func sameTags(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func deleteRecord(api *cf.API, zoneId string, recordId string) error {
+	_, err := api.Raw(http.MethodDelete, fmt.Sprintf("/zones/%s/dns_records/%s", zoneId, recordId), nil)
+
+	return err
+}
@@ -0,0 +1,36 @@
+package cloudflare
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnchangedTags(t *testing.T) {
+	tests := []struct {
+		update    []string
+		record    []string
+		unchanged bool
+	}{
+		{[]string{"a:1", "b:2"}, []string{"a:1", "b:2"}, true},
+		{[]string{"b:2", ownerMarker, "a:1"}, []string{ownerMarker, "a:1", "b:2"}, true},
+		{[]string{}, nil, true},
+		{[]string{"a:1", "b:2"}, []string{"a:1"}, false},
+		{[]string{"a:1", "a:1"}, []string{"a:1", "b:2"}, false},
+		{[]string{"a,b"}, []string{"a", "b"}, false},
+	}
+
+	for _, test := range tests {
+		tags := append([]string(nil), test.update...)
+		update := dnsRecordUpdate{Tags: &tags}
+		record := dnsRecord{Tags: test.record}
+
+		if got := update.unchanged(record); got != test.unchanged {
+			t.Errorf("tags %v against %v unchanged %v, want %v", test.update, test.record, got, test.unchanged)
+		}
+
+		// the update is sent as it is, sorting must not change it
+		if strings.Join(tags, "|") != strings.Join(test.update, "|") {
+			t.Errorf("tags of the update reordered to %v", tags)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package cloudflare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+	cf "github.com/cloudflare/cloudflare-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the API calls
+const (
+	DefaultTimeout     = 30 * time.Second
+	DefaultMaxRetries  = 3
+	DefaultConcurrency = 4
+)
+
+// Bounds of the delay between retries of rate limited or failed calls
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// APIOptions configure the client of an updater, they have to be set before the init.
+type APIOptions struct {
+	// BaseURL overrides the API endpoint, i.e. to point at a fake API
+	BaseURL string
+	// Timeout limits every single call, retries get a fresh timeout
+	Timeout time.Duration
+	// MaxRetries of calls answered with 429 or 5xx, or failing on the network level. Calls creating or changing
+	// records are retried on 5xx and network errors only if they cannot have reached the API, see retryable.
+	MaxRetries int
+	// Token or Key replace the credentials of the init on every call, so rotated secret files are picked up
+	Token *secrets.Secret
+	Key   *secrets.Secret
+}
+
+func (o APIOptions) options() []cf.Option {
+	timeout := o.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	options := []cf.Option{
+		cf.HTTPClient(&http.Client{Transport: &retryTransport{
+			next:       http.DefaultTransport,
+			timeout:    timeout,
+			maxRetries: o.MaxRetries,
+			token:      o.Token,
+			key:        o.Key,
+			log:        log.WithField("module", "cloudflare"),
+		}}),
+		// retries are left to the transport, which honors Retry-After
+		cf.UsingRetryPolicy(0, 0, 0),
+	}
+
+	if o.BaseURL != "" {
+		options = append(options, cf.BaseURL(strings.TrimSuffix(o.BaseURL, "/")))
+	}
+
+	return options
+}
+
+// retryTransport retries calls answered with 429 or 5xx and network errors with exponential backoff, waiting at least
+// as long as a Retry-After header asks for. Every attempt is limited by the timeout. Only idempotent calls are retried
+// on any of them, see retryable.
+type retryTransport struct {
+	next       http.RoundTripper
+	timeout    time.Duration
+	maxRetries int
+	token      *secrets.Secret
+	key        *secrets.Secret
+	log        *log.Entry
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := minRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		attemptReq, cancel, err := t.prepare(req, attempt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := t.next.RoundTrip(attemptReq)
+
+		if !retryable(req.Method, res, err) || attempt >= t.maxRetries {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+
+			// the timeout also covers reading the body, release it once the body is closed
+			res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+			return res, nil
+		}
+
+		wait := delay
+
+		if err != nil {
+			cancel()
+			t.log.WithError(err).Warn(fmt.Sprintf("Cloudflare API call failed, retrying in %s", wait))
+		} else {
+			if retryAfter := parseRetryAfter(res.Header.Get("Retry-After")); retryAfter > wait {
+				wait = retryAfter
+			}
+
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			_ = res.Body.Close()
+			cancel()
+
+			t.log.WithField("status", res.StatusCode).Warn(fmt.Sprintf("Cloudflare API call was rejected, retrying in %s", wait))
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// retryable tells if an attempt can be repeated. A rate limited call was not processed, so it is retried whatever the
+// method. After a 5xx or a network error a POST or PATCH may have been applied already, i.e. a record created right
+// before the gateway timed out, so those are only retried if the connection could not be established at all.
+func retryable(method string, res *http.Response, err error) bool {
+	if err == nil && res.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+
+	if err == nil && res.StatusCode < 500 {
+		return false
+	}
+
+	switch method {
+	case http.MethodPost, http.MethodPatch:
+		var opErr *net.OpError
+		return err != nil && errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+
+	return true
+}
+
+// prepare clones the request for an attempt with its own timeout and a fresh body.
+func (t *retryTransport) prepare(req *http.Request, attempt int) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	attemptReq := req.Clone(ctx)
+
+	if token := t.token.Value(); token != "" {
+		attemptReq.Header.Set("Authorization", "Bearer "+token)
+	} else if key := t.key.Value(); key != "" {
+		attemptReq.Header.Set("X-Auth-Key", key)
+	}
+
+	if attempt > 0 && req.Body != nil {
+		if req.GetBody == nil {
+			cancel()
+			return nil, nil, fmt.Errorf("cannot retry %s %s, the request body cannot be read again", req.Method, req.URL.Path)
+		}
+
+		body, err := req.GetBody()
+
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+
+		attemptReq.Body = body
+	}
+
+	return attemptReq, cancel, nil
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date, zero if missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+
+	return 0
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
@@ -1,42 +1,160 @@
 package cloudflare
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/history"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
 	cf "github.com/cloudflare/cloudflare-go"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/publicsuffix"
 )
 
 type Action struct {
 	DnsRecord string
 	CfZoneId  string
 	IpVersion int
+	Options   *RecordOptions
+	// RecordType is empty for A / AAAA records, or the type of a record whose address hints are maintained
+	RecordType string
+}
+
+// target identifies the action in the outbox
+func (a *Action) target() string {
+	if a.RecordType == "" {
+		return a.DnsRecord
+	}
+
+	return strings.ToLower(a.RecordType) + ":" + a.DnsRecord
+}
+
+// RecordOptions are applied when a record gets created and enforced on every update.
+// Unset options keep the value of an existing record.
+type RecordOptions struct {
+	// Zone name or ID the record belongs to, looked up by the longest matching zone of the account if empty
+	Zone string
+
+	Proxied *bool
+	TTL     int
+	Comment *string
+	Tags    []string
+}
+
+// ProviderName identifies the updater in the history and the outbox
+const ProviderName = "cloudflare"
+
+// Bounds of the delay between attempts to resolve the zones
+const (
+	minResolveBackoff = 10 * time.Second
+	maxResolveBackoff = 5 * time.Minute
+)
+
+// Operations reported in an ActionResult
+const (
+	OperationResearch  = "research"
+	OperationCreate    = "create"
+	OperationUpdate    = "update"
+	OperationAdopt     = "adopt"
+	OperationDelete    = "delete"
+	OperationSkip      = "skip"
+	OperationUnchanged = "unchanged"
+)
+
+// ActionResult reports the outcome of a single create / update call done for an action.
+type ActionResult struct {
+	Action    *Action
+	Operation string
+	RecordId  string
+	Content   string
+	DryRun    bool
+	Error     error
 }
 
 type Updater struct {
 	log *log.Entry
 
+	// group names the set of credentials and records the updater handles, empty for the default one
+	group string
+
 	ipv4Zones []string
 	ipv6Zones []string
 
-	actions []*Action
+	recordOptions map[string]*RecordOptions
+
+	hintRecords []HintRecord
+
+	// zones whose records follow the previous address, with their include / exclude name patterns
+	followZones   []string
+	followInclude []string
+	followExclude []string
+
+	mu            sync.Mutex
+	actions       []*Action
+	followZoneIds map[string]string
 
 	isInit bool
 	api    *cf.API
 
-	In chan *net.IP
+	// APIOptions configure the client, if set before the init
+	APIOptions APIOptions
+
+	// Concurrency limits the number of zones updated at the same time
+	Concurrency int
+
+	// CacheRefresh is the age after which cached records of a zone are fetched again, zero disables the cache
+	CacheRefresh time.Duration
+	cache        *recordCache
+
+	In chan *events.IPUpdate
+
+	// DryRun researches records but only logs the create / update calls instead of sending them
+	DryRun bool
+
+	// History journals the outcome of every create / update call, if set
+	History *history.Journal
+
+	// Outbox stores failed actions for a later retry, if set
+	Outbox *outbox.Outbox
+
+	// Ownership marks created records by comment or tag and restricts updates to marked records
+	Ownership string
+	// AdoptRecords allows marking and updating an existing record if none is marked yet
+	AdoptRecords bool
+
+	latest events.Latest
 }
 
 func NewUpdater() *Updater {
 	return &Updater{
-		log:    log.WithField("module", "cloudflare"),
-		isInit: false,
-		In:     make(chan *net.IP, 10),
+		log:           log.WithField("module", "cloudflare"),
+		recordOptions: make(map[string]*RecordOptions),
+		Ownership:     OwnershipOff,
+		APIOptions:    APIOptions{Timeout: DefaultTimeout, MaxRetries: DefaultMaxRetries},
+		Concurrency:   DefaultConcurrency,
+		CacheRefresh:  DefaultCacheRefresh,
+		isInit:        false,
+		In:            make(chan *events.IPUpdate, 10),
+	}
+}
+
+// SetGroup names the group of credentials and records, keeping its history and outbox entries apart from other groups.
+func (u *Updater) SetGroup(group string) {
+	u.group = group
+	u.log = u.log.WithField("group", group)
+}
+
+// Provider identifies the updater in the history and the outbox, qualified by the group if there is one.
+func (u *Updater) Provider() string {
+	if u.group == "" {
+		return ProviderName
 	}
+
+	return ProviderName + ":" + u.group
 }
 
 func (u *Updater) SetIPv4Zones(zones string) {
@@ -47,8 +165,13 @@ func (u *Updater) SetIPv6Zones(zones string) {
 	u.ipv6Zones = strings.Split(zones, ",")
 }
 
+// SetRecordOptions sets the options of a record, applying to both its IPv4 and IPv6 actions.
+func (u *Updater) SetRecordOptions(record string, options RecordOptions) {
+	u.recordOptions[record] = &options
+}
+
 func (u *Updater) InitWithToken(token string) error {
-	api, err := cf.NewWithAPIToken(token)
+	api, err := cf.NewWithAPIToken(token, u.APIOptions.options()...)
 
 	if err != nil {
 		return err
@@ -58,7 +181,7 @@ func (u *Updater) InitWithToken(token string) error {
 }
 
 func (u *Updater) InitWithKey(email string, key string) error {
-	api, err := cf.New(key, email)
+	api, err := cf.New(key, email, u.APIOptions.options()...)
 
 	if err != nil {
 		return err
@@ -67,43 +190,80 @@ func (u *Updater) InitWithKey(email string, key string) error {
 	return u.init(api)
 }
 
+// init only stores the client, the zones are resolved lazily on the first update so an unreachable API at
+// startup does not disable the updater.
 func (u *Updater) init(api *cf.API) error {
-	// Create unique list of zones and fetch their CloudFlare zone IDs
-	zoneIdMap := make(map[string]string)
+	u.api = api
+	u.cache = newRecordCache(u.CacheRefresh)
+	u.isInit = true
 
-	for _, val := range u.ipv4Zones {
-		zoneIdMap[val] = ""
-	}
+	return nil
+}
 
-	for _, val := range u.ipv6Zones {
-		zoneIdMap[val] = ""
+// resolveActions looks up the zone IDs and builds the action list, unless that already succeeded.
+func (u *Updater) resolveActions() ([]*Action, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.actions != nil {
+		return u.actions, nil
 	}
 
-	for val := range zoneIdMap {
-		zone, err := publicsuffix.EffectiveTLDPlusOne(val)
+	// Create unique list of records and fetch their CloudFlare zone IDs
+	var records []string
+	seen := make(map[string]bool)
+	explicitZones := make(map[string]string)
 
-		if err != nil {
-			return err
+	for _, val := range append(append([]string{}, u.ipv4Zones...), u.ipv6Zones...) {
+		if seen[val] {
+			continue
 		}
+		seen[val] = true
+		records = append(records, val)
 
-		id, err := api.ZoneIDByName(zone)
+		if options := u.recordOptions[val]; options != nil && options.Zone != "" {
+			explicitZones[val] = options.Zone
+		}
+	}
 
-		if err != nil {
-			return err
+	for _, hint := range u.hintRecords {
+		if !seen[hint.Name] {
+			seen[hint.Name] = true
+			records = append(records, hint.Name)
 		}
 
-		zoneIdMap[val] = id
+		if hint.Zone != "" {
+			explicitZones[hint.Name] = hint.Zone
+		}
+	}
+
+	// Followed zones are looked up by their own name
+	for _, val := range u.followZones {
+		if !seen[val] {
+			seen[val] = true
+			records = append(records, val)
+			explicitZones[val] = val
+		}
+	}
+
+	zoneIdMap, err := resolveZoneIds(u.api, records, explicitZones)
+
+	if err != nil {
+		return nil, err
 	}
 
 	// Now create an updater action list
+	actions := make([]*Action, 0, len(u.ipv4Zones)+len(u.ipv6Zones))
+
 	for _, val := range u.ipv4Zones {
 		a := &Action{
 			DnsRecord: val,
 			CfZoneId:  zoneIdMap[val],
 			IpVersion: 4,
+			Options:   u.recordOptions[val],
 		}
 
-		u.actions = append(u.actions, a)
+		actions = append(actions, a)
 	}
 
 	for _, val := range u.ipv6Zones {
@@ -111,15 +271,33 @@ func (u *Updater) init(api *cf.API) error {
 			DnsRecord: val,
 			CfZoneId:  zoneIdMap[val],
 			IpVersion: 6,
+			Options:   u.recordOptions[val],
 		}
 
-		u.actions = append(u.actions, a)
+		actions = append(actions, a)
 	}
 
-	u.api = api
-	u.isInit = true
+	for _, hint := range u.hintRecords {
+		if hint.IPv4 {
+			actions = append(actions, &Action{DnsRecord: hint.Name, CfZoneId: zoneIdMap[hint.Name], IpVersion: 4, RecordType: hint.Type})
+		}
 
-	return nil
+		if hint.IPv6 {
+			actions = append(actions, &Action{DnsRecord: hint.Name, CfZoneId: zoneIdMap[hint.Name], IpVersion: 6, RecordType: hint.Type})
+		}
+	}
+
+	followZoneIds := make(map[string]string, len(u.followZones))
+
+	for _, val := range u.followZones {
+		followZoneIds[val] = zoneIdMap[val]
+	}
+
+	u.log.WithField("actions", len(actions)).WithField("follow-zones", len(followZoneIds)).Info("Resolved Cloudflare zones")
+	u.actions = actions
+	u.followZoneIds = followZoneIds
+
+	return actions, nil
 }
 
 func (u *Updater) StartWorker() {
@@ -135,87 +313,514 @@ func (u *Updater) shouldProcessUpdates() bool {
 }
 
 func (u *Updater) spawnWorker() {
+	// latest update per version received while the zones could not be resolved
+	pending := make(map[int]*events.IPUpdate)
+
+	resolveRetry := time.NewTimer(time.Hour)
+	resolveRetry.Stop()
+	resolveBackoff := minResolveBackoff
+
 	for {
 		select {
-		case ip := <-u.In:
+		case update := <-u.In:
 			if !u.shouldProcessUpdates() {
 				continue
 			}
 
-			u.log.WithField("ip", ip).Info("Received update request")
+			u.latest.Remember(update)
+			u.log.WithField("ip", update.IP).Info("Received update request")
 
-			for _, action := range u.actions {
-				// Skip IPv6 action mismatching IP version
-				if ip.To4() == nil && action.IpVersion != 6 {
-					continue
-				}
+			if len(pending) > 0 {
+				// a retry is already scheduled and will pick up this update as well
+				u.queueUpdate(pending, update)
+				continue
+			}
 
-				// Skip IPv4 action mismatching IP version
-				if ip.To4() != nil && action.IpVersion == 6 {
-					continue
+			actions, err := u.resolveActions()
+
+			if err != nil {
+				u.log.WithError(err).Error(fmt.Sprintf("Failed to resolve Cloudflare zones, retrying in %s", resolveBackoff))
+				u.queueUpdate(pending, update)
+				resolveRetry.Reset(resolveBackoff)
+				continue
+			}
+
+			u.processUpdate(actions, update)
+		case <-resolveRetry.C:
+			actions, err := u.resolveActions()
+
+			if err != nil {
+				resolveBackoff *= 2
+				if resolveBackoff > maxResolveBackoff {
+					resolveBackoff = maxResolveBackoff
 				}
 
-				// Create detailed sub-logger for this action
-				alog := u.log.WithField("domain", fmt.Sprintf("%s/IPv%d", action.DnsRecord, action.IpVersion))
+				u.log.WithError(err).Error(fmt.Sprintf("Failed to resolve Cloudflare zones, retrying in %s", resolveBackoff))
+				resolveRetry.Reset(resolveBackoff)
+				continue
+			}
+
+			for _, update := range pending {
+				u.processUpdate(actions, update)
+			}
+
+			pending = make(map[int]*events.IPUpdate)
+			resolveBackoff = minResolveBackoff
+		}
+	}
+}
+
+// queueUpdate keeps the latest update per version while the zones cannot be resolved. The records still hold the
+// address published before the first queued update, so that one stays the previous address to follow.
+func (u *Updater) queueUpdate(pending map[int]*events.IPUpdate, update *events.IPUpdate) {
+	version := ipVersion(update.IP)
+
+	if queued, ok := pending[version]; ok {
+		merged := *update
+		merged.Previous = queued.Previous
+		update = &merged
+	}
+
+	pending[version] = update
+}
+
+// processUpdate runs the actions and followed zones of an update. Zones are processed in parallel, bounded by the
+// concurrency, while the calls within a zone run one after another. A summary is logged once all zones are done.
+func (u *Updater) processUpdate(actions []*Action, update *events.IPUpdate) {
+	ip := &update.IP
+	sum := &summary{}
+
+	var zoneIds []string
+	jobs := make(map[string][]func())
+
+	addJob := func(zoneId string, job func()) {
+		if _, ok := jobs[zoneId]; !ok {
+			zoneIds = append(zoneIds, zoneId)
+		}
+		jobs[zoneId] = append(jobs[zoneId], job)
+	}
+
+	for _, action := range actions {
+		action := action
+
+		addJob(action.CfZoneId, func() {
+			applies, err := u.runAction(action, ip, sum)
+			if !applies || u.DryRun {
+				return
+			}
+
+			if err != nil {
+				u.Outbox.Enqueue(u.Provider(), action.target(), update, err)
+			} else {
+				u.Outbox.Complete(u.Provider(), action.target(), *ip)
+			}
+		})
+	}
+
+	u.mu.Lock()
+	followZoneIds := u.followZoneIds
+	u.mu.Unlock()
+
+	for _, zone := range u.followZones {
+		zone, zoneId := zone, followZoneIds[zone]
+
+		addJob(zoneId, func() {
+			u.processFollow(zone, zoneId, update, sum)
+		})
+	}
+
+	concurrency := u.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for _, zoneId := range zoneIds {
+		wg.Add(1)
+
+		go func(zoneJobs []func()) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			for _, job := range zoneJobs {
+				job()
+			}
+		}(jobs[zoneId])
+	}
+
+	wg.Wait()
+
+	sum.log(u.log.WithField("ip", update.IP), u.DryRun)
+}
+
+func ipVersion(ip net.IP) int {
+	if ip.To4() != nil {
+		return 4
+	}
+
+	return 6
+}
+
+// runAction does a single action and reports its results, returning the last error that occurred.
+// Returns false if the action does not apply to the IP version.
+func (u *Updater) runAction(action *Action, ip *net.IP, sum *summary) (bool, error) {
+	actionResults := u.doAction(action, ip)
+	if actionResults == nil {
+		return false, nil
+	}
+
+	var err error
 
-				// Decide record type on ip version
-				var recordType string
+	for actionResult := range actionResults {
+		u.logActionResult(actionResult)
+		sum.add(actionResult)
 
-				if ip.To4() == nil {
-					recordType = "AAAA"
-				} else {
-					recordType = "A"
+		if actionResult.Operation == OperationSkip || actionResult.Operation == OperationUnchanged {
+			continue
+		}
+
+		u.History.RecordUpdate(u.Provider(), action.DnsRecord, *ip, actionResult.DryRun, actionResult.Error)
+
+		if actionResult.Error != nil {
+			err = actionResult.Error
+		}
+	}
+
+	return true, err
+}
+
+// Retry runs the action of an operation stored in the outbox again.
+func (u *Updater) Retry(op *outbox.Operation) error {
+	if !u.shouldProcessUpdates() {
+		return errors.New("cloudflare updater is not initialized")
+	}
+
+	actions, err := u.resolveActions()
+
+	if err != nil {
+		return err
+	}
+
+	// a newer address received since the failure takes precedence
+	update := u.latest.Current(op.Update())
+
+	if strings.HasPrefix(op.Target, followTargetPrefix) {
+		zone := strings.TrimPrefix(op.Target, followTargetPrefix)
+
+		u.mu.Lock()
+		zoneId, ok := u.followZoneIds[zone]
+		u.mu.Unlock()
+
+		if !ok {
+			return fmt.Errorf("zone %s is not followed anymore", zone)
+		}
+
+		if applies, err := u.runFollow(zone, zoneId, update, nil); applies {
+			return err
+		}
+
+		return fmt.Errorf("no previous %s address to follow in %s", op.Family, zone)
+	}
+
+	for _, action := range actions {
+		if action.target() != op.Target {
+			continue
+		}
+
+		if applies, err := u.runAction(action, &update.IP, nil); applies {
+			return err
+		}
+	}
+
+	return fmt.Errorf("no %s action configured for %s", op.Family, op.Target)
+}
+
+// doAction researches the records of a single action and creates or updates them with the given IP.
+// Every create / update call is reported through the returned channel, which is closed once the action is done.
+// Returns nil if the action does not apply to the IP version.
+func (u *Updater) doAction(action *Action, ip *net.IP) chan ActionResult {
+	// Skip IPv6 action mismatching IP version
+	if ip.To4() == nil && action.IpVersion != 6 {
+		return nil
+	}
+
+	// Skip IPv4 action mismatching IP version
+	if ip.To4() != nil && action.IpVersion == 6 {
+		return nil
+	}
+
+	actionResults := make(chan ActionResult)
+
+	go func() {
+		defer close(actionResults)
+
+		if action.RecordType == RecordTypeSRV {
+			u.doSrvAction(action, ip, actionResults)
+			return
+		}
+
+		if action.RecordType != "" {
+			u.doHintAction(action, ip, actionResults)
+			return
+		}
+
+		// Decide record type on ip version
+		var recordType string
+
+		if ip.To4() == nil {
+			recordType = "AAAA"
+		} else {
+			recordType = "A"
+		}
+
+		// Research all current records matching the current scheme
+		records, err := u.listRecords(action.CfZoneId, recordType, action.DnsRecord, "")
+
+		if err != nil {
+			actionResults <- ActionResult{action, OperationResearch, "", "", u.DryRun, err}
+			return
+		}
+
+		managed, unmanaged := u.partitionRecords(records)
+
+		// Records without the ownership marker were created by hand and are left alone, unless adoption is allowed
+		adopt := false
+
+		if len(managed) == 0 && len(unmanaged) > 0 {
+			if !u.AdoptRecords {
+				for _, record := range unmanaged {
+					actionResults <- ActionResult{action, OperationSkip, record.ID, record.Content, u.DryRun, nil}
 				}
+				return
+			}
+
+			managed = unmanaged[:1]
+			adopt = true
+		}
+
+		// Create record if none were found
+		if len(managed) == 0 {
+			if u.DryRun {
+				actionResults <- ActionResult{action, OperationCreate, "", ip.String(), true, nil}
+				return
+			}
+
+			err := u.createRecord(action.CfZoneId, u.newRecord(action, recordType, ip.String()))
 
-				// Research all current records matching the current scheme
-				records, err := u.api.DNSRecords(context.Background(), action.CfZoneId, cf.DNSRecord{
-					Type: recordType,
-					Name: action.DnsRecord,
-				})
+			actionResults <- ActionResult{action, OperationCreate, "", ip.String(), false, err}
+			return
+		}
 
-				if err != nil {
-					alog.WithError(err).Error("Action failed, could not research DNS records")
+		// Collapse duplicate managed records down to the oldest one
+		if u.Ownership != OwnershipOff {
+			for _, record := range managed[1:] {
+				if u.DryRun {
+					actionResults <- ActionResult{action, OperationDelete, record.ID, record.Content, true, nil}
 					continue
 				}
 
-				// Create record if none were found
-				if len(records) == 0 {
-					alog.Info("Creating DNS record")
-
-					_, err := u.api.CreateDNSRecord(context.Background(), action.CfZoneId, cf.DNSRecord{
-						Type:    recordType,
-						Name:    action.DnsRecord,
-						Content: ip.String(),
-						Proxied: func(in bool) *bool { return &in }(false),
-						TTL:     120,
-						ZoneID:  action.CfZoneId,
-					})
-
-					if err != nil {
-						alog.WithError(err).Error("Action failed, could not create DNS record")
-						continue
-					}
-				}
+				err := u.deleteRecord(action.CfZoneId, record.ID)
 
-				// Update existing records
-				for _, record := range records {
-					alog.WithField("record-id", record.ID).Info("Updating DNS record")
-
-					// Ensure we submit all required fields even if they did not change,otherwise
-					// cloudflare-go might revert them to default values.
-					err := u.api.UpdateDNSRecord(context.Background(), action.CfZoneId, record.ID, cf.DNSRecord{
-						Content: ip.String(),
-						TTL:     record.TTL,
-						Proxied: record.Proxied,
-					})
-
-					if err != nil {
-						alog.WithError(err).Error("Action failed, could not update DNS record")
-						continue
-					}
-				}
+				actionResults <- ActionResult{action, OperationDelete, record.ID, record.Content, false, err}
 			}
 
+			managed = managed[:1]
+		}
+
+		operation := OperationUpdate
+		if adopt {
+			operation = OperationAdopt
 		}
+
+		// Update existing records, unless they already match
+		for _, record := range managed {
+			update := u.recordUpdate(action, record, ip.String(), adopt)
+
+			if update.unchanged(record) {
+				actionResults <- ActionResult{action, OperationUnchanged, record.ID, record.Content, u.DryRun, nil}
+				continue
+			}
+
+			if u.DryRun {
+				actionResults <- ActionResult{action, operation, record.ID, ip.String(), true, nil}
+				continue
+			}
+
+			err := u.updateRecord(action.CfZoneId, record.ID, update)
+
+			actionResults <- ActionResult{action, operation, record.ID, ip.String(), false, err}
+		}
+	}()
+
+	return actionResults
+}
+
+// newRecord builds a record for the action, applying its options over the defaults and marking it as managed.
+func (u *Updater) newRecord(action *Action, recordType string, content string) dnsRecord {
+	record := dnsRecord{
+		DNSRecord: cf.DNSRecord{
+			Type:    recordType,
+			Name:    action.DnsRecord,
+			Content: content,
+			Proxied: func(in bool) *bool { return &in }(false),
+			TTL:     120,
+			ZoneID:  action.CfZoneId,
+		},
+	}
+
+	if options := action.Options; options != nil {
+		if options.Proxied != nil {
+			record.Proxied = options.Proxied
+		}
+		if options.TTL != 0 {
+			record.TTL = options.TTL
+		}
+		if options.Comment != nil {
+			record.Comment = *options.Comment
+		}
+		record.Tags = options.Tags
+	}
+
+	record.Comment = u.markComment(record.Comment)
+	record.Tags = u.markTags(record.Tags)
+
+	return record
+}
+
+// recordUpdate builds the update of an existing record, enforcing the action options.
+// Adopting a record adds the ownership marker to its comment or tags.
+func (u *Updater) recordUpdate(action *Action, record dnsRecord, content string, adopt bool) dnsRecordUpdate {
+	// Ensure we submit all required fields even if they did not change, otherwise
+	// the API might revert them to default values.
+	update := dnsRecordUpdate{
+		Content: content,
+		TTL:     record.TTL,
+		Proxied: record.Proxied,
+	}
+
+	comment, tags := record.Comment, record.Tags
+	enforceComment, enforceTags := adopt, adopt
+
+	if options := action.Options; options != nil {
+		if options.Proxied != nil {
+			update.Proxied = options.Proxied
+		}
+		if options.TTL != 0 {
+			update.TTL = options.TTL
+		}
+		if options.Comment != nil {
+			comment, enforceComment = *options.Comment, true
+		}
+		if options.Tags != nil {
+			tags, enforceTags = options.Tags, true
+		}
+	}
+
+	if enforceComment {
+		comment = u.markComment(comment)
+		update.Comment = &comment
+	}
+
+	if enforceTags {
+		tags = u.markTags(tags)
+		update.Tags = &tags
+	}
+
+	return update
+}
+
+// summary counts the outcomes of the calls of an update
+type summary struct {
+	mu     sync.Mutex
+	counts map[string]int
+	failed int
+}
+
+func (s *summary) add(result ActionResult) {
+	if s == nil || result.Operation == OperationResearch && result.Error == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if result.Error != nil {
+		s.failed++
+		return
+	}
+
+	if s.counts == nil {
+		s.counts = make(map[string]int)
+	}
+
+	s.counts[result.Operation]++
+}
+
+func (s *summary) log(slog *log.Entry, dryRun bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slog = slog.WithFields(log.Fields{
+		"created":   s.counts[OperationCreate],
+		"updated":   s.counts[OperationUpdate] + s.counts[OperationAdopt],
+		"unchanged": s.counts[OperationUnchanged],
+		"deleted":   s.counts[OperationDelete],
+		"skipped":   s.counts[OperationSkip],
+		"failed":    s.failed,
+	})
+
+	switch {
+	case dryRun:
+		slog.Info("Finished Cloudflare dry run")
+	case s.failed > 0:
+		slog.Warn("Finished Cloudflare update with failures")
+	default:
+		slog.Info("Finished Cloudflare update")
+	}
+}
+
+func (u *Updater) logActionResult(actionResult ActionResult) {
+	// Create detailed sub-logger for this action
+	alog := u.log.WithField("domain", fmt.Sprintf("%s/IPv%d", actionResult.Action.target(), actionResult.Action.IpVersion))
+
+	if actionResult.RecordId != "" {
+		alog = alog.WithField("record-id", actionResult.RecordId)
+	}
+
+	if actionResult.Error != nil {
+		alog.WithError(actionResult.Error).Error(fmt.Sprintf("Action failed, could not %s DNS record", actionResult.Operation))
+		return
+	}
+
+	alog = alog.WithField("content", actionResult.Content)
+
+	if actionResult.Operation == OperationSkip {
+		alog.Warn("Skipping DNS record not created by this service, allow adoption to update it")
+		return
+	}
+
+	if actionResult.Operation == OperationUnchanged {
+		alog.Info("Unchanged DNS record, skipping update")
+		return
+	}
+
+	if actionResult.DryRun {
+		alog.Info(fmt.Sprintf("Dry run, would %s DNS record", actionResult.Operation))
+		return
+	}
+
+	switch actionResult.Operation {
+	case OperationCreate:
+		alog.Info("Created DNS record")
+	case OperationUpdate:
+		alog.Info("Updated DNS record")
+	case OperationAdopt:
+		alog.Warn("Adopted DNS record not created by this service, marked and updated it")
+	case OperationDelete:
+		alog.Info("Deleted duplicate DNS record")
 	}
 }
@@ -0,0 +1,346 @@
+package cloudflare
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/fake_cloudflare"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+	log "github.com/sirupsen/logrus"
+)
+
+const testToken = "test-token"
+
+func testLog() *log.Entry {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	return log.NewEntry(logger)
+}
+
+// newFakeAPI serves a fake Cloudflare API with the zone example.com for the duration of the test.
+func newFakeAPI(t *testing.T) (*fake_cloudflare.Server, *fake_cloudflare.Zone, string) {
+	fake := fake_cloudflare.NewServer()
+	fake.Token = testToken
+	zone := fake.AddZone("example.com")
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, zone, server.URL
+}
+
+func newTestUpdater(t *testing.T, baseURL string, token string, cacheRefresh time.Duration) *Updater {
+	u := NewUpdater()
+	u.log = testLog()
+	u.APIOptions = APIOptions{BaseURL: baseURL, Timeout: 5 * time.Second}
+	u.CacheRefresh = cacheRefresh
+	u.SetIPv4Zones("home.example.com")
+	u.SetIPv6Zones("home.example.com")
+
+	if err := u.InitWithToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+// runUpdate runs the actions applying to the address, returning the reported operations and the last error.
+func runUpdate(t *testing.T, u *Updater, ip string) ([]string, error) {
+	actions, err := u.resolveActions()
+	if err != nil {
+		return nil, err
+	}
+
+	address := net.ParseIP(ip)
+	var operations []string
+
+	for _, action := range actions {
+		results := u.doAction(action, &address)
+		if results == nil {
+			continue
+		}
+
+		for result := range results {
+			operations = append(operations, result.Operation)
+			if result.Error != nil {
+				err = result.Error
+			}
+		}
+	}
+
+	return operations, err
+}
+
+func TestUpdaterAgainstFakeAPI(t *testing.T) {
+	for _, cacheRefresh := range []time.Duration{0, DefaultCacheRefresh} {
+		t.Run(fmt.Sprintf("cache %s", cacheRefresh), func(t *testing.T) {
+			fake, zone, baseURL := newFakeAPI(t)
+			u := newTestUpdater(t, baseURL, testToken, cacheRefresh)
+
+			tests := []struct {
+				ip        string
+				operation string
+				records   []string
+			}{
+				{"192.0.2.1", OperationCreate, []string{"A 192.0.2.1"}},
+				{"192.0.2.2", OperationUpdate, []string{"A 192.0.2.2"}},
+				{"192.0.2.2", OperationUnchanged, []string{"A 192.0.2.2"}},
+				{"2001:db8::1", OperationCreate, []string{"A 192.0.2.2", "AAAA 2001:db8::1"}},
+				{"2001:0db8:0000::0001", OperationUnchanged, []string{"A 192.0.2.2", "AAAA 2001:db8::1"}},
+			}
+
+			for _, test := range tests {
+				before := fake.Records(zone.ID)
+
+				operations, err := runUpdate(t, u, test.ip)
+				if err != nil {
+					t.Fatalf("update to %s: %v", test.ip, err)
+				}
+
+				if len(operations) != 1 || operations[0] != test.operation {
+					t.Errorf("update to %s reported %v, want %s", test.ip, operations, test.operation)
+				}
+
+				after := fake.Records(zone.ID)
+				var records []string
+				for _, record := range after {
+					records = append(records, record.Type+" "+record.Content)
+
+					if record.Name != "home.example.com" || record.TTL != 120 || record.Proxied == nil || *record.Proxied {
+						t.Errorf("record %+v, want the defaults of a new record", record)
+					}
+				}
+
+				if strings.Join(records, ",") != strings.Join(test.records, ",") {
+					t.Errorf("update to %s left %v, want %v", test.ip, records, test.records)
+				}
+
+				if test.operation == OperationUnchanged && len(before) == len(after) {
+					for i := range before {
+						if !after[i].ModifiedOn.Equal(before[i].ModifiedOn) {
+							t.Errorf("unchanged record %s was written", after[i].ID)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUpdaterPagination(t *testing.T) {
+	fake, zone, baseURL := newFakeAPI(t)
+
+	// the record to update comes after two full pages of other records
+	for i := 0; i < 2*recordsPerPage; i++ {
+		if _, err := fake.AddRecord(zone.ID, fake_cloudflare.Record{Type: "A", Name: fmt.Sprintf("host%03d.example.com", i), Content: "198.51.100.1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := fake.AddRecord(zone.ID, fake_cloudflare.Record{Type: "A", Name: "home.example.com", Content: "192.0.2.1", TTL: 120}); err != nil {
+		t.Fatal(err)
+	}
+
+	u := newTestUpdater(t, baseURL, testToken, DefaultCacheRefresh)
+
+	operations, err := runUpdate(t, u, "192.0.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(operations) != 1 || operations[0] != OperationUpdate {
+		t.Errorf("reported %v, want the record on the last page updated", operations)
+	}
+
+	records := fake.Records(zone.ID)
+	if len(records) != 2*recordsPerPage+1 || records[len(records)-1].Content != "192.0.2.2" {
+		t.Errorf("%d records with %s last, want the existing record updated instead of a new one", len(records), records[len(records)-1].Content)
+	}
+}
+
+func TestUpdaterOwnership(t *testing.T) {
+	tests := []struct {
+		name      string
+		ownership string
+		adopt     bool
+		operation string
+		content   string
+	}{
+		{"off", OwnershipOff, false, OperationUpdate, "192.0.2.2"},
+		{"skip unmanaged", OwnershipComment, false, OperationSkip, "192.0.2.1"},
+		{"adopt", OwnershipTag, true, OperationAdopt, "192.0.2.2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, zone, baseURL := newFakeAPI(t)
+
+			if _, err := fake.AddRecord(zone.ID, fake_cloudflare.Record{Type: "A", Name: "home.example.com", Content: "192.0.2.1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			u := newTestUpdater(t, baseURL, testToken, 0)
+			u.Ownership = test.ownership
+			u.AdoptRecords = test.adopt
+
+			operations, err := runUpdate(t, u, "192.0.2.2")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records := fake.Records(zone.ID)
+			if len(operations) != 1 || operations[0] != test.operation || len(records) != 1 || records[0].Content != test.content {
+				t.Errorf("reported %v leaving %+v, want %s to %s", operations, records, test.operation, test.content)
+			}
+
+			if test.adopt && !u.isManaged(dnsRecord{Tags: records[0].Tags}) {
+				t.Errorf("adopted record has the tags %v, want the ownership marker", records[0].Tags)
+			}
+		})
+	}
+}
+
+func TestUpdaterErrorEnvelope(t *testing.T) {
+	fake, zone, baseURL := newFakeAPI(t)
+
+	// a wrong token already fails to resolve the zones
+	if _, err := runUpdate(t, newTestUpdater(t, baseURL, "wrong-token", 0), "192.0.2.1"); err == nil || !strings.Contains(err.Error(), "Authentication error") {
+		t.Errorf("error %v, want the authentication error of the API", err)
+	}
+
+	// errors of record calls carry the message of the API
+	u := newTestUpdater(t, baseURL, testToken, 0)
+	u.SetRecordOptions("home.example.com", RecordOptions{TTL: 30})
+
+	if _, err := runUpdate(t, u, "192.0.2.1"); err == nil || !strings.Contains(err.Error(), "TTL") {
+		t.Errorf("error %v, want the validation error of the API", err)
+	}
+
+	if records := fake.Records(zone.ID); len(records) != 0 {
+		t.Errorf("rejected record created: %+v", records)
+	}
+}
+
+func TestUpdaterFollowOwnership(t *testing.T) {
+	tests := []struct {
+		name    string
+		adopt   bool
+		content map[string]string
+	}{
+		{"skip unmanaged", false, map[string]string{"home.example.com": "192.0.2.1", "vpn.example.com": "192.0.2.2", "www.example.com": "198.51.100.1"}},
+		{"adopt", true, map[string]string{"home.example.com": "192.0.2.2", "vpn.example.com": "192.0.2.2", "www.example.com": "198.51.100.1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, zone, baseURL := newFakeAPI(t)
+
+			for _, record := range []fake_cloudflare.Record{
+				{Type: "A", Name: "home.example.com", Content: "192.0.2.1"},
+				{Type: "A", Name: "vpn.example.com", Content: "192.0.2.1", Tags: []string{ownerMarker}},
+				{Type: "A", Name: "www.example.com", Content: "198.51.100.1"},
+			} {
+				if _, err := fake.AddRecord(zone.ID, record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			u := newTestUpdater(t, baseURL, testToken, 0)
+			u.Ownership = OwnershipTag
+			u.AdoptRecords = test.adopt
+
+			applies, err := u.runFollow("example.com", zone.ID, &events.IPUpdate{IP: net.ParseIP("192.0.2.2"), Previous: net.ParseIP("192.0.2.1")}, nil)
+			if !applies || err != nil {
+				t.Fatalf("follow applies %v with error %v", applies, err)
+			}
+
+			for _, record := range fake.Records(zone.ID) {
+				if record.Content != test.content[record.Name] {
+					t.Errorf("%s points at %s, want %s", record.Name, record.Content, test.content[record.Name])
+				}
+
+				if record.Content == "192.0.2.2" && !u.isManaged(dnsRecord{Tags: record.Tags}) {
+					t.Errorf("followed record %s has the tags %v, want the ownership marker", record.Name, record.Tags)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdaterRetriesOnlyIdempotentCalls(t *testing.T) {
+	fake := fake_cloudflare.NewServer()
+	fake.Token = testToken
+	zone := fake.AddZone("example.com")
+
+	var mu sync.Mutex
+	failed := make(map[string]bool)
+
+	// the first lookup and the first create are applied, but their answers lost on the way back
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := !failed[r.Method] && (r.Method == http.MethodGet || r.Method == http.MethodPost)
+		failed[r.Method] = true
+		mu.Unlock()
+
+		if !fail {
+			fake.ServeHTTP(w, r)
+			return
+		}
+
+		fake.ServeHTTP(httptest.NewRecorder(), r)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(server.Close)
+
+	u := NewUpdater()
+	u.log = testLog()
+	u.APIOptions = APIOptions{BaseURL: server.URL, Timeout: 5 * time.Second, MaxRetries: 3}
+	u.CacheRefresh = 0
+	u.SetIPv4Zones("home.example.com")
+
+	if err := u.InitWithToken(testToken); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lookup is retried, the create is not, as a retry would add a second record
+	if _, err := runUpdate(t, u, "192.0.2.1"); err == nil {
+		t.Error("lost answer of the create not reported")
+	}
+
+	if records := fake.Records(zone.ID); len(records) != 1 {
+		t.Fatalf("%d records after the lost answer, want the create applied once", len(records))
+	}
+
+	// the next update finds the record created before
+	operations, err := runUpdate(t, u, "192.0.2.1")
+	if err != nil || len(operations) != 1 || operations[0] != OperationUnchanged {
+		t.Errorf("reported %v with error %v, want the created record unchanged", operations, err)
+	}
+}
+
+func TestRetryPrefersNewestAddress(t *testing.T) {
+	fake, zone, baseURL := newFakeAPI(t)
+	u := newTestUpdater(t, baseURL, testToken, 0)
+
+	// the failed update of 192.0.2.1 is retried after 192.0.2.2 was received
+	u.latest.Remember(&events.IPUpdate{IP: net.ParseIP("192.0.2.2")})
+	op := &outbox.Operation{Target: "home.example.com", Family: "ipv4", Address: "192.0.2.1"}
+
+	if err := u.Retry(op); err != nil {
+		t.Fatal(err)
+	}
+
+	records := fake.Records(zone.ID)
+	if len(records) != 1 || records[0].Content != "192.0.2.2" {
+		t.Errorf("retry left %+v, want the newest address", records)
+	}
+}
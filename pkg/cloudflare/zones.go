@@ -0,0 +1,83 @@
+package cloudflare
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	cf "github.com/cloudflare/cloudflare-go"
+)
+
+var zoneIdPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// zoneForRecord returns the longest zone name the record belongs to, or an empty string if none matches.
+func zoneForRecord(record string, zoneNames []string) string {
+	record = normalizeName(record)
+	match := ""
+
+	for _, zoneName := range zoneNames {
+		zoneName = normalizeName(zoneName)
+
+		if record != zoneName && !strings.HasSuffix(record, "."+zoneName) {
+			continue
+		}
+
+		if len(zoneName) > len(match) {
+			match = zoneName
+		}
+	}
+
+	return match
+}
+
+// resolveZoneIds maps every record to the ID of its zone. Records with an explicit zone (a zone name or ID) use
+// it, all others are matched against the longest suffix of the zones listed by the account.
+func resolveZoneIds(api *cf.API, records []string, explicitZones map[string]string) (map[string]string, error) {
+	zones, err := api.ListZones(context.Background())
+
+	if err != nil {
+		return nil, err
+	}
+
+	zoneIds := make(map[string]string, len(zones))
+	zoneNames := make([]string, 0, len(zones))
+
+	for _, zone := range zones {
+		zoneIds[normalizeName(zone.Name)] = zone.ID
+		zoneNames = append(zoneNames, zone.Name)
+	}
+
+	recordZoneIds := make(map[string]string, len(records))
+
+	for _, record := range records {
+		zone, explicit := explicitZones[record]
+
+		if explicit && zoneIdPattern.MatchString(zone) {
+			recordZoneIds[record] = zone
+			continue
+		}
+
+		if !explicit {
+			zone = zoneForRecord(record, zoneNames)
+
+			if zone == "" {
+				return nil, fmt.Errorf("no zone of the account matches %s", record)
+			}
+		}
+
+		id, ok := zoneIds[normalizeName(zone)]
+
+		if !ok {
+			return nil, fmt.Errorf("zone %s of %s not found in the account", zone, record)
+		}
+
+		recordZoneIds[record] = id
+	}
+
+	return recordZoneIds, nil
+}
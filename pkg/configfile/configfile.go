@@ -0,0 +1,111 @@
+// Package configfile decodes config files written in JSON, YAML or TOML into the same model. YAML and TOML are
+// converted to JSON first, so the json tags of the model apply to every format and unknown fields are rejected alike.
+//
+// Only the parts of YAML and TOML that config files use are supported: YAML without anchors, aliases, tags and
+// multiple documents, TOML without dates and times. Anything else is rejected with the line it was found on.
+package configfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Decode reads the file at path into v, rejecting unknown fields. The format is chosen by the extension, .yaml and
+// .yml are YAML, .toml is TOML and everything else JSON.
+func Decode(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var tree interface{}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		tree, err = parseYAML(string(data))
+		tree = conform(tree, reflect.TypeOf(v))
+	case ".toml":
+		tree, err = parseTOML(string(data))
+	default:
+		return decodeJSON(data, v)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+
+	return decodeJSON(encoded, v)
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(v)
+}
+
+// unescape decodes the escape sequence at the start of s, the backslash already dropped, returning the decoded text
+// and the length of the sequence. It covers the escapes of YAML double quoted and TOML basic strings.
+func unescape(s string) (string, int, error) {
+	if s == "" {
+		return "", 0, fmt.Errorf("incomplete escape sequence")
+	}
+
+	switch s[0] {
+	case '0':
+		return "\x00", 1, nil
+	case 'a':
+		return "\a", 1, nil
+	case 'b':
+		return "\b", 1, nil
+	case 't', '\t':
+		return "\t", 1, nil
+	case 'n':
+		return "\n", 1, nil
+	case 'v':
+		return "\v", 1, nil
+	case 'f':
+		return "\f", 1, nil
+	case 'r':
+		return "\r", 1, nil
+	case 'e':
+		return "\x1b", 1, nil
+	case ' ', '"', '/', '\\':
+		return s[:1], 1, nil
+	case 'x', 'u', 'U':
+		digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[0]]
+		if len(s) < 1+digits {
+			return "", 0, fmt.Errorf("incomplete escape sequence \\%s", s)
+		}
+
+		var code rune
+		for _, c := range s[1 : 1+digits] {
+			var digit rune
+			switch {
+			case c >= '0' && c <= '9':
+				digit = c - '0'
+			case c >= 'a' && c <= 'f':
+				digit = c - 'a' + 10
+			case c >= 'A' && c <= 'F':
+				digit = c - 'A' + 10
+			default:
+				return "", 0, fmt.Errorf("invalid escape sequence \\%s", s[:1+digits])
+			}
+			code = code<<4 | digit
+		}
+
+		return string(code), 1 + digits, nil
+	}
+
+	return "", 0, fmt.Errorf("unknown escape sequence \\%c", s[0])
+}
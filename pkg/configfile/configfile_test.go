@@ -0,0 +1,204 @@
+package configfile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	Requests []testRequest `json:"requests"`
+}
+
+type testRequest struct {
+	Name       string            `json:"name"`
+	Body       string            `json:"body"`
+	Status     string            `json:"status"`
+	RetryCount *int              `json:"retryCount"`
+	OnIPv6     *bool             `json:"onIPv6"`
+	Headers    map[string]string `json:"headers"`
+	TLS        testTLS           `json:"tls"`
+}
+
+type testTLS struct {
+	Pins []string `json:"pins"`
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestDecodeFormats(t *testing.T) {
+	retryCount, onIPv6 := 3, true
+	want := testFile{Requests: []testRequest{
+		{
+			Name:       "status-page",
+			Body:       "{\"ip\": {{json .IP}}}\n",
+			Status:     "200",
+			RetryCount: &retryCount,
+			OnIPv6:     &onIPv6,
+			Headers:    map[string]string{"Content-Type": "application/json", "X-Api-Key": "{{.Password}}"},
+			TLS:        testTLS{Pins: []string{"a", "b"}},
+		},
+		{Name: "second", Status: "2xx"},
+	}}
+
+	files := map[string]string{
+		"requests.json": `{"requests": [
+			{"name": "status-page", "body": "{\"ip\": {{json .IP}}}\n", "status": "200", "retryCount": 3, "onIPv6": true,
+			 "headers": {"Content-Type": "application/json", "X-Api-Key": "{{.Password}}"}, "tls": {"pins": ["a", "b"]}},
+			{"name": "second", "status": "2xx"}
+		]}`,
+		"requests.yaml": `
+# the requests of the status page
+requests:
+- name: status-page
+  body: |
+    {"ip": {{json .IP}}}
+  status: 200 # kept as text for the string field
+  retryCount: 3
+  onIPv6: true
+  headers:
+    Content-Type: application/json
+    "X-Api-Key": '{{.Password}}'
+  tls: {pins: [a, "b"]}
+- name: second
+  status: 2xx
+`,
+		"requests.toml": `
+# the requests of the status page
+[[requests]]
+name = "status-page"
+body = """
+{"ip": {{json .IP}}}
+"""
+status = "200"
+retryCount = 3
+onIPv6 = true
+tls.pins = [
+  "a", # first
+  'b',
+]
+
+[requests.headers]
+Content-Type = "application/json"
+"X-Api-Key" = '{{.Password}}'
+
+[[requests]]
+name = "second"
+status = "2xx"
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			var got testFile
+			if err := Decode(writeFile(t, name, content), &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"unknown.json", `{"requests": [{"nmae": "x"}]}`, "unknown field"},
+		{"unknown.yaml", "requests:\n  - nmae: x\n", "unknown field"},
+		{"unknown.toml", "[[requests]]\nnmae = \"x\"\n", "unknown field"},
+		{"type.toml", "[[requests]]\nstatus = 200\n", "cannot unmarshal number"},
+		{"tabs.yaml", "requests:\n\t- name: x\n", "line 2: tabs"},
+		{"anchor.yaml", "requests: &all\n", "line 1: anchors"},
+		{"duplicate.yaml", "requests:\nrequests:\n", "line 2: duplicate key"},
+		{"indentation.yaml", "requests:\n  - name: x\n      body: y\n", "line 3: unexpected indentation"},
+		{"documents.yaml", "requests:\n---\nrequests:\n", "line 2: multiple documents"},
+		{"flow.yaml", "requests: [{name: x}\n", "unterminated flow collection"},
+		{"date.toml", "[[requests]]\nname = 2024-01-01\n", "line 2: dates"},
+		{"table.toml", "[a]\n[a]\n", "line 2: table a is defined twice"},
+		{"duplicate.toml", "a = 1\na = 2\n", "line 2: duplicate key"},
+		{"string.toml", "a = \"x\n", "line 1: unterminated string"},
+		{"garbage.toml", "a = 1 b\n", "line 1: expected the end of the line"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got testFile
+			if err := Decode(writeFile(t, test.name, test.content), &got); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestYAML(t *testing.T) {
+	tests := []struct {
+		yaml string
+		json string
+	}{
+		{"", `null`},
+		{"--- # start\na: 1", `{"a":1}`},
+		{"a: ~\nb: null\nc:\nd: ''", `{"a":null,"b":null,"c":null,"d":""}`},
+		{"a: true\nb: False\nc: 0x1f\nd: 0o17\ne: 1.5e3\nf: 007\ng: 1.2.3", `{"a":true,"b":false,"c":31,"d":15,"e":1500,"f":7,"g":"1.2.3"}`},
+		{"a: http://example.com/#x # comment", `{"a":"http://example.com/#x"}`},
+		{`a: "tab\tquote\"\u00e9"` + "\nb: 'it''s'", `{"a":"tab\tquote\"é","b":"it's"}`},
+		{"- a\n- - b\n  - c\n-\n  d: e", `["a",["b","c"],{"d":"e"}]`},
+		{"a:\n  - b: 1\n    c: 2\n  - 3", `{"a":[{"b":1,"c":2},3]}`},
+		{"a: |\n  one\n    two\n\n  three\n\n\nb: 1", `{"a":"one\n  two\n\nthree\n","b":1}`},
+		{"a: |-\n  one\nb: |+\n  two\n\n", `{"a":"one","b":"two\n\n"}`},
+		{"a: >\n  one\n  two\n\n  three\n    indented\n  four\n", `{"a":"one two\nthree\n  indented\nfour\n"}`},
+		{"a: [1, [2, 3], {b: c, 'd': }, ]\ne: {\n  f: g, # comment\n  h: [i]\n}", `{"a":[1,[2,3],{"b":"c","d":null}],"e":{"f":"g","h":["i"]}}`},
+	}
+
+	for _, test := range tests {
+		tree, err := parseYAML(test.yaml)
+		if err != nil {
+			t.Errorf("%q: %v", test.yaml, err)
+			continue
+		}
+
+		if encoded, _ := json.Marshal(conform(tree, nil)); string(encoded) != test.json {
+			t.Errorf("%q parsed to %s, want %s", test.yaml, encoded, test.json)
+		}
+	}
+}
+
+func TestTOML(t *testing.T) {
+	tests := []struct {
+		toml string
+		json string
+	}{
+		{"", `{}`},
+		{"a = 1_000\nb = 0x1f\nc = 0o17\nd = 0b11\ne = 1.5e3\nf = false", `{"a":1000,"b":31,"c":15,"d":3,"e":1500,"f":false}`},
+		{`a = "tab\tquote\"\u00e9"` + "\nb = 'C:\\path'", `{"a":"tab\tquote\"é","b":"C:\\path"}`},
+		{"a = \"\"\"\none \\\n   two\"\"\"\"\nb = '''\nthree\n'''", `{"a":"one two\"","b":"three\n"}`},
+		{"a.b = 1\n[c]\nd = {e = 2, f.g = [3, 'x']}\n[c.h]\ni = 4", `{"a":{"b":1},"c":{"d":{"e":2,"f":{"g":[3,"x"]}},"h":{"i":4}}}`},
+		{"[[a]]\nb = 1\n[a.c]\nd = 2\n[[a]]\nb = 3\n[a.c]\nd = 4", `{"a":[{"b":1,"c":{"d":2}},{"b":3,"c":{"d":4}}]}`},
+	}
+
+	for _, test := range tests {
+		tree, err := parseTOML(test.toml)
+		if err != nil {
+			t.Errorf("%q: %v", test.toml, err)
+			continue
+		}
+
+		if encoded, _ := json.Marshal(tree); string(encoded) != test.json {
+			t.Errorf("%q parsed to %s, want %s", test.toml, encoded, test.json)
+		}
+	}
+}
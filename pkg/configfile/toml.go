@@ -0,0 +1,467 @@
+package configfile
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+`)
+	tomlInt     = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)$`)
+	tomlFloat   = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+	tomlDate    = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}|^[0-9]{2}:[0-9]{2}`)
+)
+
+// tomlParser parses a TOML document of tables, arrays of tables, inline tables, arrays, strings, booleans and
+// numbers into maps, slices and scalars.
+type tomlParser struct {
+	s    string
+	pos  int
+	root map[string]interface{}
+	// defined are the paths of the tables defined by a header, a table must not be defined twice
+	defined map[string]bool
+}
+
+func parseTOML(data string) (interface{}, error) {
+	p := &tomlParser{
+		s:       strings.ReplaceAll(data, "\r\n", "\n"),
+		root:    make(map[string]interface{}),
+		defined: make(map[string]bool),
+	}
+
+	current := p.root
+
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.s) {
+			return p.root, nil
+		}
+
+		if p.s[p.pos] == '[' {
+			closing := "]"
+			if strings.HasPrefix(p.s[p.pos:], "[[") {
+				closing = "]]"
+			}
+			p.pos += len(closing)
+
+			keys, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+
+			if !strings.HasPrefix(p.s[p.pos:], closing) {
+				return nil, p.errorf("expected %s after the table name", closing)
+			}
+			p.pos += len(closing)
+
+			if current, err = p.table(keys, closing == "]]"); err != nil {
+				return nil, err
+			}
+		} else if err := p.keyValue(current); err != nil {
+			return nil, err
+		}
+
+		p.skipSpace()
+		p.skipComment()
+		if p.pos < len(p.s) && p.s[p.pos] != '\n' {
+			return nil, p.errorf("expected the end of the line")
+		}
+	}
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	line := 1 + strings.Count(p.s[:p.pos], "\n")
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if p.pos < len(p.s) && p.s[p.pos] == '#' {
+		for p.pos < len(p.s) && p.s[p.pos] != '\n' {
+			p.pos++
+		}
+	}
+}
+
+// skipBlank skips whitespace, line breaks and comments.
+func (p *tomlParser) skipBlank() {
+	for {
+		p.skipSpace()
+		p.skipComment()
+		if p.pos >= len(p.s) || p.s[p.pos] != '\n' {
+			return
+		}
+		p.pos++
+	}
+}
+
+// table returns the table of a [header] or the new element of an [[array of tables]].
+func (p *tomlParser) table(keys []string, array bool) (map[string]interface{}, error) {
+	table := p.root
+	path := ""
+
+	for _, key := range keys[:len(keys)-1] {
+		next, segment, err := descend(table, key)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		table, path = next, path+"."+segment
+	}
+
+	last := keys[len(keys)-1]
+
+	if array {
+		items, ok := table[last].([]interface{})
+		if _, exists := table[last]; exists && !ok {
+			return nil, p.errorf("key %q is already defined", last)
+		}
+
+		element := make(map[string]interface{})
+		table[last] = append(items, element)
+
+		return element, nil
+	}
+
+	path += "." + last
+	if p.defined[path] {
+		return nil, p.errorf("table %s is defined twice", path[1:])
+	}
+	p.defined[path] = true
+
+	next, _, err := descend(table, last)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+
+	return next, nil
+}
+
+// descend returns the table of the key, created if missing, or the last element of an array of tables. The segment
+// identifies the table in the path of the headers.
+func descend(table map[string]interface{}, key string) (map[string]interface{}, string, error) {
+	switch v := table[key].(type) {
+	case nil:
+		next := make(map[string]interface{})
+		table[key] = next
+		return next, key, nil
+	case map[string]interface{}:
+		return v, key, nil
+	case []interface{}:
+		if len(v) > 0 {
+			if next, ok := v[len(v)-1].(map[string]interface{}); ok {
+				return next, key + "[" + strconv.Itoa(len(v)-1) + "]", nil
+			}
+		}
+	}
+
+	return nil, "", fmt.Errorf("key %q is not a table", key)
+}
+
+// keyValue parses "key = value" into the table, dotted keys create the tables in between.
+func (p *tomlParser) keyValue(table map[string]interface{}) error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+
+	if p.pos >= len(p.s) || p.s[p.pos] != '=' {
+		return p.errorf("expected = after the key")
+	}
+	p.pos++
+	p.skipSpace()
+
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys[:len(keys)-1] {
+		if table, _, err = descend(table, key); err != nil {
+			return p.errorf("%v", err)
+		}
+	}
+
+	last := keys[len(keys)-1]
+	if _, ok := table[last]; ok {
+		return p.errorf("duplicate key %q", last)
+	}
+	table[last] = value
+
+	return nil
+}
+
+// key parses a bare, quoted or dotted key.
+func (p *tomlParser) key() ([]string, error) {
+	var keys []string
+
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.s) {
+			return nil, p.errorf("expected a key")
+		}
+
+		var key string
+		var err error
+
+		switch p.s[p.pos] {
+		case '"':
+			key, err = p.basicString()
+		case '\'':
+			key, err = p.literalString()
+		default:
+			key = tomlBareKey.FindString(p.s[p.pos:])
+			if key == "" {
+				return nil, p.errorf("expected a key")
+			}
+			p.pos += len(key)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+
+		p.skipSpace()
+		if p.pos >= len(p.s) || p.s[p.pos] != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *tomlParser) value() (interface{}, error) {
+	if p.pos >= len(p.s) {
+		return nil, p.errorf("expected a value")
+	}
+
+	rest := p.s[p.pos:]
+
+	switch {
+	case strings.HasPrefix(rest, `"""`), strings.HasPrefix(rest, "'''"):
+		return p.multilineString()
+	case rest[0] == '"':
+		return p.basicString()
+	case rest[0] == '\'':
+		return p.literalString()
+	case rest[0] == '[':
+		return p.array()
+	case rest[0] == '{':
+		return p.inlineTable()
+	}
+
+	// booleans and numbers end at whitespace, a separator or a comment
+	end := strings.IndexAny(rest, " \t\n,]}#")
+	if end < 0 {
+		end = len(rest)
+	}
+	token := rest[:end]
+
+	switch token {
+	case "true":
+		p.pos += end
+		return true, nil
+	case "false":
+		p.pos += end
+		return false, nil
+	}
+
+	if tomlDate.MatchString(token) {
+		return nil, p.errorf("dates and times are not supported")
+	}
+
+	number := strings.ReplaceAll(token, "_", "")
+	if strings.HasPrefix(token, "_") || strings.HasSuffix(token, "_") || strings.Contains(token, "__") {
+		number = ""
+	}
+
+	var value interface{}
+	var err error
+
+	switch {
+	case tomlInt.MatchString(number):
+		value, err = strconv.ParseInt(number, 10, 64)
+	case strings.HasPrefix(number, "0x"):
+		value, err = strconv.ParseInt(number[2:], 16, 64)
+	case strings.HasPrefix(number, "0o"):
+		value, err = strconv.ParseInt(number[2:], 8, 64)
+	case strings.HasPrefix(number, "0b"):
+		value, err = strconv.ParseInt(number[2:], 2, 64)
+	case tomlFloat.MatchString(number) && strings.ContainsAny(number, ".eE"):
+		value, err = strconv.ParseFloat(number, 64)
+	default:
+		err = errors.New("invalid")
+	}
+
+	if err != nil {
+		return nil, p.errorf("invalid value %q", token)
+	}
+	p.pos += end
+
+	return value, nil
+}
+
+func (p *tomlParser) basicString() (string, error) {
+	var b strings.Builder
+
+	for i := p.pos + 1; i < len(p.s); i++ {
+		switch c := p.s[i]; c {
+		case '"':
+			p.pos = i + 1
+			return b.String(), nil
+		case '\\':
+			text, n, err := unescape(p.s[i+1:])
+			if err != nil {
+				return "", p.errorf("%v", err)
+			}
+			b.WriteString(text)
+			i += n
+		case '\n':
+			return "", p.errorf("unterminated string")
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", p.errorf("unterminated string")
+}
+
+func (p *tomlParser) literalString() (string, error) {
+	end := strings.IndexAny(p.s[p.pos+1:], "'\n")
+	if end < 0 || p.s[p.pos+1+end] != '\'' {
+		return "", p.errorf("unterminated string")
+	}
+
+	value := p.s[p.pos+1 : p.pos+1+end]
+	p.pos += end + 2
+
+	return value, nil
+}
+
+// multilineString parses a basic or literal string in triple quotes, spanning several lines. A line break right after the
+// opening quotes is dropped, as is a backslash at the end of a line of a basic string along with the following
+// whitespace.
+func (p *tomlParser) multilineString() (string, error) {
+	q := p.s[p.pos]
+	delimiter := strings.Repeat(string(q), 3)
+	start := p.pos
+	p.pos += 3
+
+	if p.pos < len(p.s) && p.s[p.pos] == '\n' {
+		p.pos++
+	}
+
+	var b strings.Builder
+
+	for p.pos < len(p.s) {
+		if strings.HasPrefix(p.s[p.pos:], delimiter) {
+			// up to two quotes right before the closing ones belong to the string
+			n := 3
+			for n < 5 && p.pos+n < len(p.s) && p.s[p.pos+n] == q {
+				n++
+			}
+			b.WriteString(p.s[p.pos : p.pos+n-3])
+			p.pos += n
+
+			return b.String(), nil
+		}
+
+		c := p.s[p.pos]
+		if c != '\\' || q == '\'' {
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+
+		if rest := strings.TrimLeft(p.s[p.pos+1:], " \t"); strings.HasPrefix(rest, "\n") {
+			p.pos = len(p.s) - len(strings.TrimLeft(rest, " \t\n"))
+			continue
+		}
+
+		text, n, err := unescape(p.s[p.pos+1:])
+		if err != nil {
+			return "", p.errorf("%v", err)
+		}
+		b.WriteString(text)
+		p.pos += 1 + n
+	}
+
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+func (p *tomlParser) array() ([]interface{}, error) {
+	p.pos++
+	items := []interface{}{}
+
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.s) {
+			return nil, p.errorf("unterminated array")
+		}
+		if p.s[p.pos] == ']' {
+			p.pos++
+			return items, nil
+		}
+
+		item, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+
+		p.skipBlank()
+		if p.pos >= len(p.s) {
+			return nil, p.errorf("unterminated array")
+		}
+
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (p *tomlParser) inlineTable() (map[string]interface{}, error) {
+	p.pos++
+	table := make(map[string]interface{})
+
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.s) {
+			return nil, p.errorf("unterminated inline table")
+		}
+		if p.s[p.pos] == '}' {
+			p.pos++
+			return table, nil
+		}
+
+		if err := p.keyValue(table); err != nil {
+			return nil, err
+		}
+
+		p.skipBlank()
+		if p.pos >= len(p.s) {
+			return nil, p.errorf("unterminated inline table")
+		}
+
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+		default:
+			return nil, p.errorf("expected , or } in inline table")
+		}
+	}
+}
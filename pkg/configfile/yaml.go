@@ -0,0 +1,679 @@
+package configfile
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	yamlInt   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	yamlHex   = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+	yamlOctal = regexp.MustCompile(`^0o[0-7]+$`)
+	yamlFloat = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+
+	errFlowIncomplete = errors.New("unterminated flow collection")
+)
+
+// yamlPlain is an unquoted scalar, its type depends on the field it is decoded into, see conform.
+type yamlPlain string
+
+// yamlParser parses a YAML document of block mappings, block sequences, block scalars and flow collections into
+// maps, slices and scalars.
+type yamlParser struct {
+	lines []string
+	pos   int
+}
+
+func parseYAML(data string) (interface{}, error) {
+	data = strings.TrimSuffix(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	p := &yamlParser{lines: strings.Split(data, "\n")}
+
+	// the document may start with a marker
+	for p.pos < len(p.lines) && isBlankOrComment(p.lines[p.pos]) {
+		p.pos++
+	}
+	if p.pos < len(p.lines) && (p.lines[p.pos] == "---" || strings.HasPrefix(p.lines[p.pos], "--- #")) {
+		p.pos++
+	}
+
+	indent, _, ok, err := p.peek()
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	value, err := p.parseBlock(indent)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, ok, err := p.peek(); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, p.errorf(p.pos, "unexpected content after the document")
+	}
+
+	return value, nil
+}
+
+func (p *yamlParser) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", line+1, fmt.Sprintf(format, args...))
+}
+
+// peek skips blank and comment lines, returning the indentation and text of the next line.
+func (p *yamlParser) peek() (int, string, bool, error) {
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if isBlankOrComment(line) {
+			continue
+		}
+
+		text := strings.TrimLeft(line, " ")
+		indent := len(line) - len(text)
+
+		if text[0] == '\t' {
+			return 0, "", false, p.errorf(p.pos, "tabs are not allowed for indentation")
+		}
+		if indent == 0 && (strings.HasPrefix(text, "---") || strings.HasPrefix(text, "...")) {
+			return 0, "", false, p.errorf(p.pos, "multiple documents are not supported")
+		}
+		if indent == 0 && text[0] == '%' {
+			return 0, "", false, p.errorf(p.pos, "directives are not supported")
+		}
+
+		return indent, strings.TrimRight(text, " \t"), true, nil
+	}
+
+	return 0, "", false, nil
+}
+
+// parseBlock parses the node starting on the current line, which is indented by indent.
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	_, text, _, _ := p.peek()
+
+	if isSequenceItem(text) {
+		return p.parseSequence(indent)
+	}
+	if _, _, isKey, err := splitKey(text); err != nil {
+		return nil, p.errorf(p.pos, "%v", err)
+	} else if isKey {
+		return p.parseMapping(indent)
+	}
+
+	return p.parseValue(text, indent-1, false)
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+
+	for {
+		lineIndent, text, ok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if !ok || lineIndent < indent {
+			return m, nil
+		}
+		if lineIndent > indent {
+			return nil, p.errorf(p.pos, "unexpected indentation")
+		}
+
+		key, rest, isKey, err := splitKey(text)
+		if err != nil {
+			return nil, p.errorf(p.pos, "%v", err)
+		}
+		if !isKey || isSequenceItem(text) {
+			return nil, p.errorf(p.pos, "expected a key of the mapping")
+		}
+		if _, ok := m[key]; ok {
+			return nil, p.errorf(p.pos, "duplicate key %q", key)
+		}
+
+		value, err := p.parseValue(rest, indent, true)
+		if err != nil {
+			return nil, err
+		}
+
+		m[key] = value
+	}
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	items := []interface{}{}
+
+	for {
+		lineIndent, text, ok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if !ok || lineIndent < indent || lineIndent == indent && !isSequenceItem(text) {
+			return items, nil
+		}
+		if lineIndent > indent {
+			return nil, p.errorf(p.pos, "unexpected indentation")
+		}
+
+		rest := strings.TrimLeft(text[1:], " ")
+		itemIndent := indent + len(text) - len(rest)
+
+		var item interface{}
+
+		if _, _, isKey, _ := splitKey(rest); rest != "" && (isKey || isSequenceItem(rest)) {
+			// a collection starting on the line of the dash continues at the indentation of its first entry
+			p.lines[p.pos] = strings.Repeat(" ", itemIndent) + rest
+			item, err = p.parseBlock(itemIndent)
+		} else {
+			item, err = p.parseValue(rest, indent, false)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+}
+
+// parseValue parses the value following a key or dash on the current line, nested blocks have to be indented
+// further than indent. A sequence may start at the indentation of the key of a mapping.
+func (p *yamlParser) parseValue(rest string, indent int, inMapping bool) (interface{}, error) {
+	line := p.pos
+	p.pos++
+
+	rest = strings.TrimLeft(rest, " ")
+
+	switch {
+	case rest == "" || rest[0] == '#':
+		lineIndent, text, ok, err := p.peek()
+		if err != nil || !ok {
+			return nil, err
+		}
+		if lineIndent > indent {
+			return p.parseBlock(lineIndent)
+		}
+		if inMapping && lineIndent == indent && isSequenceItem(text) {
+			return p.parseSequence(indent)
+		}
+
+		return nil, nil
+	case rest[0] == '|' || rest[0] == '>':
+		return p.parseBlockScalar(rest, indent, line)
+	case rest[0] == '[' || rest[0] == '{':
+		return p.parseFlow(rest, indent, line)
+	case rest[0] == '&' || rest[0] == '*' || rest[0] == '!':
+		return nil, p.errorf(line, "anchors, aliases and tags are not supported")
+	case rest[0] == '"' || rest[0] == '\'':
+		value, n, err := quoted(rest)
+		if err != nil {
+			return nil, p.errorf(line, "%v", err)
+		}
+		if after := strings.TrimLeft(rest[n:], " \t"); after != "" && after[0] != '#' {
+			return nil, p.errorf(line, "unexpected text after the quoted string")
+		}
+
+		return value, nil
+	}
+
+	return yamlPlain(stripComment(rest)), nil
+}
+
+// parseBlockScalar parses a literal (|) or folded (>) block scalar, optionally with the chomping indicator - or +.
+func (p *yamlParser) parseBlockScalar(header string, indent int, line int) (interface{}, error) {
+	header = stripComment(header)
+	literal := header[0] == '|'
+
+	chomp := header[1:]
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, p.errorf(line, "unsupported block scalar header %q", header)
+	}
+
+	var lines []string
+	contentIndent := -1
+
+	for ; p.pos < len(p.lines); p.pos++ {
+		raw := p.lines[p.pos]
+		if strings.TrimSpace(raw) == "" {
+			lines = append(lines, "")
+			continue
+		}
+
+		lineIndent := len(raw) - len(strings.TrimLeft(raw, " "))
+		if lineIndent <= indent {
+			break
+		}
+		if contentIndent < 0 {
+			contentIndent = lineIndent
+		}
+		if lineIndent < contentIndent {
+			return nil, p.errorf(p.pos, "line is indented less than the first line of the block scalar")
+		}
+
+		lines = append(lines, raw[contentIndent:])
+	}
+
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var text string
+	if literal {
+		text = strings.Join(lines, "\n")
+	} else {
+		text = fold(lines)
+	}
+
+	if chomp != "-" && len(lines) > 0 {
+		text += "\n"
+	}
+	if chomp == "+" {
+		text += strings.Repeat("\n", trailing)
+	}
+
+	return text, nil
+}
+
+// fold joins the lines of a folded block scalar, single line breaks become spaces apart from more indented lines.
+func fold(lines []string) string {
+	var b strings.Builder
+	breaks, normal, written := 0, false, false
+
+	for _, line := range lines {
+		if line == "" {
+			breaks++
+			continue
+		}
+
+		moreIndented := line[0] == ' ' || line[0] == '\t'
+
+		switch {
+		case !written:
+			b.WriteString(strings.Repeat("\n", breaks))
+		case normal && !moreIndented && breaks == 0:
+			b.WriteByte(' ')
+		case normal && !moreIndented:
+			b.WriteString(strings.Repeat("\n", breaks))
+		default:
+			b.WriteString(strings.Repeat("\n", breaks+1))
+		}
+
+		b.WriteString(line)
+		breaks, normal, written = 0, !moreIndented, true
+	}
+
+	return b.String()
+}
+
+// parseFlow parses a flow collection, continued on the following lines until it is complete.
+func (p *yamlParser) parseFlow(text string, indent int, line int) (interface{}, error) {
+	for {
+		f := &flowParser{s: text}
+
+		value, err := f.value()
+		if err == errFlowIncomplete && p.pos < len(p.lines) {
+			// continuation lines are indented further, apart from the closing bracket
+			next := p.lines[p.pos]
+			trimmed := strings.TrimLeft(next, " ")
+			if isBlankOrComment(next) || len(next)-len(trimmed) > indent || trimmed[0] == ']' || trimmed[0] == '}' {
+				text += "\n" + next
+				p.pos++
+				continue
+			}
+		}
+		if err != nil {
+			return nil, p.errorf(line, "%v", err)
+		}
+
+		f.skip()
+		if f.pos < len(f.s) {
+			return nil, p.errorf(line, "unexpected text after the flow collection")
+		}
+
+		return value, nil
+	}
+}
+
+// flowParser parses the flow collections [a, b] and {a: b}.
+type flowParser struct {
+	s   string
+	pos int
+}
+
+// skip skips whitespace, line breaks and comments.
+func (f *flowParser) skip() {
+	for f.pos < len(f.s) {
+		switch c := f.s[f.pos]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			f.pos++
+		case c == '#' && (f.pos == 0 || strings.ContainsRune(" \t\n", rune(f.s[f.pos-1]))):
+			for f.pos < len(f.s) && f.s[f.pos] != '\n' {
+				f.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (f *flowParser) value() (interface{}, error) {
+	f.skip()
+	if f.pos >= len(f.s) {
+		return nil, errFlowIncomplete
+	}
+
+	switch f.s[f.pos] {
+	case '[':
+		f.pos++
+		items := []interface{}{}
+
+		for {
+			if done, err := f.next(']'); err != nil || done {
+				return items, err
+			}
+
+			item, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, item)
+
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.pos++
+		m := make(map[string]interface{})
+
+		for {
+			if done, err := f.next('}'); err != nil || done {
+				return m, err
+			}
+
+			key, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+
+			name, ok := key.(string)
+			if plain, isPlain := key.(yamlPlain); isPlain {
+				name, ok = string(plain), true
+			}
+			if !ok {
+				return nil, errors.New("keys of flow mappings have to be scalars")
+			}
+			if _, ok := m[name]; ok {
+				return nil, fmt.Errorf("duplicate key %q", name)
+			}
+
+			f.skip()
+			if f.pos >= len(f.s) {
+				return nil, errFlowIncomplete
+			}
+			if f.s[f.pos] != ':' {
+				return nil, fmt.Errorf("expected : after the key %q", name)
+			}
+			f.pos++
+
+			f.skip()
+			if f.pos < len(f.s) && (f.s[f.pos] == ',' || f.s[f.pos] == '}') {
+				m[name] = nil
+			} else if m[name], err = f.value(); err != nil {
+				return nil, err
+			}
+
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	case '"', '\'':
+		value, n, err := quoted(f.s[f.pos:])
+		if err != nil {
+			return nil, err
+		}
+		f.pos += n
+
+		return value, nil
+	case '&', '*', '!':
+		return nil, errors.New("anchors, aliases and tags are not supported")
+	}
+
+	start := f.pos
+	for ; f.pos < len(f.s); f.pos++ {
+		c := f.s[f.pos]
+		if strings.IndexByte(",[]{}\n", c) >= 0 ||
+			c == ':' && (f.pos+1 == len(f.s) || strings.IndexByte(" \t\n,[]{}", f.s[f.pos+1]) >= 0) ||
+			c == '#' && strings.IndexByte(" \t", f.s[f.pos-1]) >= 0 {
+			break
+		}
+	}
+
+	return yamlPlain(strings.TrimSpace(f.s[start:f.pos])), nil
+}
+
+// next skips to the next entry of a collection, telling if the collection ended.
+func (f *flowParser) next(end byte) (bool, error) {
+	f.skip()
+	if f.pos >= len(f.s) {
+		return false, errFlowIncomplete
+	}
+	if f.s[f.pos] == end {
+		f.pos++
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// separator expects a comma or the end of the collection after an entry.
+func (f *flowParser) separator(end byte) error {
+	f.skip()
+	if f.pos >= len(f.s) {
+		return errFlowIncomplete
+	}
+
+	switch f.s[f.pos] {
+	case ',':
+		f.pos++
+	case end:
+	default:
+		return fmt.Errorf("expected , or %c in flow collection", end)
+	}
+
+	return nil
+}
+
+// quoted parses the single or double quoted string at the start of s, returning its value and length.
+func quoted(s string) (string, int, error) {
+	q := s[0]
+	var b strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == q:
+			return b.String(), i + 1, nil
+		case c == '\\' && q == '"':
+			text, n, err := unescape(s[i+1:])
+			if err != nil {
+				return "", 0, err
+			}
+			b.WriteString(text)
+			i += n
+		case c == '\n':
+			return "", 0, errors.New("quoted strings spanning several lines are not supported")
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", 0, errors.New("unterminated quoted string")
+}
+
+// splitKey splits "key: value" into key and value, telling if the text is an entry of a mapping at all.
+func splitKey(text string) (string, string, bool, error) {
+	if text == "" || strings.IndexByte("[{#|>", text[0]) >= 0 {
+		return "", "", false, nil
+	}
+
+	if text[0] == '"' || text[0] == '\'' {
+		key, n, err := quoted(text)
+		if err != nil {
+			return "", "", false, err
+		}
+
+		after := strings.TrimLeft(text[n:], " ")
+		if strings.HasPrefix(after, ":") && (len(after) == 1 || after[1] == ' ') {
+			return key, after[1:], true, nil
+		}
+
+		return "", "", false, nil
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] == '#' && i > 0 && text[i-1] == ' ' {
+			break
+		}
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimRight(text[:i], " "), text[i+1:], true, nil
+		}
+	}
+
+	return "", "", false, nil
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func isBlankOrComment(line string) bool {
+	text := strings.TrimSpace(line)
+	return text == "" || text[0] == '#'
+}
+
+// stripComment drops a trailing comment of a plain scalar.
+func stripComment(text string) string {
+	for i := 1; i < len(text); i++ {
+		if text[i] == '#' && (text[i-1] == ' ' || text[i-1] == '\t') {
+			text = text[:i]
+			break
+		}
+	}
+
+	return strings.TrimSpace(text)
+}
+
+// resolvePlain returns the null, boolean, number or string of a plain scalar, following the core schema of YAML 1.2.
+func resolvePlain(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+
+	switch {
+	case yamlInt.MatchString(s):
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	case yamlHex.MatchString(s):
+		if n, err := strconv.ParseInt(s[2:], 16, 64); err == nil {
+			return n
+		}
+	case yamlOctal.MatchString(s):
+		if n, err := strconv.ParseInt(s[2:], 8, 64); err == nil {
+			return n
+		}
+	case yamlFloat.MatchString(s):
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return n
+		}
+	}
+
+	return s
+}
+
+// conform resolves the plain scalars of the tree by the type of the fields they are decoded into. Like YAML libraries
+// do, a plain scalar looking like a number or boolean is kept as text for string fields, i.e. "status: 200".
+func conform(value interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch v := value.(type) {
+	case yamlPlain:
+		if t != nil && t.Kind() == reflect.String && v != "~" && v != "null" && v != "Null" && v != "NULL" {
+			return string(v)
+		}
+
+		return resolvePlain(string(v))
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+
+		for i := range v {
+			v[i] = conform(v[i], elem)
+		}
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = conform(item, fieldType(t, key))
+		}
+	}
+
+	return value
+}
+
+// fieldType returns the type of the map element or struct field that the key is decoded into, matching the json tags
+// like encoding/json does. It is nil if unknown.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		var folded reflect.Type
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			if name == key {
+				return field.Type
+			}
+			if folded == nil && strings.EqualFold(name, key) {
+				folded = field.Type
+			}
+		}
+
+		return folded
+	}
+
+	return nil
+}
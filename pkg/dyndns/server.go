@@ -5,20 +5,22 @@ import (
 	"net"
 	"net/http"
 
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
 	log "github.com/sirupsen/logrus"
 )
 
 type Server struct {
 	log     *log.Entry
-	out     chan<- *net.IP
+	out     chan<- *events.IPUpdate
 	localIp *net.IP
 
 	Username  string
-	Password  string
+	Password  *secrets.Secret
 	BasicAuth bool
 }
 
-func NewServer(out chan<- *net.IP, localIp *net.IP) *Server {
+func NewServer(out chan<- *events.IPUpdate, localIp *net.IP) *Server {
 	return &Server{
 		log:     log.WithField("module", "dyndns"),
 		out:     out,
@@ -26,19 +28,20 @@ func NewServer(out chan<- *net.IP, localIp *net.IP) *Server {
 	}
 }
 
-// Handler offers a simple HTTP handler func for an HTTP server.
-// It expects the IP address parameters and will relay them towards the CloudFlare updater
-// worker once they get submitted.
-//
-// Expected parameters can be
-//   "ipaddr" IPv4 address
-//   "ip6addr" IPv6 address
-//
-// see https://service.avm.de/help/de/FRITZ-Box-Fon-WLAN-7490/016/hilfe_dyndns
-func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
+// Protect wraps another handler with the same credential checks the update handler uses.
+func (s *Server) Protect(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorize(w, r) {
+			return
+		}
 
-	s.log.Info("Received incoming DynDNS update")
+		handler(w, r)
+	}
+}
+
+// authorize checks the request credentials and writes the rejection response if they do not match.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) bool {
+	params := r.URL.Query()
 
 	// check request basic auth, if configured
 	username, password, ok := r.BasicAuth()
@@ -46,7 +49,7 @@ func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
 		s.log.Warn("Rejected due to basic auth mismatch")
 		w.Header().Set("WWW-Authenticate", "Basic realm=\"Authentication required to access this resource\"")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+		return false
 	}
 
 	// use request parameters for auth, if basic auth is not configured
@@ -56,9 +59,30 @@ func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check username / password match
-	if subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) != 1 || subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) != 1 {
+	if subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) != 1 || subtle.ConstantTimeCompare([]byte(password), []byte(s.Password.Value())) != 1 {
 		s.log.Warn("Rejected due to username / password mismatch")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// Handler offers a simple HTTP handler func for an HTTP server.
+// It expects the IP address parameters and will relay them towards the CloudFlare updater
+// worker once they get submitted.
+//
+// Expected parameters can be
+//   "ipaddr" IPv4 address
+//   "ip6addr" IPv6 address
+//
+// see https://service.avm.de/help/de/FRITZ-Box-Fon-WLAN-7490/016/hilfe_dyndns
+func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	s.log.Info("Received incoming DynDNS update")
+
+	if !s.authorize(w, r) {
 		return
 	}
 
@@ -66,7 +90,7 @@ func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
 	ipv4 := net.ParseIP(params.Get("v4"))
 	if ipv4 != nil && ipv4.To4() != nil {
 		s.log.WithField("ipv4", ipv4).Info("Forwarding update request for IPv4")
-		s.out <- &ipv4
+		s.out <- &events.IPUpdate{IP: ipv4, Source: events.SourcePush}
 	}
 
 	if *s.localIp == nil {
@@ -74,7 +98,7 @@ func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
 		ipv6 := net.ParseIP(params.Get("v6"))
 		if ipv6 != nil && ipv6.To4() == nil {
 			s.log.WithField("ipv6", ipv6).Info("Forwarding update request for IPv6")
-			s.out <- &ipv6
+			s.out <- &events.IPUpdate{IP: ipv6, Source: events.SourcePush}
 		}
 	} else {
 		// Parse Prefix
@@ -90,7 +114,7 @@ func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			s.log.WithField("prefix", prefix).WithField("ipv6", constructedIp).Info("Forwarding update request for IPv6")
-			s.out <- &constructedIp
+			s.out <- &events.IPUpdate{IP: constructedIp, Prefix: prefix, Source: events.SourcePush}
 		}
 	}
 
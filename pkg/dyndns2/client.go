@@ -0,0 +1,194 @@
+package dyndns2
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/state"
+)
+
+// userAgent identifies the client, the protocol asks for a meaningful one
+const userAgent = "router-dyndns-helper"
+
+// updatePath is used if the server URL has no path of its own
+const updatePath = "/nic/update"
+
+// Return codes of the protocol
+const (
+	CodeGood  = "good"
+	CodeNoChg = "nochg"
+	Code911   = "911"
+)
+
+// fatalCodes must not be retried, the host is suspended until its config changes
+var fatalCodes = map[string]string{
+	"badauth":  "invalid user name or password",
+	"!donator": "feature not available to the account",
+	"notfqdn":  "host name is not a fully qualified domain name",
+	"nohost":   "host name does not exist in the account",
+	"numhost":  "too many host names in one request",
+	"abuse":    "host name blocked for abuse",
+	"badagent": "user agent blocked",
+	"badsys":   "invalid system parameter",
+	"!yours":   "host name belongs to another account",
+}
+
+// backOffCodes ask the client to stop sending updates for a while
+var backOffCodes = map[string]string{
+	Code911:  "server side error",
+	"dnserr": "server side DNS error",
+}
+
+// accountCodes concern the whole call instead of a single host name, servers may answer them with a single line
+var accountCodes = map[string]bool{
+	"badauth":  true,
+	"!donator": true,
+	"numhost":  true,
+	"badagent": true,
+	"badsys":   true,
+	Code911:    true,
+	"dnserr":   true,
+}
+
+// Account is a dyndns2 server along with the credentials and the host names updated with a single call.
+type Account struct {
+	Name      string
+	Server    string
+	Username  string
+	Password  *secrets.Secret
+	Hostnames []string
+	Timeout   time.Duration
+	Onipv4    bool
+	Onipv6    bool
+}
+
+// HostResult is the return code of a single host name.
+type HostResult struct {
+	Hostname string
+	Code     string
+	// Line is the full response line, i.e. "good 192.0.2.1"
+	Line string
+}
+
+// Fatal tells if the code forbids further updates of the host.
+func (r HostResult) Fatal() bool {
+	_, ok := fatalCodes[r.Code]
+	return ok
+}
+
+// BackOff tells if the code asks to pause all updates.
+func (r HostResult) BackOff() bool {
+	_, ok := backOffCodes[r.Code]
+	return ok
+}
+
+// Success tells if the host was updated or already had the address.
+func (r HostResult) Success() bool {
+	return r.Code == CodeGood || r.Code == CodeNoChg
+}
+
+// Describe explains the code.
+func (r HostResult) Describe() string {
+	if reason, ok := fatalCodes[r.Code]; ok {
+		return reason
+	}
+	if reason, ok := backOffCodes[r.Code]; ok {
+		return reason
+	}
+	if r.Success() {
+		return "updated"
+	}
+
+	return "unknown response " + r.Line
+}
+
+// fingerprint identifies the config of a host, a suspension is lifted once it changes. It is keyed by the salt of the
+// store, so the stored value cannot be used to guess the password.
+func (a *Account) fingerprint(store *state.Store, hostname string) string {
+	return store.Fingerprint(a.Server, a.Username, a.Password.Value(), hostname)
+}
+
+// updateURL builds the update call for the host names, the password is sent as basic auth only.
+func (a *Account) updateURL(hostnames []string, ip net.IP) (string, error) {
+	u, err := url.Parse(a.Server)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = updatePath
+	}
+
+	query := u.Query()
+	query.Set("hostname", strings.Join(hostnames, ","))
+	query.Set("myip", ip.String())
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// update sends a single call for all host names and maps the response lines to them. A single line with a code
+// concerning the whole call, i.e. badauth or 911, applies to all host names. Any other number of lines than host names
+// is an error, as the lines cannot be told apart.
+func (a *Account) update(hostnames []string, ip net.IP) ([]HostResult, error) {
+	updateURL, err := a.updateURL(hostnames, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(http.MethodGet, updateURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.SetBasicAuth(a.Username, a.Password.Value())
+	request.Header.Set("User-Agent", userAgent)
+
+	client := &http.Client{Timeout: a.Timeout}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("empty response with status %s", response.Status)
+	}
+
+	if len(lines) != len(hostnames) && (len(lines) != 1 || !accountCodes[strings.Fields(lines[0])[0]]) {
+		return nil, fmt.Errorf("response has %d lines for %d host names: %s", len(lines), len(hostnames), strings.Join(lines, ", "))
+	}
+
+	results := make([]HostResult, len(hostnames))
+
+	for i, hostname := range hostnames {
+		line := lines[0]
+		if len(lines) == len(hostnames) {
+			line = lines[i]
+		}
+
+		results[i] = HostResult{Hostname: hostname, Code: strings.Fields(line)[0], Line: line}
+	}
+
+	return results, nil
+}
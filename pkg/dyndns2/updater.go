@@ -0,0 +1,389 @@
+package dyndns2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/history"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProviderName identifies the updater in the history and the outbox
+const ProviderName = "dyndns2"
+
+// BackOffDuration is the pause after a 911 or dnserr response, as the protocol asks for
+const BackOffDuration = 30 * time.Minute
+
+type Updater struct {
+	log *log.Entry
+
+	isInit bool
+
+	In chan *events.IPUpdate
+
+	Accounts []*Account
+
+	// end of the back-off per account name
+	mu      sync.Mutex
+	backOff map[string]time.Time
+
+	// DryRun logs the update calls instead of sending them
+	DryRun bool
+
+	// History journals the outcome of every host name, if set
+	History *history.Journal
+
+	// Outbox stores failed calls for a later retry, if set
+	Outbox *outbox.Outbox
+
+	// State keeps the suspended host names, only in memory unless replaced by a persistent store
+	State *state.Store
+
+	latest events.Latest
+}
+
+func NewUpdater() *Updater {
+	store, _ := state.NewStore("")
+
+	return &Updater{
+		log:     log.WithField("module", "dyndns2"),
+		isInit:  false,
+		In:      make(chan *events.IPUpdate, 10),
+		backOff: make(map[string]time.Time),
+		State:   store,
+	}
+}
+
+func (u *Updater) InitFromEnvironment() error {
+	// allows up to 9 accounts, same as the hooks, indexes can be skipped
+	for accountIndex := 1; accountIndex < 10; accountIndex++ {
+		// read from DYNDNS2_1_*, DYNDNS2_2_* ... DYNDNS2_9_*, skipping when empty server
+		prefix := fmt.Sprintf("DYNDNS2_%d_", accountIndex)
+
+		server := os.Getenv(prefix + "SERVER")
+		if server == "" {
+			continue
+		}
+
+		var hostnames []string
+		for _, hostname := range strings.Split(os.Getenv(prefix+"HOSTNAMES"), ",") {
+			if hostname = strings.TrimSpace(hostname); hostname != "" {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		if len(hostnames) == 0 {
+			log.Warn(fmt.Sprintf("No %sHOSTNAMES set, skipping account", prefix))
+			continue
+		}
+
+		name := os.Getenv(prefix + "NAME")
+		if name == "" {
+			name = strconv.Itoa(accountIndex)
+		}
+
+		timeoutStr := os.Getenv(prefix + "TIMEOUT")
+		if timeoutStr == "" {
+			timeoutStr = "30s"
+		}
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil || timeout < time.Second || timeout > 2*time.Minute {
+			if err == nil {
+				err = fmt.Errorf("value %s outside bounds [1s, 2m]", timeout)
+			}
+			log.WithError(err).Warn(fmt.Sprintf("Failed to parse %sTIMEOUT, using default value 30s", prefix))
+			timeout = 30 * time.Second
+		}
+
+		onIpV4, err := strconv.ParseBool(os.Getenv(prefix + "ONIPV4"))
+		if err != nil {
+			onIpV4 = true
+		}
+		onIpV6, err := strconv.ParseBool(os.Getenv(prefix + "ONIPV6"))
+		if err != nil {
+			onIpV6 = false
+		}
+
+		password, err := secrets.FromEnv(prefix + "PASSWORD")
+		if err != nil {
+			log.WithError(err).Warn("Failed to read the password, skipping account")
+			continue
+		}
+
+		u.Accounts = append(u.Accounts, &Account{
+			Name:      name,
+			Server:    server,
+			Username:  os.Getenv(prefix + "USERNAME"),
+			Password:  password,
+			Hostnames: hostnames,
+			Timeout:   timeout,
+			Onipv4:    onIpV4,
+			Onipv6:    onIpV6,
+		})
+	}
+
+	u.isInit = true
+
+	return nil
+}
+
+func (u *Updater) StartWorker() {
+	go u.spawnWorker()
+}
+
+func (u *Updater) shouldProcessUpdates() bool {
+	if !u.isInit {
+		return false
+	}
+
+	if len(u.Accounts) == 0 {
+		return false
+	}
+
+	return true
+}
+
+func (u *Updater) spawnWorker() {
+	for {
+		select {
+		case update := <-u.In:
+			if !u.shouldProcessUpdates() {
+				continue
+			}
+
+			u.latest.Remember(update)
+			u.log.WithField("ip", update.IP).Info("Received update request, updating all dyndns2 accounts")
+
+			wg := sync.WaitGroup{}
+
+			for _, account := range u.Accounts {
+				if !account.sendsFamily(update) {
+					continue
+				}
+				wg.Add(1)
+				go func(account *Account) {
+					defer wg.Done()
+					failed := u.updateAccount(account, account.Hostnames, update)
+					if u.DryRun {
+						return
+					}
+					// only the failed host names are retried, the others are done
+					for _, hostname := range account.Hostnames {
+						if err, ok := failed[hostname]; ok {
+							u.Outbox.Enqueue(ProviderName, outboxTarget(account, hostname), update, err)
+						} else {
+							u.Outbox.Complete(ProviderName, outboxTarget(account, hostname), update.IP)
+						}
+					}
+					// operations of the whole account stored by earlier versions are superseded
+					u.Outbox.Complete(ProviderName, account.Name, update.IP)
+				}(account)
+			}
+			wg.Wait()
+			u.log.Debug("dyndns2 updates done")
+		}
+	}
+}
+
+func (a *Account) sendsFamily(update *events.IPUpdate) bool {
+	if update.IP.To4() != nil {
+		return a.Onipv4
+	}
+
+	return a.Onipv6
+}
+
+func suspensionKey(account *Account, hostname string) string {
+	return ProviderName + "/" + account.Name + "/" + hostname
+}
+
+// outboxTarget identifies a host name of the account in the outbox.
+func outboxTarget(account *Account, hostname string) string {
+	return account.Name + "/" + hostname
+}
+
+// activeHostnames returns the given host names of the account that are not suspended. Suspensions of a changed config
+// are lifted.
+func (u *Updater) activeHostnames(account *Account, candidates []string) []string {
+	var hostnames []string
+
+	for _, hostname := range candidates {
+		key := suspensionKey(account, hostname)
+		suspension, ok := u.State.Suspension(key)
+
+		if ok && suspension.Fingerprint == account.fingerprint(u.State, hostname) {
+			u.log.WithField("account", account.Name).WithField("hostname", hostname).
+				Warn(fmt.Sprintf("Host name is suspended since %s after %s, change its config to resume updates",
+					suspension.Since.Format(time.RFC3339), suspension.Reason))
+			continue
+		}
+
+		if ok {
+			u.log.WithField("account", account.Name).WithField("hostname", hostname).Info("Config changed, resuming suspended host name")
+			if err := u.State.Resume(key); err != nil {
+				u.log.WithError(err).Error("Failed to store the state")
+			}
+		}
+
+		hostnames = append(hostnames, hostname)
+	}
+
+	return hostnames
+}
+
+// updateAccount sends the address to the given host names of the account that are active in a single call, returning
+// the errors of the host names that failed by name. Fatal codes suspend their host name and are not returned, as
+// retrying them is forbidden by the protocol.
+func (u *Updater) updateAccount(account *Account, candidates []string, update *events.IPUpdate) map[string]error {
+	alog := u.log.WithField("account", account.Name).WithField("ip", update.IP)
+
+	hostnames := u.activeHostnames(account, candidates)
+	if len(hostnames) == 0 {
+		alog.Warn("All host names are suspended, not sending dyndns2 update")
+		return nil
+	}
+
+	u.mu.Lock()
+	backOff := u.backOff[account.Name]
+	u.mu.Unlock()
+
+	if time.Now().Before(backOff) {
+		err := fmt.Errorf("server asked to back off until %s", backOff.Format(time.RFC3339))
+		alog.WithError(err).Warn("Not sending dyndns2 update")
+		return failAll(hostnames, err)
+	}
+
+	if u.DryRun {
+		updateURL, err := account.updateURL(hostnames, update.IP)
+		if err != nil {
+			return failAll(hostnames, err)
+		}
+		alog.Info(fmt.Sprintf("Dry run, would send dyndns2 update: GET %s", updateURL))
+		for _, hostname := range hostnames {
+			u.History.RecordUpdate(ProviderName, hostname, update.IP, true, nil)
+		}
+		return nil
+	}
+
+	results, err := account.update(hostnames, update.IP)
+
+	if err != nil {
+		alog.WithError(err).Error("dyndns2 update failed")
+		for _, hostname := range hostnames {
+			u.History.RecordUpdate(ProviderName, hostname, update.IP, false, err)
+		}
+		return failAll(hostnames, err)
+	}
+
+	failed := make(map[string]error)
+
+	for _, result := range results {
+		hlog := alog.WithField("hostname", result.Hostname).WithField("response", result.Line)
+
+		switch {
+		case result.Success():
+			hlog.Info("dyndns2 host name updated")
+			u.History.RecordUpdate(ProviderName, result.Hostname, update.IP, false, nil)
+			continue
+		case result.Fatal():
+			u.suspend(account, result)
+		case result.BackOff():
+			u.startBackOff(account)
+			failed[result.Hostname] = fmt.Errorf("%s: %s", result.Code, result.Describe())
+		default:
+			failed[result.Hostname] = errors.New(result.Describe())
+		}
+
+		err := fmt.Errorf("%s: %s", result.Code, result.Describe())
+		hlog.WithError(err).Error("dyndns2 host name update failed")
+		u.History.RecordUpdate(ProviderName, result.Hostname, update.IP, false, err)
+	}
+
+	return failed
+}
+
+// failAll returns the error for each of the host names.
+func failAll(hostnames []string, err error) map[string]error {
+	failed := make(map[string]error, len(hostnames))
+
+	for _, hostname := range hostnames {
+		failed[hostname] = err
+	}
+
+	return failed
+}
+
+func (u *Updater) suspend(account *Account, result HostResult) {
+	suspension := state.Suspension{
+		Fingerprint: account.fingerprint(u.State, result.Hostname),
+		Reason:      result.Code,
+		Since:       time.Now().UTC(),
+	}
+
+	u.log.WithField("account", account.Name).WithField("hostname", result.Hostname).
+		Error(fmt.Sprintf("Suspending host name after %s (%s) until its config changes", result.Code, result.Describe()))
+
+	if err := u.State.Suspend(suspensionKey(account, result.Hostname), suspension); err != nil {
+		u.log.WithError(err).Error("Failed to store the state")
+	}
+}
+
+func (u *Updater) startBackOff(account *Account) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.backOff[account.Name] = time.Now().Add(BackOffDuration)
+
+	u.log.WithField("account", account.Name).Warn(fmt.Sprintf("Backing off for %s as the server asked for", BackOffDuration))
+}
+
+// Retry sends the update of an operation stored in the outbox again, unless the account is still backing off. The
+// operation is either a single host name of an account or, if stored by an earlier version, all of its host names.
+func (u *Updater) Retry(op *outbox.Operation) error {
+	if !u.shouldProcessUpdates() {
+		return errors.New("dyndns2 updater is not initialized")
+	}
+
+	for _, account := range u.Accounts {
+		hostnames := account.Hostnames
+
+		if op.Target != account.Name {
+			hostname := strings.TrimPrefix(op.Target, account.Name+"/")
+			if hostname == op.Target || !hasHostname(account, hostname) {
+				continue
+			}
+			hostnames = []string{hostname}
+		}
+
+		// a newer address received since the failure takes precedence
+		failed := u.updateAccount(account, hostnames, u.latest.Current(op.Update()))
+
+		for _, hostname := range hostnames {
+			if err, ok := failed[hostname]; ok {
+				return fmt.Errorf("%s: %w", hostname, err)
+			}
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("no dyndns2 account or host name configured for %s", op.Target)
+}
+
+func hasHostname(account *Account, hostname string) bool {
+	for _, configured := range account.Hostnames {
+		if configured == hostname {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,310 @@
+package dyndns2
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// standIn is a dyndns2 server answering every call with the same body, recording the calls it received.
+type standIn struct {
+	server *httptest.Server
+
+	mu    sync.Mutex
+	body  string
+	calls int
+	last  call
+}
+
+// call is the last update received by the stand-in
+type call struct {
+	hostnames string
+	myip      string
+	username  string
+	password  string
+	userAgent string
+}
+
+func newStandIn(t *testing.T, body string) *standIn {
+	s := &standIn{body: body}
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if r.URL.Path != updatePath {
+			t.Errorf("update sent to %s, want %s", r.URL.Path, updatePath)
+		}
+
+		s.calls++
+		s.last = call{hostnames: r.URL.Query().Get("hostname"), myip: r.URL.Query().Get("myip"), userAgent: r.UserAgent()}
+		s.last.username, s.last.password, _ = r.BasicAuth()
+
+		_, _ = fmt.Fprint(w, s.body)
+	}))
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+func (s *standIn) answer(body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.body = body
+}
+
+// received returns the number of calls and the last one.
+func (s *standIn) received() (int, call) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls, s.last
+}
+
+func testUpdater(t *testing.T, s *standIn, statePath string, hostnames ...string) (*Updater, *Account) {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	store, err := state.NewStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account := &Account{
+		Name:      "test",
+		Server:    s.server.URL,
+		Username:  "user",
+		Password:  secrets.New("p4ssw0rd"),
+		Hostnames: hostnames,
+		Timeout:   5 * time.Second,
+		Onipv4:    true,
+	}
+
+	u := NewUpdater()
+	u.log = log.NewEntry(logger)
+	u.State = store
+	u.Accounts = []*Account{account}
+	u.isInit = true
+
+	return u, account
+}
+
+func update(ip string) *events.IPUpdate {
+	return &events.IPUpdate{IP: net.ParseIP(ip)}
+}
+
+func TestUpdateAccount(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		failed    []string
+		suspended []string
+	}{
+		{"good", "good 192.0.2.1\ngood 192.0.2.1\n", nil, nil},
+		{"nochg", "nochg 192.0.2.1\r\ngood 192.0.2.1\r\n", nil, nil},
+		{"single line applies to all hosts", "badauth", nil, []string{"home.example.org", "vpn.example.org"}},
+		{"line per host", "good 192.0.2.1\nnohost\n", nil, []string{"vpn.example.org"}},
+		{"unknown response", "good 192.0.2.1\nwhatever\n", []string{"vpn.example.org"}, nil},
+		{"911", "911", []string{"home.example.org", "vpn.example.org"}, nil},
+		// lines that cannot be mapped to the host names are not applied to any of them
+		{"single host line", "nohost", []string{"home.example.org", "vpn.example.org"}, nil},
+		{"too many lines", "good 192.0.2.1\ngood 192.0.2.1\nnohost\n", []string{"home.example.org", "vpn.example.org"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStandIn(t, test.body)
+			u, account := testUpdater(t, s, "", "home.example.org", "vpn.example.org")
+
+			errs := u.updateAccount(account, account.Hostnames, update("192.0.2.1"))
+
+			var failed []string
+			for _, hostname := range account.Hostnames {
+				if _, ok := errs[hostname]; ok {
+					failed = append(failed, hostname)
+				}
+			}
+
+			if strings.Join(failed, ",") != strings.Join(test.failed, ",") {
+				t.Errorf("failed %v (%v), want %v", failed, errs, test.failed)
+			}
+
+			if _, last := s.received(); last != (call{"home.example.org,vpn.example.org", "192.0.2.1", "user", "p4ssw0rd", userAgent}) {
+				t.Errorf("sent %+v", last)
+			}
+
+			var suspended []string
+			for _, hostname := range account.Hostnames {
+				if _, ok := u.State.Suspension(suspensionKey(account, hostname)); ok {
+					suspended = append(suspended, hostname)
+				}
+			}
+
+			if strings.Join(suspended, ",") != strings.Join(test.suspended, ",") {
+				t.Errorf("suspended %v, want %v", suspended, test.suspended)
+			}
+		})
+	}
+}
+
+func TestBackOff(t *testing.T) {
+	s := newStandIn(t, "911")
+	u, account := testUpdater(t, s, "", "home.example.org")
+
+	if err := u.updateAccount(account, account.Hostnames, update("192.0.2.1"))["home.example.org"]; err == nil || !strings.HasPrefix(err.Error(), "911") {
+		t.Fatalf("error %v, want 911", err)
+	}
+
+	s.answer("good 192.0.2.2")
+
+	// no calls while backing off, even if the server recovered
+	if err := u.updateAccount(account, account.Hostnames, update("192.0.2.2"))["home.example.org"]; err == nil || !strings.Contains(err.Error(), "back off") {
+		t.Errorf("error %v, want the back-off reported", err)
+	}
+
+	if calls, _ := s.received(); calls != 1 {
+		t.Errorf("%d calls, want none while backing off", calls)
+	}
+
+	u.mu.Lock()
+	u.backOff[account.Name] = time.Now().Add(-time.Second)
+	u.mu.Unlock()
+
+	errs := u.updateAccount(account, account.Hostnames, update("192.0.2.2"))
+	if calls, _ := s.received(); len(errs) > 0 || calls != 2 {
+		t.Errorf("errors %v after %d calls, want the update sent once the back-off ended", errs, calls)
+	}
+}
+
+func TestResumeAfterConfigChange(t *testing.T) {
+	s := newStandIn(t, "badauth")
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	u, account := testUpdater(t, s, statePath, "home.example.org")
+
+	if errs := u.updateAccount(account, account.Hostnames, update("192.0.2.1")); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	s.answer("good 192.0.2.2")
+
+	// suspended hosts are not sent again, also after a restart with the same config
+	store, err := state.NewStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.State = store
+
+	errs := u.updateAccount(account, account.Hostnames, update("192.0.2.2"))
+	if calls, _ := s.received(); len(errs) > 0 || calls != 1 {
+		t.Errorf("errors %v after %d calls, want the suspended host skipped", errs, calls)
+	}
+
+	account.Password = secrets.New("n3w-p4ssw0rd")
+
+	errs = u.updateAccount(account, account.Hostnames, update("192.0.2.2"))
+	if calls, last := s.received(); len(errs) > 0 || calls != 2 || last.password != "n3w-p4ssw0rd" {
+		t.Errorf("errors %v after %d calls, want the host resumed with the new password", errs, calls)
+	}
+
+	if _, ok := u.State.Suspension(suspensionKey(account, "home.example.org")); ok {
+		t.Error("suspension kept after the config changed")
+	}
+}
+
+func TestFingerprintIsSalted(t *testing.T) {
+	account := &Account{Server: "https://members.example.org", Username: "user", Password: secrets.New("p4ssw0rd")}
+
+	first, _ := state.NewStore("")
+	second, _ := state.NewStore("")
+
+	fingerprint := account.fingerprint(first, "home.example.org")
+
+	if fingerprint != account.fingerprint(first, "home.example.org") {
+		t.Error("fingerprint changed without a config change")
+	}
+
+	if fingerprint == account.fingerprint(second, "home.example.org") {
+		t.Error("fingerprint does not depend on the salt of the store")
+	}
+
+	if strings.Contains(fingerprint, "p4ssw0rd") || fingerprint == account.fingerprint(first, "vpn.example.org") {
+		t.Errorf("fingerprint %s does not identify the host without revealing the password", fingerprint)
+	}
+}
+
+func TestOnlyFailedHostnamesAreRetried(t *testing.T) {
+	s := newStandIn(t, "good 192.0.2.1\nwhatever\n")
+	u, account := testUpdater(t, s, "", "home.example.org", "vpn.example.org")
+	u.Outbox = outbox.NewOutbox(filepath.Join(t.TempDir(), "outbox.json"))
+
+	// stored for the whole account by an earlier version
+	u.Outbox.Enqueue(ProviderName, account.Name, update("192.0.2.0"), nil)
+
+	u.StartWorker()
+	u.In <- update("192.0.2.1")
+
+	var ops []*outbox.Operation
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if ops, _ = u.Outbox.List(); len(ops) == 1 && ops[0].Target != account.Name {
+			break
+		}
+	}
+
+	if len(ops) != 1 || ops[0].Target != "test/vpn.example.org" {
+		t.Fatalf("outbox holds %+v, want the failed host name only", ops)
+	}
+
+	s.answer("good 192.0.2.1")
+
+	if err := u.Retry(ops[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls, last := s.received(); calls != 2 || last.hostnames != "vpn.example.org" {
+		t.Errorf("retry sent %s, want vpn.example.org", last.hostnames)
+	}
+}
+
+func TestRetryTargets(t *testing.T) {
+	s := newStandIn(t, "nochg 192.0.2.1\nnochg 192.0.2.1")
+	u, _ := testUpdater(t, s, "", "home.example.org", "vpn.example.org")
+
+	tests := []struct {
+		target    string
+		hostnames string
+		err       string
+	}{
+		{"test", "home.example.org,vpn.example.org", ""},
+		{"test/home.example.org", "home.example.org", "home.example.org: response has 2 lines for 1 host names"},
+		{"test/old.example.org", "", "no dyndns2 account or host name configured"},
+		{"other/home.example.org", "", "no dyndns2 account or host name configured"},
+	}
+
+	for _, test := range tests {
+		before, _ := s.received()
+
+		err := u.Retry(&outbox.Operation{Target: test.target, Family: "ipv4", Address: "192.0.2.1"})
+		if (err == nil) != (test.err == "") || (err != nil && !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("retry of %s failed with %v, want %q", test.target, err, test.err)
+		}
+
+		calls, last := s.received()
+		if (test.hostnames == "" && calls != before) || (test.hostnames != "" && last.hostnames != test.hostnames) {
+			t.Errorf("retry of %s sent %s after %d calls, want %q", test.target, last.hostnames, calls, test.hostnames)
+		}
+	}
+}
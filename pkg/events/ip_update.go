@@ -0,0 +1,36 @@
+package events
+
+import (
+	"net"
+)
+
+// Sources of an IPUpdate
+const (
+	SourcePoll = "poll"
+	SourcePush = "push"
+)
+
+// IPUpdate describes a detected WAN address on its way from the poll / push servers to the updaters.
+type IPUpdate struct {
+	IP net.IP
+	// Previous is the last address seen for the same family, nil if there was none
+	Previous net.IP
+	// Prefix the IPv6 address was constructed from, nil if it was reported directly
+	Prefix *net.IPNet
+	// Source is either SourcePoll or SourcePush
+	Source string
+}
+
+// Family returns "ipv4" or "ipv6" depending on the address.
+func Family(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+
+	return "ipv6"
+}
+
+// Family returns the family of the updated address.
+func (u *IPUpdate) Family() string {
+	return Family(u.IP)
+}
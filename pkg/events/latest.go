@@ -0,0 +1,39 @@
+package events
+
+import (
+	"sync"
+)
+
+// Latest keeps the newest update of each family an updater received. Retries of failed updates run after newer ones
+// may have arrived, so they send the newest address instead of pushing the old one over it. The zero value is ready
+// to use.
+type Latest struct {
+	mu      sync.Mutex
+	updates map[string]*IPUpdate
+}
+
+// Remember stores the update as the newest one of its family.
+func (l *Latest) Remember(update *IPUpdate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.updates == nil {
+		l.updates = make(map[string]*IPUpdate)
+	}
+
+	l.updates[update.Family()] = update
+}
+
+// Current returns the update with the newest address of its family, keeping the previous address and source of the
+// update. It is the update itself if no newer address is known.
+func (l *Latest) Current(update *IPUpdate) *IPUpdate {
+	l.mu.Lock()
+	known := l.updates[update.Family()]
+	l.mu.Unlock()
+
+	if known == nil || known.IP.Equal(update.IP) {
+		return update
+	}
+
+	return &IPUpdate{IP: known.IP, Previous: update.Previous, Prefix: known.Prefix, Source: update.Source}
+}
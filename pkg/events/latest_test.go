@@ -0,0 +1,34 @@
+package events
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLatest(t *testing.T) {
+	var latest Latest
+
+	old := &IPUpdate{IP: net.ParseIP("192.0.2.1"), Previous: net.ParseIP("192.0.2.0"), Source: SourcePoll}
+
+	if got := latest.Current(old); got != old {
+		t.Errorf("current of %s is %s without a known address", old.IP, got.IP)
+	}
+
+	_, prefix, _ := net.ParseCIDR("2001:db8::/64")
+	latest.Remember(&IPUpdate{IP: net.ParseIP("192.0.2.2"), Source: SourcePush})
+	latest.Remember(&IPUpdate{IP: net.ParseIP("2001:db8::2"), Prefix: prefix, Source: SourcePush})
+
+	got := latest.Current(old)
+	if !got.IP.Equal(net.ParseIP("192.0.2.2")) || !got.Previous.Equal(old.Previous) || got.Source != SourcePoll || got.Prefix != nil {
+		t.Errorf("current of %s is %+v, want the newer address with the previous address and source of the update", old.IP, got)
+	}
+
+	got = latest.Current(&IPUpdate{IP: net.ParseIP("2001:db8::1")})
+	if !got.IP.Equal(net.ParseIP("2001:db8::2")) || got.Prefix != prefix {
+		t.Errorf("current of 2001:db8::1 is %+v, want the newer address with its prefix", got)
+	}
+
+	if same := (&IPUpdate{IP: net.ParseIP("192.0.2.2")}); latest.Current(same) != same {
+		t.Errorf("current of the newest address is not the update itself")
+	}
+}
@@ -0,0 +1,41 @@
+package fake_cloudflare
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Seed describes the zones and records a server starts with
+type Seed struct {
+	Zones []struct {
+		Name    string   `json:"name"`
+		Records []Record `json:"records"`
+	} `json:"zones"`
+}
+
+// LoadSeed adds the zones and records of a JSON seed file to the server.
+func (s *Server) LoadSeed(path string) error {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	var seed Seed
+
+	if err := json.Unmarshal(data, &seed); err != nil {
+		return err
+	}
+
+	for _, seedZone := range seed.Zones {
+		zone := s.AddZone(seedZone.Name)
+
+		for _, record := range seedZone.Records {
+			if _, err := s.AddRecord(zone.ID, record); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,502 @@
+package fake_cloudflare
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pagination defaults and limits of the real API
+const (
+	zonesPerPage      = 20
+	maxZonesPerPage   = 50
+	recordsPerPage    = 100
+	maxRecordsPerPage = 5000
+)
+
+// Zone is a zone as listed by GET /zones
+type Zone struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// Record is a DNS record as returned by the dns_records endpoints
+type Record struct {
+	ID         string      `json:"id"`
+	ZoneID     string      `json:"zone_id"`
+	ZoneName   string      `json:"zone_name"`
+	Type       string      `json:"type"`
+	Name       string      `json:"name"`
+	Content    string      `json:"content"`
+	Data       interface{} `json:"data,omitempty"`
+	TTL        int         `json:"ttl"`
+	Proxied    *bool       `json:"proxied,omitempty"`
+	Proxiable  bool        `json:"proxiable"`
+	Comment    string      `json:"comment,omitempty"`
+	Tags       []string    `json:"tags,omitempty"`
+	CreatedOn  time.Time   `json:"created_on"`
+	ModifiedOn time.Time   `json:"modified_on"`
+}
+
+// recordChange is the body of create and update calls, nil fields are left as they are on PATCH
+type recordChange struct {
+	Type    *string     `json:"type"`
+	Name    *string     `json:"name"`
+	Content *string     `json:"content"`
+	Data    interface{} `json:"data"`
+	TTL     *int        `json:"ttl"`
+	Proxied *bool       `json:"proxied"`
+	Comment *string     `json:"comment"`
+	Tags    *[]string   `json:"tags"`
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type resultInfo struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	TotalPages int `json:"total_pages"`
+	Count      int `json:"count"`
+	Total      int `json:"total_count"`
+}
+
+type envelope struct {
+	Result     interface{} `json:"result"`
+	ResultInfo *resultInfo `json:"result_info,omitempty"`
+	Success    bool        `json:"success"`
+	Errors     []apiError  `json:"errors"`
+	Messages   []string    `json:"messages"`
+}
+
+// Server is an in-memory stand-in for the zones and dns_records endpoints of the Cloudflare v4 API, meant for
+// checking a configuration offline. It serves both with and without the /client/v4 path prefix.
+type Server struct {
+	log *log.Entry
+
+	// Token is the API token every request has to carry, any credentials are accepted if empty
+	Token string
+
+	mu      sync.Mutex
+	zones   []*Zone
+	records map[string][]*Record
+}
+
+func NewServer() *Server {
+	return &Server{
+		log:     log.WithField("module", "fake_cloudflare"),
+		records: make(map[string][]*Record),
+	}
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// AddZone adds a zone by name and returns it.
+func (s *Server) AddZone(name string) *Zone {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zone := &Zone{ID: newId(), Name: strings.ToLower(strings.TrimSuffix(name, ".")), Status: "active"}
+	s.zones = append(s.zones, zone)
+
+	return zone
+}
+
+// AddRecord adds a record to the zone, filling in its ID and timestamps.
+func (s *Server) AddRecord(zoneId string, record Record) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zone := s.zone(zoneId)
+
+	if zone == nil {
+		return nil, fmt.Errorf("zone %s not found", zoneId)
+	}
+
+	if err := normalizeRecord(&record); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	record.ID = newId()
+	record.ZoneID = zone.ID
+	record.ZoneName = zone.Name
+	record.CreatedOn = now
+	record.ModifiedOn = now
+
+	s.records[zone.ID] = append(s.records[zone.ID], &record)
+
+	return &record, nil
+}
+
+// Zones returns a copy of all zones.
+func (s *Server) Zones() []Zone {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zones := make([]Zone, 0, len(s.zones))
+	for _, zone := range s.zones {
+		zones = append(zones, *zone)
+	}
+
+	return zones
+}
+
+// Records returns a copy of all records of the zone.
+func (s *Server) Records(zoneId string) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]Record, 0, len(s.records[zoneId]))
+	for _, record := range s.records[zoneId] {
+		records = append(records, *record)
+	}
+
+	return records
+}
+
+func (s *Server) zone(id string) *Zone {
+	for _, zone := range s.zones {
+		if zone.ID == id {
+			return zone
+		}
+	}
+
+	return nil
+}
+
+// normalizeRecord validates the record like the real API does and brings its content into canonical form.
+func normalizeRecord(record *Record) error {
+	record.Type = strings.ToUpper(record.Type)
+	record.Name = strings.ToLower(strings.TrimSuffix(record.Name, "."))
+
+	if record.Name == "" {
+		return fmt.Errorf("DNS record name is required")
+	}
+
+	switch record.Type {
+	case "A", "AAAA":
+		ip := net.ParseIP(record.Content)
+
+		if ip == nil || (record.Type == "A") != (ip.To4() != nil) {
+			return fmt.Errorf("Content for %s record is invalid.", record.Type)
+		}
+
+		record.Content = ip.String()
+		record.Proxiable = true
+	case "HTTPS", "SVCB":
+		data, ok := record.Data.(map[string]interface{})
+
+		if !ok {
+			return fmt.Errorf("Data for %s record is required.", record.Type)
+		}
+
+		record.Content = fmt.Sprintf("%v %v %v", data["priority"], data["target"], data["value"])
+	case "SRV":
+		data, ok := record.Data.(map[string]interface{})
+
+		if !ok {
+			return fmt.Errorf("Data for %s record is required.", record.Type)
+		}
+
+		record.Content = fmt.Sprintf("%v %v %v", data["weight"], data["port"], data["target"])
+	case "":
+		return fmt.Errorf("DNS record type is required")
+	}
+
+	if record.TTL == 0 {
+		record.TTL = 1
+	}
+
+	if record.TTL != 1 && (record.TTL < 60 || record.TTL > 86400) {
+		return fmt.Errorf("TTL must be between 60 and 86400 seconds, or 1 for Automatic.")
+	}
+
+	if record.Proxied == nil {
+		proxied := false
+		record.Proxied = &proxied
+	}
+
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/client/v4")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	rlog := s.log.WithField("method", r.Method).WithField("path", path)
+
+	if !s.authorized(r) {
+		rlog.Warn("Rejected request with invalid credentials")
+		s.writeError(w, http.StatusForbidden, 10000, "Authentication error")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case len(parts) == 1 && parts[0] == "zones" && r.Method == http.MethodGet:
+		s.listZones(w, r)
+	case len(parts) == 3 && parts[0] == "zones" && parts[2] == "dns_records":
+		zone := s.zone(parts[1])
+
+		if zone == nil {
+			s.writeError(w, http.StatusNotFound, 7003, fmt.Sprintf("Could not route to %s, perhaps your object identifier is invalid?", path))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			s.listRecords(w, r, zone)
+		case http.MethodPost:
+			s.createRecord(w, r, zone, rlog)
+		default:
+			s.writeError(w, http.StatusMethodNotAllowed, 10405, "Method not allowed")
+		}
+	case len(parts) == 4 && parts[0] == "zones" && parts[2] == "dns_records":
+		zone := s.zone(parts[1])
+
+		if zone == nil {
+			s.writeError(w, http.StatusNotFound, 7003, fmt.Sprintf("Could not route to %s, perhaps your object identifier is invalid?", path))
+			return
+		}
+
+		index := -1
+		for i, record := range s.records[zone.ID] {
+			if record.ID == parts[3] {
+				index = i
+			}
+		}
+
+		if index < 0 {
+			s.writeError(w, http.StatusNotFound, 81044, "Record does not exist.")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			s.writeResult(w, s.records[zone.ID][index], nil)
+		case http.MethodPatch, http.MethodPut:
+			s.updateRecord(w, r, zone, index, rlog)
+		case http.MethodDelete:
+			record := s.records[zone.ID][index]
+			s.records[zone.ID] = append(s.records[zone.ID][:index], s.records[zone.ID][index+1:]...)
+			rlog.WithField("record", record.Name).WithField("content", record.Content).Info("Deleted record")
+			s.writeResult(w, map[string]string{"id": record.ID}, nil)
+		default:
+			s.writeError(w, http.StatusMethodNotAllowed, 10405, "Method not allowed")
+		}
+	default:
+		s.writeError(w, http.StatusNotFound, 7000, "No route for that URI")
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+
+	return r.Header.Get("Authorization") == "Bearer "+s.Token
+}
+
+func (s *Server) listZones(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(r.URL.Query().Get("name"))
+
+	var zones []interface{}
+
+	for _, zone := range s.zones {
+		if name == "" || zone.Name == name {
+			zones = append(zones, zone)
+		}
+	}
+
+	s.writePage(w, r, zones, zonesPerPage, maxZonesPerPage)
+}
+
+func (s *Server) listRecords(w http.ResponseWriter, r *http.Request, zone *Zone) {
+	query := r.URL.Query()
+	recordType := strings.ToUpper(query.Get("type"))
+	name := strings.ToLower(strings.TrimSuffix(query.Get("name"), "."))
+	content := query.Get("content")
+
+	if ip := net.ParseIP(content); ip != nil {
+		content = ip.String()
+	}
+
+	var records []interface{}
+
+	for _, record := range s.records[zone.ID] {
+		if recordType != "" && record.Type != recordType {
+			continue
+		}
+		if name != "" && record.Name != name {
+			continue
+		}
+		if content != "" && record.Content != content {
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	s.writePage(w, r, records, recordsPerPage, maxRecordsPerPage)
+}
+
+func (s *Server) createRecord(w http.ResponseWriter, r *http.Request, zone *Zone, rlog *log.Entry) {
+	var change recordChange
+
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		s.writeError(w, http.StatusBadRequest, 9207, "Request body is invalid.")
+		return
+	}
+
+	record := &Record{}
+	change.apply(record)
+
+	if err := normalizeRecord(record); err != nil {
+		s.writeError(w, http.StatusBadRequest, 9005, err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	record.ID = newId()
+	record.ZoneID = zone.ID
+	record.ZoneName = zone.Name
+	record.CreatedOn = now
+	record.ModifiedOn = now
+
+	s.records[zone.ID] = append(s.records[zone.ID], record)
+
+	rlog.WithField("record", record.Name).WithField("content", record.Content).Info("Created record")
+	s.writeResult(w, record, nil)
+}
+
+func (s *Server) updateRecord(w http.ResponseWriter, r *http.Request, zone *Zone, index int, rlog *log.Entry) {
+	var change recordChange
+
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		s.writeError(w, http.StatusBadRequest, 9207, "Request body is invalid.")
+		return
+	}
+
+	existing := s.records[zone.ID][index]
+	record := &Record{}
+
+	if r.Method == http.MethodPatch {
+		*record = *existing
+	} else {
+		// PUT replaces the record, keeping only its identity
+		record.ID, record.ZoneID, record.ZoneName, record.CreatedOn = existing.ID, existing.ZoneID, existing.ZoneName, existing.CreatedOn
+	}
+
+	change.apply(record)
+
+	if err := normalizeRecord(record); err != nil {
+		s.writeError(w, http.StatusBadRequest, 9005, err.Error())
+		return
+	}
+
+	record.ModifiedOn = time.Now().UTC()
+	s.records[zone.ID][index] = record
+
+	rlog.WithField("record", record.Name).WithField("content", record.Content).Info("Updated record")
+	s.writeResult(w, record, nil)
+}
+
+func (c recordChange) apply(record *Record) {
+	if c.Type != nil {
+		record.Type = *c.Type
+	}
+	if c.Name != nil {
+		record.Name = *c.Name
+	}
+	if c.Content != nil {
+		record.Content = *c.Content
+	}
+	if c.Data != nil {
+		record.Data = c.Data
+	}
+	if c.TTL != nil {
+		record.TTL = *c.TTL
+	}
+	if c.Proxied != nil {
+		record.Proxied = c.Proxied
+	}
+	if c.Comment != nil {
+		record.Comment = *c.Comment
+	}
+	if c.Tags != nil {
+		record.Tags = *c.Tags
+	}
+}
+
+// writePage writes the page selected by the page / per_page parameters, along with its result_info.
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, items []interface{}, defaultPerPage int, maxPerPage int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	start := (page - 1) * perPage
+	if start > len(items) {
+		start = len(items)
+	}
+
+	end := start + perPage
+	if end > len(items) {
+		end = len(items)
+	}
+
+	result := append([]interface{}{}, items[start:end]...)
+
+	s.writeResult(w, result, &resultInfo{
+		Page:       page,
+		PerPage:    perPage,
+		TotalPages: (len(items) + perPage - 1) / perPage,
+		Count:      len(result),
+		Total:      len(items),
+	})
+}
+
+func (s *Server) writeResult(w http.ResponseWriter, result interface{}, info *resultInfo) {
+	s.write(w, http.StatusOK, envelope{Result: result, ResultInfo: info, Success: true, Errors: []apiError{}, Messages: []string{}})
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, code int, message string) {
+	s.write(w, status, envelope{Success: false, Errors: []apiError{{code, message}}, Messages: []string{}})
+}
+
+func (s *Server) write(w http.ResponseWriter, status int, body envelope) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		s.log.WithError(err).Error("Failed to write response")
+	}
+}
@@ -0,0 +1,206 @@
+package fake_cloudflare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type testResponse struct {
+	Result     json.RawMessage `json:"result"`
+	ResultInfo *resultInfo     `json:"result_info"`
+	Success    bool            `json:"success"`
+	Errors     []apiError      `json:"errors"`
+}
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	s := NewServer()
+	s.Token = "test-token"
+
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	s.log = log.NewEntry(logger)
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	return s, server
+}
+
+func call(t *testing.T, server *httptest.Server, method string, path string, body interface{}) (int, testResponse) {
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, server.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer test-token")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var response testResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("%s %s: invalid envelope: %v", method, path, err)
+	}
+
+	return res.StatusCode, response
+}
+
+func TestZonePagination(t *testing.T) {
+	s, server := newTestServer(t)
+
+	for i := 0; i < 25; i++ {
+		s.AddZone(fmt.Sprintf("zone%02d.example", i))
+	}
+
+	tests := []struct {
+		path  string
+		count int
+		pages int
+	}{
+		{"/zones", 20, 2},
+		{"/zones?page=2", 5, 2},
+		{"/zones?page=3", 0, 2},
+		{"/client/v4/zones?per_page=10&page=3", 5, 3},
+		{"/zones?per_page=500", 25, 1},
+		{"/zones?name=ZONE07.example", 1, 1},
+	}
+
+	for _, test := range tests {
+		status, response := call(t, server, http.MethodGet, test.path, nil)
+
+		if status != http.StatusOK || !response.Success {
+			t.Fatalf("%s answered %d, %v", test.path, status, response.Errors)
+		}
+
+		var zones []Zone
+		if err := json.Unmarshal(response.Result, &zones); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(zones) != test.count || response.ResultInfo.Count != test.count || response.ResultInfo.TotalPages != test.pages {
+			t.Errorf("%s returned %d zones on %d pages, want %d on %d", test.path, len(zones), response.ResultInfo.TotalPages, test.count, test.pages)
+		}
+	}
+}
+
+func TestRecordLifecycle(t *testing.T) {
+	s, server := newTestServer(t)
+	zone := s.AddZone("example.com")
+	path := "/zones/" + zone.ID + "/dns_records"
+
+	status, response := call(t, server, http.MethodPost, path, map[string]interface{}{
+		"type": "AAAA", "name": "Home.Example.com.", "content": "2001:0db8::0001", "ttl": 120, "tags": []string{"a"},
+	})
+	if status != http.StatusOK || !response.Success {
+		t.Fatalf("create answered %d, %v", status, response.Errors)
+	}
+
+	var created Record
+	_ = json.Unmarshal(response.Result, &created)
+
+	if created.Name != "home.example.com" || created.Content != "2001:db8::1" || created.Proxied == nil || *created.Proxied {
+		t.Errorf("created %+v, want name and content in canonical form and proxied off", created)
+	}
+
+	// PATCH keeps the fields it does not name
+	_, response = call(t, server, http.MethodPatch, path+"/"+created.ID, map[string]interface{}{"content": "2001:db8::2"})
+	var patched Record
+	_ = json.Unmarshal(response.Result, &patched)
+
+	if patched.Content != "2001:db8::2" || patched.TTL != 120 || len(patched.Tags) != 1 {
+		t.Errorf("patched %+v, want only the content changed", patched)
+	}
+
+	// PUT replaces the record
+	_, response = call(t, server, http.MethodPut, path+"/"+created.ID, map[string]interface{}{"type": "AAAA", "name": "home.example.com", "content": "2001:db8::3"})
+	var replaced Record
+	_ = json.Unmarshal(response.Result, &replaced)
+
+	if replaced.ID != created.ID || replaced.TTL != 1 || len(replaced.Tags) != 0 {
+		t.Errorf("replaced %+v, want the defaults for the fields not sent", replaced)
+	}
+
+	_, response = call(t, server, http.MethodGet, path+"?content=2001:0db8:0:0::3&type=aaaa", nil)
+	var found []Record
+	_ = json.Unmarshal(response.Result, &found)
+
+	if len(found) != 1 || found[0].ID != created.ID {
+		t.Errorf("filter by content found %v", found)
+	}
+
+	if status, _ := call(t, server, http.MethodDelete, path+"/"+created.ID, nil); status != http.StatusOK {
+		t.Errorf("delete answered %d", status)
+	}
+
+	if records := s.Records(zone.ID); len(records) != 0 {
+		t.Errorf("%d records left after the delete", len(records))
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	s, server := newTestServer(t)
+	zone := s.AddZone("example.com")
+	path := "/zones/" + zone.ID + "/dns_records"
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		status int
+		code   int
+	}{
+		{"unknown zone", http.MethodGet, "/zones/0123/dns_records", nil, http.StatusNotFound, 7003},
+		{"unknown record", http.MethodPatch, path + "/0123", map[string]string{"content": "192.0.2.1"}, http.StatusNotFound, 81044},
+		{"unknown route", http.MethodGet, "/accounts", nil, http.StatusNotFound, 7000},
+		{"content of other family", http.MethodPost, path, map[string]string{"type": "A", "name": "home.example.com", "content": "2001:db8::1"}, http.StatusBadRequest, 9005},
+		{"ttl out of range", http.MethodPost, path, map[string]interface{}{"type": "A", "name": "home.example.com", "content": "192.0.2.1", "ttl": 30}, http.StatusBadRequest, 9005},
+		{"invalid body", http.MethodPost, path, "not an object", http.StatusBadRequest, 9207},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, response := call(t, server, test.method, test.path, test.body)
+
+			if status != test.status || response.Success || len(response.Errors) != 1 || response.Errors[0].Code != test.code {
+				t.Errorf("answered %d %+v, want %d with code %d", status, response, test.status, test.code)
+			}
+		})
+	}
+
+	if records := s.Records(zone.ID); len(records) != 0 {
+		t.Errorf("rejected calls created %d records", len(records))
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/zones", nil)
+	req.Header.Set("Authorization", "Bearer wrong-token")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("wrong token answered %d, want 403", res.StatusCode)
+	}
+}
@@ -0,0 +1,284 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	log "github.com/sirupsen/logrus"
+)
+
+// Entry kinds
+const (
+	KindAddress = "address"
+	KindUpdate  = "update"
+)
+
+// Update statuses
+const (
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+	StatusDryRun  = "dry-run"
+)
+
+// Entry is a single line of the journal, either a detected address or the outcome of a provider update.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Family   string    `json:"family"`
+	Address  string    `json:"address"`
+	Provider string    `json:"provider,omitempty"`
+	Record   string    `json:"record,omitempty"`
+	Status   string    `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// lowWaterPercent of MaxSize the journal is trimmed down to once it grew larger than MaxSize
+const lowWaterPercent = 80
+
+// Journal is an append-only JSON lines file with size and age based retention.
+// All methods are safe to call on a nil journal, which makes history optional for the updaters.
+type Journal struct {
+	log *log.Entry
+
+	mu   sync.Mutex
+	path string
+
+	lastCompaction time.Time
+
+	// MaxSize in bytes the journal may grow to before the oldest entries are dropped
+	MaxSize int64
+	// MaxAge of entries kept in the journal
+	MaxAge time.Duration
+}
+
+func NewJournal(path string) *Journal {
+	return &Journal{
+		log:     log.WithField("module", "history"),
+		path:    path,
+		MaxSize: 5 * 1024 * 1024,
+		MaxAge:  90 * 24 * time.Hour,
+	}
+}
+
+// RecordAddress journals a newly detected address.
+func (j *Journal) RecordAddress(ip net.IP) {
+	if j == nil {
+		return
+	}
+
+	j.append(Entry{
+		Time:    time.Now(),
+		Kind:    KindAddress,
+		Family:  events.Family(ip),
+		Address: ip.String(),
+	})
+}
+
+// RecordUpdate journals the outcome of a single provider update.
+func (j *Journal) RecordUpdate(provider string, record string, ip net.IP, dryRun bool, err error) {
+	if j == nil {
+		return
+	}
+
+	entry := Entry{
+		Time:     time.Now(),
+		Kind:     KindUpdate,
+		Family:   events.Family(ip),
+		Address:  ip.String(),
+		Provider: provider,
+		Record:   record,
+		Status:   StatusSuccess,
+	}
+
+	if dryRun {
+		entry.Status = StatusDryRun
+	}
+
+	if err != nil {
+		entry.Status = StatusFailed
+		entry.Error = err.Error()
+	}
+
+	j.append(entry)
+}
+
+func (j *Journal) append(entry Entry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.appendLocked(entry); err != nil {
+		j.log.WithError(err).Error("Failed to append history entry")
+		return
+	}
+
+	if err := j.compactLocked(false); err != nil {
+		j.log.WithError(err).Error("Failed to apply history retention")
+	}
+}
+
+func (j *Journal) appendLocked(entry Entry) error {
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+
+	return err
+}
+
+// compactLocked drops entries older than MaxAge and lines that cannot be decoded. If the journal is still larger than
+// MaxSize, the oldest entries are dropped down to the low-water mark, so the next append does not trim it again.
+// Unless forced, age based retention runs at most once per hour.
+func (j *Journal) compactLocked(force bool) error {
+	stat, err := os.Stat(j.path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	oversized := j.MaxSize > 0 && stat.Size() > j.MaxSize
+	expired := j.MaxAge > 0 && time.Since(j.lastCompaction) > time.Hour
+
+	if !force && !oversized && !expired {
+		return nil
+	}
+
+	j.lastCompaction = time.Now()
+
+	entries, skipped, err := j.readLocked()
+
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-j.MaxAge)
+	lines := make([][]byte, 0, len(entries))
+	var size int64
+
+	for _, entry := range entries {
+		if j.MaxAge > 0 && entry.Time.Before(cutoff) {
+			continue
+		}
+
+		line, err := json.Marshal(entry)
+
+		if err != nil {
+			return err
+		}
+
+		lines = append(lines, append(line, '\n'))
+		size += int64(len(line) + 1)
+	}
+
+	if j.MaxSize > 0 && size > j.MaxSize {
+		lowWater := j.MaxSize * lowWaterPercent / 100
+
+		for size > lowWater && len(lines) > 0 {
+			size -= int64(len(lines[0]))
+			lines = lines[1:]
+		}
+	}
+
+	if len(lines) == len(entries) && skipped == 0 {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	for _, line := range lines {
+		if _, err := tmp.Write(line); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	j.log.WithField("dropped", len(entries)-len(lines)+skipped).Debug("Applied history retention")
+
+	return os.Rename(tmp.Name(), j.path)
+}
+
+// readLocked returns the entries of the journal and the number of lines skipped as they could not be decoded, i.e.
+// a line cut short by a crash while appending.
+func (j *Journal) readLocked() ([]Entry, int, error) {
+	f, err := os.Open(j.path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	defer f.Close()
+
+	var entries []Entry
+	skipped := 0
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry Entry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			j.log.WithError(err).WithField("line", line).Warn(fmt.Sprintf("Skipping undecodable entry of %s", j.path))
+			skipped++
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, skipped, scanner.Err()
+}
+
+// Compact applies the retention rules right away.
+func (j *Journal) Compact() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.compactLocked(true)
+}
@@ -0,0 +1,173 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func newTestJournal(t *testing.T) *Journal {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	j := NewJournal(filepath.Join(t.TempDir(), "history", "history.jsonl"))
+	j.log = log.NewEntry(logger)
+
+	return j
+}
+
+func all(t *testing.T, j *Journal) []Entry {
+	entries, err := j.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entries
+}
+
+func TestRecord(t *testing.T) {
+	j := newTestJournal(t)
+
+	j.RecordAddress(net.ParseIP("192.0.2.1"))
+	j.RecordUpdate("cloudflare", "home.example.com", net.ParseIP("192.0.2.1"), false, nil)
+	j.RecordUpdate("cloudflare", "home.example.com", net.ParseIP("2001:db8::1"), true, nil)
+	j.RecordUpdate("dyndns2", "vpn.example.org", net.ParseIP("192.0.2.1"), false, errors.New("911: server side error"))
+
+	want := []Entry{
+		{Kind: KindAddress, Family: "ipv4", Address: "192.0.2.1"},
+		{Kind: KindUpdate, Family: "ipv4", Address: "192.0.2.1", Provider: "cloudflare", Record: "home.example.com", Status: StatusSuccess},
+		{Kind: KindUpdate, Family: "ipv6", Address: "2001:db8::1", Provider: "cloudflare", Record: "home.example.com", Status: StatusDryRun},
+		{Kind: KindUpdate, Family: "ipv4", Address: "192.0.2.1", Provider: "dyndns2", Record: "vpn.example.org", Status: StatusFailed, Error: "911: server side error"},
+	}
+
+	entries := all(t, j)
+	if len(entries) != len(want) {
+		t.Fatalf("journaled %d entries, want %d", len(entries), len(want))
+	}
+
+	for i, entry := range entries {
+		if time.Since(entry.Time) > time.Minute {
+			t.Errorf("entry %d journaled at %s", i, entry.Time)
+		}
+
+		entry.Time = time.Time{}
+		if entry != want[i] {
+			t.Errorf("entry %d is %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+func TestRetentionBySize(t *testing.T) {
+	j := newTestJournal(t)
+	j.MaxSize = 2000
+
+	for i := 0; i < 100; i++ {
+		j.RecordUpdate("cloudflare", fmt.Sprintf("host-%d.example.com", i), net.ParseIP("192.0.2.1"), false, nil)
+
+		if stat, err := os.Stat(j.path); err != nil || stat.Size() > j.MaxSize {
+			t.Fatalf("journal grew to %d bytes after %d entries (%v), want at most %d", stat.Size(), i+1, err, j.MaxSize)
+		}
+	}
+
+	entries := all(t, j)
+	if last := entries[len(entries)-1]; last.Record != "host-99.example.com" {
+		t.Errorf("newest entry is %s, want the oldest ones dropped", last.Record)
+	}
+
+	// trimmed down to the low-water mark, not just below the limit
+	j.MaxSize = int64(len(entries)) * 100
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, _ := os.Stat(j.path)
+	if stat.Size() > j.MaxSize*lowWaterPercent/100 {
+		t.Errorf("journal trimmed to %d bytes, want at most %d", stat.Size(), j.MaxSize*lowWaterPercent/100)
+	}
+}
+
+func TestRetentionByAge(t *testing.T) {
+	j := newTestJournal(t)
+	j.MaxAge = time.Hour
+
+	old := Entry{Time: time.Now().Add(-2 * time.Hour), Kind: KindAddress, Family: "ipv4", Address: "192.0.2.1"}
+	if err := j.appendLocked(old); err != nil {
+		t.Fatal(err)
+	}
+	j.RecordAddress(net.ParseIP("192.0.2.2"))
+
+	// the first append applied the retention already
+	entries := all(t, j)
+	if len(entries) != 1 || entries[0].Address != "192.0.2.2" {
+		t.Errorf("kept %+v, want only the recent entry", entries)
+	}
+
+	// further appends within the hour leave old entries to the next compaction
+	if err := j.appendLocked(old); err != nil {
+		t.Fatal(err)
+	}
+	j.RecordAddress(net.ParseIP("192.0.2.3"))
+
+	if entries := all(t, j); len(entries) != 3 {
+		t.Errorf("kept %d entries, want age based retention to wait", len(entries))
+	}
+
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := all(t, j); len(entries) != 2 {
+		t.Errorf("kept %d entries after compaction, want 2", len(entries))
+	}
+}
+
+func TestUndecodableLines(t *testing.T) {
+	j := newTestJournal(t)
+	j.RecordAddress(net.ParseIP("192.0.2.1"))
+
+	// a line cut short by a crash while appending
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"time":"2024-01-01T00:00:00Z","kind":"addr` + "\n\n")
+	f.Close()
+
+	j.RecordAddress(net.ParseIP("192.0.2.2"))
+
+	if entries := all(t, j); len(entries) != 2 {
+		t.Errorf("read %d entries, want the undecodable line skipped", len(entries))
+	}
+
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(j.path)
+	if lines := strings.Count(string(data), "\n"); lines != 2 || strings.Contains(string(data), "2024-01-01") {
+		t.Errorf("journal holds %d lines after compaction:\n%s", lines, data)
+	}
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *Journal
+
+	j.RecordAddress(net.ParseIP("192.0.2.1"))
+	j.RecordUpdate("cloudflare", "home.example.com", net.ParseIP("192.0.2.1"), false, nil)
+
+	if err := j.Compact(); err != nil {
+		t.Error(err)
+	}
+
+	if entries, err := j.Query(Query{}); entries != nil || err != nil {
+		t.Errorf("query returned %v, %v", entries, err)
+	}
+}
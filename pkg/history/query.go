@@ -0,0 +1,186 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Query filters journal entries, zero values match everything.
+type Query struct {
+	From   time.Time
+	To     time.Time
+	Family string
+	Record string
+}
+
+// ParseQuery builds a query from the textual parameters shared by the CLI and the HTTP handler.
+func ParseQuery(from string, to string, family string, record string) (Query, error) {
+	q := Query{Record: record}
+	now := time.Now()
+
+	var err error
+
+	if q.From, err = ParseTime(from, now); err != nil {
+		return q, fmt.Errorf("invalid from: %w", err)
+	}
+
+	if q.To, err = ParseTime(to, now); err != nil {
+		return q, fmt.Errorf("invalid to: %w", err)
+	}
+
+	switch strings.ToLower(family) {
+	case "":
+	case "4", "ipv4", "a":
+		q.Family = "ipv4"
+	case "6", "ipv6", "aaaa":
+		q.Family = "ipv6"
+	default:
+		return q, fmt.Errorf("invalid family %q, expected ipv4 or ipv6", family)
+	}
+
+	return q, nil
+}
+
+// ParseTime accepts RFC 3339 timestamps, plain dates (2006-01-02) and durations relative to now (168h).
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+
+	return time.Time{}, fmt.Errorf("%q is neither a RFC 3339 time, a date nor a duration", value)
+}
+
+func (q Query) matches(entry Entry) bool {
+	if !q.From.IsZero() && entry.Time.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && entry.Time.After(q.To) {
+		return false
+	}
+
+	if q.Family != "" && entry.Family != q.Family {
+		return false
+	}
+
+	// Detected addresses are not bound to a record, keep them so the record history stays readable
+	if q.Record != "" && entry.Kind == KindUpdate && entry.Record != q.Record {
+		return false
+	}
+
+	return true
+}
+
+// Query returns all journal entries matching the query, oldest first.
+func (j *Journal) Query(q Query) ([]Entry, error) {
+	if j == nil {
+		return nil, nil
+	}
+
+	j.mu.Lock()
+	entries, _, err := j.readLocked()
+	j.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	matching := make([]Entry, 0, len(entries))
+
+	for _, entry := range entries {
+		if q.matches(entry) {
+			matching = append(matching, entry)
+		}
+	}
+
+	return matching, nil
+}
+
+// WriteTable renders entries as an aligned text table.
+func WriteTable(w io.Writer, entries []Entry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "TIME\tKIND\tFAMILY\tADDRESS\tPROVIDER\tRECORD\tSTATUS\tERROR")
+
+	for _, entry := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Time.Format("2006-01-02 15:04:05"),
+			entry.Kind,
+			entry.Family,
+			entry.Address,
+			orDash(entry.Provider),
+			orDash(entry.Record),
+			orDash(entry.Status),
+			entry.Error,
+		)
+	}
+
+	return tw.Flush()
+}
+
+// WriteJSON renders entries as an indented JSON array.
+func WriteJSON(w io.Writer, entries []Entry) error {
+	if entries == nil {
+		entries = []Entry{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(entries)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
+
+// Handler serves the journal read-only as JSON, accepting the "from", "to", "family" and "record" parameters.
+func (j *Journal) Handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+
+	q, err := ParseQuery(params.Get("from"), params.Get("to"), params.Get("family"), params.Get("record"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := j.Query(q)
+
+	if err != nil {
+		j.log.WithError(err).Error("Failed to query history")
+		http.Error(w, "Failed to query history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_ = WriteJSON(w, entries)
+}
@@ -0,0 +1,157 @@
+package history
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+		err   bool
+	}{
+		{"", time.Time{}, false},
+		{"2024-03-01T08:30:00Z", time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC), false},
+		{"2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local), false},
+		{"168h", now.Add(-168 * time.Hour), false},
+		{"last week", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseTime(test.value, now)
+		if (err != nil) != test.err || !got.Equal(test.want) {
+			t.Errorf("%q parsed to %s, %v, want %s", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		family string
+		want   string
+		err    bool
+	}{
+		{"", "", false},
+		{"4", "ipv4", false},
+		{"AAAA", "ipv6", false},
+		{"ipv5", "", true},
+	}
+
+	for _, test := range tests {
+		q, err := ParseQuery("", "", test.family, "home.example.com")
+		if (err != nil) != test.err || (err == nil && (q.Family != test.want || q.Record != "home.example.com")) {
+			t.Errorf("family %q parsed to %+v, %v, want %q", test.family, q, err, test.want)
+		}
+	}
+
+	if _, err := ParseQuery("yesterday", "", "", ""); err == nil || !strings.HasPrefix(err.Error(), "invalid from") {
+		t.Errorf("error %v, want the invalid from reported", err)
+	}
+}
+
+// newQueryJournal returns a journal holding an address and updates of two records, a day apart each.
+func newQueryJournal(t *testing.T) (*Journal, time.Time) {
+	j := newTestJournal(t)
+	start := time.Now().Add(-72 * time.Hour).Truncate(time.Second)
+
+	for i, entry := range []Entry{
+		{Kind: KindAddress, Family: "ipv4", Address: "192.0.2.1"},
+		{Kind: KindUpdate, Family: "ipv4", Address: "192.0.2.1", Provider: "cloudflare", Record: "home.example.com", Status: StatusSuccess},
+		{Kind: KindUpdate, Family: "ipv6", Address: "2001:db8::1", Provider: "cloudflare", Record: "vpn.example.com", Status: StatusSuccess},
+	} {
+		entry.Time = start.Add(time.Duration(i) * 24 * time.Hour)
+		if err := j.appendLocked(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return j, start
+}
+
+func TestQuery(t *testing.T) {
+	j, start := newQueryJournal(t)
+
+	tests := []struct {
+		query Query
+		want  []string
+	}{
+		{Query{}, []string{"192.0.2.1", "192.0.2.1", "2001:db8::1"}},
+		{Query{From: start.Add(time.Hour)}, []string{"192.0.2.1", "2001:db8::1"}},
+		{Query{To: start.Add(24 * time.Hour)}, []string{"192.0.2.1", "192.0.2.1"}},
+		{Query{Family: "ipv6"}, []string{"2001:db8::1"}},
+		// detected addresses are kept along with the updates of the record
+		{Query{Record: "vpn.example.com"}, []string{"192.0.2.1", "2001:db8::1"}},
+	}
+
+	for _, test := range tests {
+		entries, err := j.Query(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Address)
+		}
+
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("query %+v returned %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	j, _ := newQueryJournal(t)
+
+	tests := []struct {
+		method string
+		target string
+		status int
+		count  int
+	}{
+		{http.MethodGet, "/history", http.StatusOK, 3},
+		{http.MethodGet, "/history?family=6&from=96h", http.StatusOK, 1},
+		{http.MethodGet, "/history?record=home.example.com&to=2000-01-01", http.StatusOK, 0},
+		{http.MethodGet, "/history?family=ipv5", http.StatusBadRequest, -1},
+		{http.MethodPost, "/history", http.StatusMethodNotAllowed, -1},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		j.Handler(recorder, httptest.NewRequest(test.method, test.target, nil))
+
+		if recorder.Code != test.status {
+			t.Errorf("%s %s answered %d, want %d", test.method, test.target, recorder.Code, test.status)
+			continue
+		}
+
+		if test.count < 0 {
+			continue
+		}
+
+		var entries []Entry
+		if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil || entries == nil || len(entries) != test.count {
+			t.Errorf("%s %s returned %s (%v), want %d entries", test.method, test.target, recorder.Body, err, test.count)
+		}
+
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s %s answered with %s", test.method, test.target, contentType)
+		}
+	}
+
+	// without a journal the history is empty
+	recorder := httptest.NewRecorder()
+	var none *Journal
+	none.Handler(recorder, httptest.NewRequest(http.MethodGet, "/history", nil))
+
+	if recorder.Code != http.StatusOK || strings.TrimSpace(recorder.Body.String()) != "[]" {
+		t.Errorf("nil journal answered %d with %s", recorder.Code, recorder.Body)
+	}
+}
@@ -0,0 +1,143 @@
+package hooks
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	log "github.com/sirupsen/logrus"
+)
+
+type HookResult struct {
+	HookIndex int
+	Attempts  int
+	Stdout    string
+	Stderr    string
+	Error     error
+	DryRun    bool
+}
+
+// processEnvironment returns the variables of the service passed to the command of the hook.
+func processEnvironment(hook Hook) []string {
+	var env []string
+
+	for _, names := range [][]string{baseEnvironment, hook.PassEnv} {
+		for _, name := range names {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	}
+
+	return env
+}
+
+// hookEnvironment builds the variables describing the update that are passed to the command.
+func hookEnvironment(update *events.IPUpdate) []string {
+	env := []string{
+		"DYNDNS_IP=" + update.IP.String(),
+		"DYNDNS_FAMILY=" + update.Family(),
+		"DYNDNS_SOURCE=" + update.Source,
+		"DYNDNS_PREVIOUS_IP=",
+		"DYNDNS_PREFIX=",
+	}
+
+	if update.Previous != nil {
+		env[3] += update.Previous.String()
+	}
+
+	if update.Prefix != nil {
+		env[4] += update.Prefix.String()
+	}
+
+	return env
+}
+
+func runHook(hook Hook, update *events.IPUpdate, dryRun bool, log *log.Entry) chan HookResult {
+	if update.IP.To4() != nil && !hook.Onipv4 {
+		return nil
+	}
+	if update.IP.To4() == nil && !hook.Onipv6 {
+		return nil
+	}
+
+	hookResult := make(chan HookResult)
+	hookIndex := hook.Index
+	env := hookEnvironment(update)
+
+	log.WithField("hook_index", hookIndex).Info(fmt.Sprintf("Executing hook: %s", hook.Command))
+
+	go func() {
+		if dryRun {
+			hookResult <- HookResult{hookIndex, 0, fmt.Sprintf("%s\n%s", hook.Command, strings.Join(env, "\n")), "", nil, true}
+			return
+		}
+
+		var stdout, stderr string
+		var err error
+
+		attempt := 0
+		for {
+			attempt++
+			stdout, stderr, err = executeHook(hook, env)
+
+			if err == nil || attempt > int(hook.RetryCount) {
+				break
+			}
+
+			// same exponential backoff retryablehttp uses, 1s, 2s, 4s ... capped at 30s
+			wait := time.Duration(1<<uint(attempt-1)) * time.Second
+			if wait > 30*time.Second {
+				wait = 30 * time.Second
+			}
+
+			log.WithField("hook_index", hookIndex).WithError(err).
+				Warn(fmt.Sprintf("Hook failed, retrying in %s (%d left)", wait, int(hook.RetryCount)-attempt+1))
+
+			time.Sleep(wait)
+		}
+
+		hookResult <- HookResult{hookIndex, attempt, stdout, stderr, err, false}
+	}()
+
+	return hookResult
+}
+
+// executeHook runs the command once through the shell of the platform, a non-zero exit status is returned as error.
+func executeHook(hook Hook, env []string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := shellCommand(hook.Command)
+	cmd.Env = append(processEnvironment(hook), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return "", "", err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(hook.Timeout)
+	defer timer.Stop()
+
+	var err error
+
+	select {
+	case err = <-done:
+	case <-timer.C:
+		// kill the whole group, otherwise children of the shell keep the output pipes open
+		killProcessGroup(cmd)
+		<-done
+		err = fmt.Errorf("hook timed out after %s", hook.Timeout)
+	}
+
+	return strings.TrimSpace(stdout.String()), strings.TrimSpace(stderr.String()), err
+}
@@ -0,0 +1,144 @@
+package hooks
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	log "github.com/sirupsen/logrus"
+)
+
+func testLog() *log.Entry {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	return log.NewEntry(logger)
+}
+
+func skipWithoutShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are written for /bin/sh")
+	}
+}
+
+func TestHookEnvironment(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/56")
+
+	tests := []struct {
+		update *events.IPUpdate
+		want   []string
+	}{
+		{
+			&events.IPUpdate{IP: net.ParseIP("192.0.2.2"), Previous: net.ParseIP("192.0.2.1"), Source: events.SourcePush},
+			[]string{"DYNDNS_IP=192.0.2.2", "DYNDNS_FAMILY=ipv4", "DYNDNS_SOURCE=push", "DYNDNS_PREVIOUS_IP=192.0.2.1", "DYNDNS_PREFIX="},
+		},
+		{
+			&events.IPUpdate{IP: net.ParseIP("2001:db8:1::1"), Prefix: prefix, Source: events.SourcePoll},
+			[]string{"DYNDNS_IP=2001:db8:1::1", "DYNDNS_FAMILY=ipv6", "DYNDNS_SOURCE=poll", "DYNDNS_PREVIOUS_IP=", "DYNDNS_PREFIX=2001:db8:1::/56"},
+		},
+	}
+
+	for _, test := range tests {
+		if got := hookEnvironment(test.update); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("environment of %s is %v, want %v", test.update.IP, got, test.want)
+		}
+	}
+}
+
+func TestProcessEnvironment(t *testing.T) {
+	t.Setenv("TZ", "Europe/Berlin")
+	t.Setenv("CLOUDFLARE_API_TOKEN", "secret-token")
+	t.Setenv("HOOK_TARGET", "allow-list")
+
+	env := strings.Join(processEnvironment(Hook{PassEnv: []string{"HOOK_TARGET", "HOOK_UNSET"}}), "\n")
+
+	for _, want := range []string{"TZ=Europe/Berlin", "HOOK_TARGET=allow-list"} {
+		if !strings.Contains(env, want) {
+			t.Errorf("environment %q misses %s", env, want)
+		}
+	}
+
+	for _, unwanted := range []string{"CLOUDFLARE_API_TOKEN", "HOOK_UNSET"} {
+		if strings.Contains(env, unwanted) {
+			t.Errorf("environment %q passes %s", env, unwanted)
+		}
+	}
+}
+
+func TestExecuteHook(t *testing.T) {
+	skipWithoutShell(t)
+	t.Setenv("HOOK_TARGET", "allow-list")
+	t.Setenv("CLOUDFLARE_API_TOKEN", "secret-token")
+
+	hook := Hook{
+		Command: `echo "$DYNDNS_IP $HOOK_TARGET"; echo warning >&2; test -z "$CLOUDFLARE_API_TOKEN"`,
+		Timeout: 5 * time.Second,
+		PassEnv: []string{"HOOK_TARGET"},
+	}
+
+	stdout, stderr, err := executeHook(hook, []string{"DYNDNS_IP=192.0.2.1"})
+	if err != nil || stdout != "192.0.2.1 allow-list" || stderr != "warning" {
+		t.Errorf("hook returned %q, %q, %v", stdout, stderr, err)
+	}
+
+	hook.Command = "echo failed; exit 3"
+	if stdout, _, err := executeHook(hook, nil); err == nil || stdout != "failed" {
+		t.Errorf("failing hook returned %q, %v", stdout, err)
+	}
+}
+
+func TestExecuteHookTimeoutKillsChildren(t *testing.T) {
+	skipWithoutShell(t)
+
+	// the background child keeps the output pipes open unless it is killed along with the shell
+	hook := Hook{Command: "sleep 10 & sleep 10", Timeout: 200 * time.Millisecond}
+
+	start := time.Now()
+	_, _, err := executeHook(hook, nil)
+
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error %v, want a timeout", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("hook returned after %s, the children were not killed", elapsed)
+	}
+}
+
+func TestRunHookRetries(t *testing.T) {
+	skipWithoutShell(t)
+
+	counter := filepath.Join(t.TempDir(), "attempts")
+	t.Setenv("HOOK_COUNTER", counter)
+
+	hook := Hook{
+		Index:      1,
+		Command:    `echo x >> "$HOOK_COUNTER"; exit 1`,
+		Timeout:    5 * time.Second,
+		RetryCount: 1,
+		Onipv4:     true,
+		PassEnv:    []string{"HOOK_COUNTER"},
+	}
+
+	if runHook(hook, &events.IPUpdate{IP: net.ParseIP("2001:db8::1")}, false, testLog()) != nil {
+		t.Errorf("hook not running on IPv6 was executed")
+	}
+
+	result := <-runHook(hook, &events.IPUpdate{IP: net.ParseIP("192.0.2.1")}, false, testLog())
+
+	data, _ := ioutil.ReadFile(counter)
+	if result.Error == nil || result.Attempts != 2 || strings.Count(string(data), "x") != 2 {
+		t.Errorf("hook ran %d times, reported %d attempts and %v, want 2 failed attempts", strings.Count(string(data), "x"), result.Attempts, result.Error)
+	}
+
+	result = <-runHook(hook, &events.IPUpdate{IP: net.ParseIP("192.0.2.1")}, true, testLog())
+	if !result.DryRun || result.Attempts != 0 || !strings.Contains(result.Stdout, "DYNDNS_IP=192.0.2.1") {
+		t.Errorf("dry run returned %+v", result)
+	}
+}
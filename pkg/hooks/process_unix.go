@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package hooks
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// baseEnvironment are the variables of the service passed to every command, the rest of the environment holds
+// credentials and is only passed if a hook asks for it
+var baseEnvironment = []string{"PATH", "HOME", "LANG", "TZ"}
+
+// shellCommand runs the command through /bin/sh.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+// setProcessGroup starts the command in its own process group, so it can be killed with all its children.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
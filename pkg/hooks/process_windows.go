@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package hooks
+
+import (
+	"os/exec"
+)
+
+// baseEnvironment are the variables of the service passed to every command, cmd.exe needs SystemRoot and friends to
+// start programs, the rest of the environment holds credentials and is only passed if a hook asks for it
+var baseEnvironment = []string{"PATH", "PATHEXT", "SystemRoot", "ComSpec", "TEMP", "TMP", "USERPROFILE", "TZ"}
+
+// shellCommand runs the command through cmd.exe.
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
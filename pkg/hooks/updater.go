@@ -0,0 +1,230 @@
+package hooks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/history"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProviderName identifies the updater in the history and the outbox
+const ProviderName = "hooks"
+
+type Hook struct {
+	// Index is n of the EXEC_HOOK_n_* variables the hook is configured by, it identifies the hook in logs and outbox
+	Index      int
+	Command    string
+	Timeout    time.Duration
+	RetryCount uint
+	Onipv4     bool
+	Onipv6     bool
+	// PassEnv are the names of further variables of the service passed to the command
+	PassEnv []string
+}
+
+type Updater struct {
+	log *log.Entry
+
+	isInit bool
+
+	In chan *events.IPUpdate
+
+	Hooks []Hook
+
+	// DryRun logs the commands and their environment instead of executing them
+	DryRun bool
+
+	// History journals the outcome of every hook, if set
+	History *history.Journal
+
+	// Outbox stores failed hooks for a later retry, if set
+	Outbox *outbox.Outbox
+
+	latest events.Latest
+}
+
+func NewUpdater() *Updater {
+	return &Updater{
+		log:    log.WithField("module", "hooks"),
+		isInit: false,
+		In:     make(chan *events.IPUpdate, 10),
+	}
+}
+
+func (u *Updater) InitFromEnvironment() error {
+	// allows up to 9 hooks, same as the HTTP requests, indexes can be skipped
+	for hookIndex := 1; hookIndex < 10; hookIndex++ {
+		// read from EXEC_HOOK_1_*, EXEC_HOOK_2_* ... EXEC_HOOK_9_*, skipping when empty command
+		hookCommand := os.Getenv(fmt.Sprintf("EXEC_HOOK_%d_COMMAND", hookIndex))
+		if hookCommand == "" {
+			continue
+		}
+		hookTimeoutStr := os.Getenv(fmt.Sprintf("EXEC_HOOK_%d_TIMEOUT", hookIndex))
+		if hookTimeoutStr == "" {
+			hookTimeoutStr = "30s"
+		}
+		hookTimeout, err := time.ParseDuration(hookTimeoutStr)
+		if err != nil || hookTimeout < time.Second || hookTimeout > 10*time.Minute {
+			if err == nil {
+				err = fmt.Errorf("value %s outside bounds [1s, 10m]", hookTimeout)
+			}
+			log.WithError(err).Warn(fmt.Sprintf("Failed to parse EXEC_HOOK_%d_TIMEOUT, using default value 30s", hookIndex))
+			hookTimeout = 30 * time.Second
+		}
+		hookRetryCountStr := os.Getenv(fmt.Sprintf("EXEC_HOOK_%d_RETRY_COUNT", hookIndex))
+		if hookRetryCountStr == "" {
+			hookRetryCountStr = "3"
+		}
+		hookRetryCount, err := strconv.ParseUint(hookRetryCountStr, 10, 32)
+		if err != nil || hookRetryCount > 10 {
+			if err == nil {
+				err = fmt.Errorf("value %d outside bounds [0, 10]", hookRetryCount)
+			}
+			log.WithError(err).Warn(fmt.Sprintf("Failed to parse EXEC_HOOK_%d_RETRY_COUNT, using default value 3", hookIndex))
+			hookRetryCount = 3
+		}
+		hookOnIpV4, err := strconv.ParseBool(os.Getenv(fmt.Sprintf("EXEC_HOOK_%d_ONIPV4", hookIndex)))
+		if err != nil {
+			hookOnIpV4 = true
+		}
+		// unlike HTTP requests, hooks run on IPv6 changes by default, they get the family and can act on either
+		hookOnIpV6, err := strconv.ParseBool(os.Getenv(fmt.Sprintf("EXEC_HOOK_%d_ONIPV6", hookIndex)))
+		if err != nil {
+			hookOnIpV6 = true
+		}
+
+		var hookPassEnv []string
+		for _, name := range strings.Split(os.Getenv(fmt.Sprintf("EXEC_HOOK_%d_PASS_ENV", hookIndex)), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hookPassEnv = append(hookPassEnv, name)
+			}
+		}
+
+		u.Hooks = append(u.Hooks, Hook{
+			Index:      hookIndex,
+			Command:    hookCommand,
+			Timeout:    hookTimeout,
+			RetryCount: uint(hookRetryCount),
+			Onipv4:     hookOnIpV4,
+			Onipv6:     hookOnIpV6,
+			PassEnv:    hookPassEnv,
+		})
+	}
+
+	u.isInit = true
+
+	return nil
+}
+
+func (u *Updater) StartWorker() {
+	go u.spawnWorker()
+}
+
+func (u *Updater) shouldProcessUpdates() bool {
+	if !u.isInit {
+		return false
+	}
+
+	if len(u.Hooks) == 0 {
+		return false
+	}
+
+	return true
+}
+
+func (u *Updater) spawnWorker() {
+	for {
+		select {
+		case update := <-u.In:
+			if !u.shouldProcessUpdates() {
+				continue
+			}
+
+			u.latest.Remember(update)
+			u.log.WithField("ip", update.IP).Info("Received update request, executing all hooks")
+
+			wg := sync.WaitGroup{}
+
+			for _, hook := range u.Hooks {
+				hookResult := runHook(hook, update, u.DryRun, u.log)
+				if hookResult == nil {
+					continue
+				}
+				wg.Add(1)
+				go func(hookResult chan HookResult) {
+					defer wg.Done()
+					result := <-hookResult
+					u.logHookResult(result, update.IP)
+					if result.DryRun {
+						return
+					}
+					target := strconv.Itoa(result.HookIndex)
+					if result.Error != nil {
+						u.Outbox.Enqueue(ProviderName, target, update, result.Error)
+					} else {
+						u.Outbox.Complete(ProviderName, target, update.IP)
+					}
+				}(hookResult)
+			}
+			wg.Wait()
+			u.log.Debug("Hooks done")
+		}
+	}
+}
+
+func (u *Updater) logHookResult(result HookResult, ip net.IP) {
+	hlog := u.log.WithField("hook_index", result.HookIndex)
+
+	if result.DryRun {
+		hlog.Info(fmt.Sprintf("Dry run, would execute hook:\n%s", result.Stdout))
+	} else if result.Error != nil {
+		hlog.WithError(result.Error).
+			WithField("attempts", result.Attempts).
+			Error(fmt.Sprintf("Hook failed, stdout: %s, stderr: %s", result.Stdout, result.Stderr))
+	} else {
+		hlog.WithField("attempts", result.Attempts).
+			Info(fmt.Sprintf("Hook result, stdout: %s, stderr: %s", result.Stdout, result.Stderr))
+	}
+
+	u.History.RecordUpdate(ProviderName, strconv.Itoa(result.HookIndex), ip, result.DryRun, result.Error)
+}
+
+// Retry executes the hook of an operation stored in the outbox again.
+func (u *Updater) Retry(op *outbox.Operation) error {
+	if !u.shouldProcessUpdates() {
+		return errors.New("hooks updater is not initialized")
+	}
+
+	var hook *Hook
+	for i := range u.Hooks {
+		if strconv.Itoa(u.Hooks[i].Index) == op.Target {
+			hook = &u.Hooks[i]
+			break
+		}
+	}
+	if hook == nil {
+		return fmt.Errorf("no hook configured for %s", op.Target)
+	}
+
+	// a newer address received since the failure takes precedence
+	update := u.latest.Current(op.Update())
+
+	hookResult := runHook(*hook, update, u.DryRun, u.log)
+	if hookResult == nil {
+		return fmt.Errorf("hook %s is not executed on %s updates", op.Target, op.Family)
+	}
+
+	result := <-hookResult
+	u.logHookResult(result, update.IP)
+
+	return result.Error
+}
@@ -0,0 +1,99 @@
+package hooks
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+)
+
+// newTestUpdater returns an updater with a single hook writing the address it got to the returned file, failing as
+// long as the fail file exists.
+func newTestUpdater(t *testing.T) (*Updater, string, string) {
+	dir := t.TempDir()
+	written, fail := filepath.Join(dir, "written"), filepath.Join(dir, "fail")
+	t.Setenv("HOOK_WRITTEN", written)
+	t.Setenv("HOOK_FAIL", fail)
+
+	u := NewUpdater()
+	u.log = testLog()
+	u.isInit = true
+	u.Outbox = outbox.NewOutbox(filepath.Join(dir, "outbox.json"))
+	u.Hooks = []Hook{{
+		Index:   2,
+		Command: `echo "$DYNDNS_IP" > "$HOOK_WRITTEN"; test ! -e "$HOOK_FAIL"`,
+		Timeout: 5 * time.Second,
+		Onipv4:  true,
+		PassEnv: []string{"HOOK_WRITTEN", "HOOK_FAIL"},
+	}}
+
+	return u, written, fail
+}
+
+func TestUpdaterStoresFailedHooks(t *testing.T) {
+	skipWithoutShell(t)
+
+	u, written, fail := newTestUpdater(t)
+	if err := ioutil.WriteFile(fail, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u.StartWorker()
+	u.In <- &events.IPUpdate{IP: net.ParseIP("192.0.2.1"), Source: events.SourcePoll}
+
+	var ops []*outbox.Operation
+	for deadline := time.Now().Add(5 * time.Second); len(ops) == 0 && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+		ops, _ = u.Outbox.List()
+	}
+
+	if len(ops) != 1 || ops[0].Provider != ProviderName || ops[0].Target != "2" || ops[0].Address != "192.0.2.1" {
+		t.Fatalf("outbox holds %+v, want the failed hook", ops)
+	}
+
+	if data, _ := ioutil.ReadFile(written); strings.TrimSpace(string(data)) != "192.0.2.1" {
+		t.Errorf("hook got %q, want 192.0.2.1", data)
+	}
+}
+
+func TestUpdaterRetry(t *testing.T) {
+	skipWithoutShell(t)
+
+	u, written, fail := newTestUpdater(t)
+
+	// the address received after the failure is used
+	u.latest.Remember(&events.IPUpdate{IP: net.ParseIP("192.0.2.2")})
+	op := &outbox.Operation{Target: "2", Family: "ipv4", Address: "192.0.2.1"}
+
+	if err := u.Retry(op); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := ioutil.ReadFile(written); strings.TrimSpace(string(data)) != "192.0.2.2" {
+		t.Errorf("retry passed %q, want the newest address 192.0.2.2", data)
+	}
+
+	if err := ioutil.WriteFile(fail, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		op  *outbox.Operation
+		err string
+	}{
+		{op, "exit status 1"},
+		{&outbox.Operation{Target: "3", Family: "ipv4", Address: "192.0.2.1"}, "no hook configured for 3"},
+		{&outbox.Operation{Target: "2", Family: "ipv6", Address: "2001:db8::1"}, "not executed on ipv6 updates"},
+	}
+
+	for _, test := range tests {
+		if err := u.Retry(test.op); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("retry of %s %s failed with %v, want %q", test.op.Target, test.op.Family, err, test.err)
+		}
+	}
+}
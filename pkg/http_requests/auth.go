@@ -0,0 +1,287 @@
+package http_requests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+)
+
+// Types of token acquisition
+const (
+	// AuthOAuth2 uses the OAuth2 client credentials grant
+	AuthOAuth2 = "oauth2"
+	// AuthLogin sends a login request whose response carries the token
+	AuthLogin = "login"
+)
+
+// Defaults of the token acquisition
+const (
+	defaultAuthHeader = "Authorization"
+	defaultAuthPrefix = "Bearer "
+	defaultTokenTTL   = 5 * time.Minute
+	// tokens are refreshed this long before they expire
+	tokenExpiryMargin = 30 * time.Second
+)
+
+// AuthConfig defines how a bearer token for a request is acquired, see tokenSource.
+type AuthConfig struct {
+	Type string `json:"type"`
+	// OAuth2 client credentials, sent as basic auth or in the body if ClientAuth is "body"
+	TokenURL     string `json:"tokenUrl"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	// ClientSecretFile is read instead of ClientSecret, again whenever it changes
+	ClientSecretFile string `json:"clientSecretFile"`
+	ClientAuth       string `json:"clientAuth"`
+	Scopes           string `json:"scopes"`
+	// Login request, its URL, body and header values are templates just like those of the request
+	LoginURL     string            `json:"loginUrl"`
+	LoginMethod  string            `json:"loginMethod"`
+	LoginBody    string            `json:"loginBody"`
+	LoginHeaders map[string]string `json:"loginHeaders"`
+	// The token is read from a value of the JSON response or from a response header of the login request
+	TokenJSONPath string `json:"tokenJsonPath"`
+	TokenHeader   string `json:"tokenHeader"`
+	// TokenTTL applies to tokens without expires_in, defaults to 5m
+	TokenTTL string `json:"tokenTtl"`
+	// Header and Prefix of the token in the request, default to "Authorization" and "Bearer "
+	Header string  `json:"header"`
+	Prefix *string `json:"prefix"`
+}
+
+// tokenSource acquires bearer tokens and caches them until shortly before they expire. It is shared by all copies of
+// a request.
+type tokenSource struct {
+	config    AuthConfig
+	ttl       time.Duration
+	header    string
+	prefix    string
+	templates *requestTemplates
+	secret    *secrets.Secret
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newTokenSource validates the config and parses the templates of the login request.
+func newTokenSource(config AuthConfig) (*tokenSource, error) {
+	s := &tokenSource{
+		config: config,
+		ttl:    defaultTokenTTL,
+		header: defaultAuthHeader,
+		prefix: defaultAuthPrefix,
+	}
+
+	if config.Header != "" {
+		s.header = config.Header
+	}
+	if config.Prefix != nil {
+		s.prefix = *config.Prefix
+	}
+
+	if config.TokenTTL != "" {
+		ttl, err := time.ParseDuration(config.TokenTTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid token TTL %q", config.TokenTTL)
+		}
+		s.ttl = ttl
+	}
+
+	switch strings.ToLower(config.Type) {
+	case AuthOAuth2:
+		if config.TokenURL == "" || config.ClientID == "" {
+			return nil, fmt.Errorf("oauth2 auth requires a token URL and a client ID")
+		}
+		if config.ClientAuth != "" && config.ClientAuth != "basic" && config.ClientAuth != "body" {
+			return nil, fmt.Errorf("invalid oauth2 client auth %q, either basic or body", config.ClientAuth)
+		}
+
+		var err error
+		if s.secret, err = secretOf(config.ClientSecret, config.ClientSecretFile); err != nil {
+			return nil, fmt.Errorf("failed to read client secret: %w", err)
+		}
+	case AuthLogin:
+		if config.LoginURL == "" {
+			return nil, fmt.Errorf("login auth requires a login URL")
+		}
+		if config.TokenJSONPath == "" && config.TokenHeader == "" {
+			return nil, fmt.Errorf("login auth requires a token JSON path or a token header")
+		}
+
+		var err error
+		if s.templates, err = parseTemplates(HttpRequest{Url: config.LoginURL, Body: config.LoginBody, Headers: config.LoginHeaders}); err != nil {
+			return nil, fmt.Errorf("login request: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth type %q, either %s or %s", config.Type, AuthOAuth2, AuthLogin)
+	}
+
+	return s, nil
+}
+
+// Token returns the cached token or acquires a new one with the client. Errors never contain the token.
+func (s *tokenSource) Token(data TemplateData, client *http.Client) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Before(s.expires) {
+		return s.token, nil
+	}
+
+	var token string
+	var ttl time.Duration
+	var err error
+
+	if strings.ToLower(s.config.Type) == AuthOAuth2 {
+		token, ttl, err = s.clientCredentials(client)
+	} else {
+		token, ttl, err = s.login(client, data)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if ttl <= 0 {
+		ttl = s.ttl
+	}
+	if ttl > 2*tokenExpiryMargin {
+		ttl -= tokenExpiryMargin
+	}
+
+	// the token is a credential like the configured ones, keep it out of all logs, replacing the expired one
+	secrets.RegisterAs(s, token)
+
+	s.token = token
+	s.expires = time.Now().Add(ttl)
+
+	return token, nil
+}
+
+// Invalidate drops the cached token, i.e. after the request was rejected with 401.
+func (s *tokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = ""
+}
+
+// clientCredentials requests a token with the OAuth2 client credentials grant, RFC 6749 section 4.4.
+func (s *tokenSource) clientCredentials(client *http.Client) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+
+	if s.config.Scopes != "" {
+		form.Set("scope", strings.Join(strings.FieldsFunc(s.config.Scopes, func(r rune) bool { return r == ',' || r == ' ' }), " "))
+	}
+	if s.config.ClientAuth == "body" {
+		form.Set("client_id", s.config.ClientID)
+		form.Set("client_secret", s.secret.Value())
+	}
+
+	request, err := http.NewRequest(http.MethodPost, s.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	if s.config.ClientAuth != "body" {
+		request.SetBasicAuth(url.QueryEscape(s.config.ClientID), url.QueryEscape(s.secret.Value()))
+	}
+
+	_, body, err := doTokenRequest(client, request)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var response struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", 0, fmt.Errorf("token response is not valid JSON: %w", err)
+	}
+
+	if response.AccessToken == "" {
+		return "", 0, fmt.Errorf("token response has no access_token")
+	}
+
+	expiresIn, _ := response.ExpiresIn.Int64()
+
+	return response.AccessToken, time.Duration(expiresIn) * time.Second, nil
+}
+
+// login sends the login request and reads the token from its response.
+func (s *tokenSource) login(client *http.Client, data TemplateData) (string, time.Duration, error) {
+	rendered, err := s.templates.render(data)
+	if err != nil {
+		return "", 0, fmt.Errorf("rendering login request failed: %w", err)
+	}
+
+	method := s.config.LoginMethod
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	request, err := http.NewRequest(method, rendered.Url, bytes.NewBufferString(rendered.Body))
+	if err != nil {
+		return "", 0, err
+	}
+
+	for key, value := range rendered.Headers {
+		request.Header.Set(key, value)
+	}
+
+	header, body, err := doTokenRequest(client, request)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var token string
+
+	if s.config.TokenHeader != "" {
+		token = strings.TrimSpace(header.Get(s.config.TokenHeader))
+		token = strings.TrimSpace(strings.TrimPrefix(token, strings.TrimSpace(s.prefix)))
+	} else if token, err = jsonPathValue(body, s.config.TokenJSONPath); err != nil {
+		return "", 0, fmt.Errorf("login response: %w", err)
+	}
+
+	if token == "" {
+		return "", 0, fmt.Errorf("login response carries no token")
+	}
+
+	return token, 0, nil
+}
+
+// doTokenRequest sends a token request, failing on any status but 2xx. The response body is kept out of the error as
+// it might contain secrets.
+func doTokenRequest(client *http.Client, request *http.Request) (http.Header, []byte, error) {
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxMatchedBody))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading token response failed: %w", err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, nil, fmt.Errorf("token request was answered with %s", response.Status)
+	}
+
+	return response.Header, body, nil
+}
@@ -0,0 +1,168 @@
+package http_requests
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+	log "github.com/sirupsen/logrus"
+)
+
+// authStandIn issues numbered tokens at /token and /login and accepts only the latest one at /api.
+type authStandIn struct {
+	server *httptest.Server
+	issued int
+	prefix string
+	valid  string
+	form   map[string]string
+}
+
+func newAuthStandIn(t *testing.T) *authStandIn {
+	s := &authStandIn{prefix: "tok-"}
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token", "/login":
+			_ = r.ParseForm()
+			s.form = map[string]string{"grant_type": r.PostForm.Get("grant_type"), "scope": r.PostForm.Get("scope")}
+			s.form["user"], s.form["secret"], _ = r.BasicAuth()
+			s.issued++
+			s.valid = s.prefix + strings.Repeat("x", s.issued)
+			if r.URL.Path == "/login" {
+				_, _ = w.Write([]byte(`{"session":{"token":"` + s.valid + `"}}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token":"` + s.valid + `","token_type":"Bearer","expires_in":3600}`))
+		case "/api":
+			if r.Header.Get("Authorization") != "Bearer "+s.valid {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte("ok"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+func (s *authStandIn) request(t *testing.T, auth AuthConfig) HttpRequest {
+	retryCount := 0
+	httpRequest, err := RequestConfig{Name: "x", Url: s.server.URL + "/api?ip={{.IPv4}}", RetryCount: &retryCount, Auth: &auth}.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httpRequest
+}
+
+var authData = TemplateData{IP: "192.0.2.1", Family: "ipv4", IPv4: "192.0.2.1"}
+
+func TestAuthClientCredentials(t *testing.T) {
+	server := newAuthStandIn(t)
+	httpRequest := server.request(t, AuthConfig{Type: AuthOAuth2, TokenURL: server.server.URL + "/token", ClientID: "id", ClientSecret: "s3cret", Scopes: "dns,update"})
+
+	for i := 0; i < 2; i++ {
+		if result := send(httpRequest, authData); result.Error != nil {
+			t.Fatalf("request %d failed: %v", i, result.Error)
+		}
+	}
+
+	if server.issued != 1 {
+		t.Errorf("%d tokens acquired, want the cached one reused", server.issued)
+	}
+
+	if server.form["grant_type"] != "client_credentials" || server.form["scope"] != "dns update" ||
+		server.form["user"] != "id" || server.form["secret"] != "s3cret" {
+		t.Errorf("unexpected token request %v", server.form)
+	}
+
+	// a revoked token is replaced once
+	server.valid = "revoked"
+
+	if result := send(httpRequest, authData); result.Error != nil {
+		t.Fatalf("request with revoked token failed: %v", result.Error)
+	}
+
+	if server.issued != 2 {
+		t.Errorf("%d tokens acquired, want a new one after 401", server.issued)
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	server := newAuthStandIn(t)
+	httpRequest := server.request(t, AuthConfig{
+		Type:          AuthLogin,
+		LoginURL:      server.server.URL + "/login",
+		LoginBody:     `{"user":"{{.Username}}"}`,
+		TokenJSONPath: "session.token",
+	})
+
+	if result := send(httpRequest, authData); result.Error != nil {
+		t.Fatalf("request failed: %v", result.Error)
+	}
+}
+
+func TestAuthValidation(t *testing.T) {
+	for _, auth := range []AuthConfig{
+		{Type: "unknown"},
+		{Type: AuthOAuth2, ClientID: "id"},
+		{Type: AuthOAuth2, TokenURL: "https://example.com", ClientID: "id", ClientAuth: "header"},
+		{Type: AuthLogin, LoginURL: "https://example.com"},
+		{Type: AuthLogin, LoginURL: "https://example.com", TokenHeader: "X-Token", TokenTTL: "soon"},
+	} {
+		if _, err := (RequestConfig{Name: "x", Url: "https://example.com", Auth: &auth}).build(); err == nil {
+			t.Errorf("invalid auth %+v accepted", auth)
+		}
+	}
+}
+
+func TestAuthTokenNotLogged(t *testing.T) {
+	server := newAuthStandIn(t)
+	httpRequest := server.request(t, AuthConfig{Type: AuthOAuth2, TokenURL: server.server.URL + "/token", ClientID: "id"})
+
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Level = log.TraceLevel
+
+	if result := <-doRequest(httpRequest, authData, false, log.NewEntry(logger)); result.Error != nil {
+		t.Fatalf("request failed: %v", result.Error)
+	}
+
+	if server.valid == "" || strings.Contains(out.String(), server.valid) {
+		t.Errorf("token %q logged: %s", server.valid, out.String())
+	}
+
+	// other modules logging the token, i.e. in an error of the client, get it redacted as well
+	if redacted := secrets.Redact("Authorization: Bearer " + server.valid); strings.Contains(redacted, server.valid) {
+		t.Errorf("acquired token not registered as secret: %s", redacted)
+	}
+}
+
+func TestAuthRefreshReplacesRedactedToken(t *testing.T) {
+	server := newAuthStandIn(t)
+	server.prefix = "refreshed-"
+	httpRequest := server.request(t, AuthConfig{Type: AuthOAuth2, TokenURL: server.server.URL + "/token", ClientID: "id"})
+
+	if result := send(httpRequest, authData); result.Error != nil {
+		t.Fatalf("request failed: %v", result.Error)
+	}
+
+	expired := server.valid
+	server.valid = "revoked"
+
+	if result := send(httpRequest, authData); result.Error != nil {
+		t.Fatalf("request with revoked token failed: %v", result.Error)
+	}
+
+	// the registry holds the current token of the source only, instead of every token acquired during the run
+	if redacted := secrets.Redact(expired + " " + server.valid); redacted != expired+" "+secrets.Redacted {
+		t.Errorf("redacted to %q, want only the current token %s replaced", redacted, server.valid)
+	}
+}
@@ -0,0 +1,477 @@
+package http_requests
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/configfile"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults and bounds of the request settings
+const (
+	defaultRetryCount = 7
+	fallbackRetry     = 6
+	maxRetryCount     = 14
+	defaultTimeout    = 5 * time.Second
+	minTimeout        = time.Second
+	maxTimeout        = 60 * time.Second
+	defaultSettle     = 10 * time.Second
+	maxSettle         = 5 * time.Minute
+)
+
+// RequestConfig defines a request, either read from the requests file or from the HTTP_REQUEST_n_* variables.
+type RequestConfig struct {
+	// Name identifies the request in logs, history and outbox, defaults to the index n of the variables
+	Name     string            `json:"name"`
+	Url      string            `json:"url"`
+	Method   string            `json:"method"`
+	Body     string            `json:"body"`
+	Headers  map[string]string `json:"headers"`
+	Hostname string            `json:"hostname"`
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	// PasswordFile is read instead of Password, again whenever it changes
+	PasswordFile string         `json:"passwordFile"`
+	BasicAuth    bool           `json:"basicAuth"`
+	Timeout      string         `json:"timeout"`
+	RetryCount   *int           `json:"retryCount"`
+	OnIPv4       *bool          `json:"onIPv4"`
+	OnIPv6       *bool          `json:"onIPv6"`
+	DualStack    bool           `json:"dualStack"`
+	Settle       string         `json:"settle"`
+	Success      ResponseConfig `json:"success"`
+	// Preset of a DynDNS provider filling the URL, credentials and success criteria, see presets
+	Preset string `json:"preset"`
+	Token  string `json:"token"`
+	// TokenFile is read instead of Token, again whenever it changes
+	TokenFile string `json:"tokenFile"`
+	// Auth acquires a bearer token for the request, see AuthConfig
+	Auth *AuthConfig `json:"auth"`
+	// TLS settings of the request and its token requests, see TLSConfig
+	TLS TLSConfig `json:"tls"`
+
+	// separateFamilies allows a request on both IPv4 and IPv6 updates, set by presets
+	separateFamilies bool
+}
+
+// ResponseConfig defines the success criteria of a request, see ResponseMatcher.
+type ResponseConfig struct {
+	Status    string `json:"status"`
+	Body      string `json:"body"`
+	JSONPath  string `json:"jsonPath"`
+	JSONValue string `json:"jsonValue"`
+	RetryOn   string `json:"retryOn"`
+	FailOn    string `json:"failOn"`
+}
+
+type requestsFile struct {
+	Requests []RequestConfig `json:"requests"`
+}
+
+// loadRequestConfigs reads the request definitions of a JSON, YAML or TOML file, unknown fields are rejected to catch
+// typos.
+func loadRequestConfigs(path string) ([]RequestConfig, error) {
+	var file requestsFile
+
+	if err := configfile.Decode(path, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for i, config := range file.Requests {
+		if strings.TrimSpace(config.Name) == "" {
+			return nil, fmt.Errorf("request %d of %s has no name", i+1, path)
+		}
+	}
+
+	return file.Requests, nil
+}
+
+// envIndexes returns the sorted indexes n of all set variables named prefix + n + suffix.
+func envIndexes(prefix string, suffix string) []int {
+	var indexes []int
+
+	for _, env := range os.Environ() {
+		key := strings.SplitN(env, "=", 2)[0]
+
+		if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, suffix) || len(key) <= len(prefix)+len(suffix) {
+			continue
+		}
+
+		index, err := strconv.Atoi(key[len(prefix) : len(key)-len(suffix)])
+		if err != nil || index < 1 {
+			continue
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	sort.Ints(indexes)
+
+	return indexes
+}
+
+// requestConfigsFromEnvironment reads the requests of the HTTP_REQUEST_n_* variables, skipping those with neither URL
+// nor preset.
+func requestConfigsFromEnvironment() []RequestConfig {
+	var configs []RequestConfig
+
+	indexes := append(envIndexes("HTTP_REQUEST_", "_URL"), envIndexes("HTTP_REQUEST_", "_PRESET")...)
+	sort.Ints(indexes)
+
+	for i, requestIndex := range indexes {
+		if i > 0 && indexes[i-1] == requestIndex {
+			continue
+		}
+
+		prefix := fmt.Sprintf("HTTP_REQUEST_%d_", requestIndex)
+
+		config := RequestConfig{
+			Name:         os.Getenv(prefix + "NAME"),
+			Url:          os.Getenv(prefix + "URL"),
+			Method:       os.Getenv(prefix + "METHOD"),
+			Body:         os.Getenv(prefix + "BODY"),
+			Headers:      make(map[string]string),
+			Hostname:     os.Getenv(prefix + "HOSTNAME"),
+			Username:     os.Getenv(prefix + "USERNAME"),
+			Password:     os.Getenv(prefix + "PASSWORD"),
+			PasswordFile: os.Getenv(prefix + "PASSWORD_FILE"),
+			Timeout:      os.Getenv(prefix + "TIMEOUT"),
+			Preset:       os.Getenv(prefix + "PRESET"),
+			Token:        os.Getenv(prefix + "TOKEN"),
+			TokenFile:    os.Getenv(prefix + "TOKEN_FILE"),
+			Settle:       os.Getenv(prefix + "SETTLE"),
+			Success: ResponseConfig{
+				Status:    os.Getenv(prefix + "SUCCESS_STATUS"),
+				Body:      os.Getenv(prefix + "SUCCESS_BODY"),
+				JSONPath:  os.Getenv(prefix + "SUCCESS_JSON_PATH"),
+				JSONValue: os.Getenv(prefix + "SUCCESS_JSON_VALUE"),
+				RetryOn:   os.Getenv(prefix + "RETRY_ON"),
+				FailOn:    os.Getenv(prefix + "FAIL_ON"),
+			},
+		}
+
+		if config.Url == "" && config.Preset == "" {
+			continue
+		}
+
+		if config.Name == "" {
+			config.Name = strconv.Itoa(requestIndex)
+		}
+
+		config.BasicAuth, _ = strconv.ParseBool(os.Getenv(prefix + "BASIC_AUTH"))
+		config.DualStack, _ = strconv.ParseBool(os.Getenv(prefix + "DUAL_STACK"))
+
+		if value := os.Getenv(prefix + "RETRY_COUNT"); value != "" {
+			retryCount, err := strconv.Atoi(value)
+			if err != nil {
+				log.WithError(err).Warn(fmt.Sprintf("Failed to parse %sRETRY_COUNT, using default value %d", prefix, fallbackRetry))
+				retryCount = fallbackRetry
+			}
+			config.RetryCount = &retryCount
+		}
+
+		if onIPv4, err := strconv.ParseBool(os.Getenv(prefix + "ONIPV4")); err == nil {
+			config.OnIPv4 = &onIPv4
+		}
+
+		if onIPv6, err := strconv.ParseBool(os.Getenv(prefix + "ONIPV6")); err == nil {
+			config.OnIPv6 = &onIPv6
+		}
+
+		for _, headerIndex := range envIndexes(prefix+"HEADER_", "_KEY") {
+			key := os.Getenv(fmt.Sprintf("%sHEADER_%d_KEY", prefix, headerIndex))
+			if key == "" {
+				continue
+			}
+
+			config.Headers[key] = os.Getenv(fmt.Sprintf("%sHEADER_%d_VALUE", prefix, headerIndex))
+		}
+
+		config.Auth = authConfigFromEnvironment(prefix + "AUTH_")
+		config.TLS = tlsConfigFromEnvironment(prefix + "TLS_")
+
+		configs = append(configs, config)
+	}
+
+	return configs
+}
+
+// authConfigFromEnvironment reads the token acquisition of a request, nil if no type is set.
+func authConfigFromEnvironment(prefix string) *AuthConfig {
+	if os.Getenv(prefix+"TYPE") == "" {
+		return nil
+	}
+
+	config := &AuthConfig{
+		Type:             os.Getenv(prefix + "TYPE"),
+		TokenURL:         os.Getenv(prefix + "TOKEN_URL"),
+		ClientID:         os.Getenv(prefix + "CLIENT_ID"),
+		ClientSecret:     os.Getenv(prefix + "CLIENT_SECRET"),
+		ClientSecretFile: os.Getenv(prefix + "CLIENT_SECRET_FILE"),
+		ClientAuth:       os.Getenv(prefix + "CLIENT_AUTH"),
+		Scopes:           os.Getenv(prefix + "SCOPES"),
+		LoginURL:         os.Getenv(prefix + "LOGIN_URL"),
+		LoginMethod:      os.Getenv(prefix + "LOGIN_METHOD"),
+		LoginBody:        os.Getenv(prefix + "LOGIN_BODY"),
+		LoginHeaders:     make(map[string]string),
+		TokenJSONPath:    os.Getenv(prefix + "TOKEN_JSON_PATH"),
+		TokenHeader:      os.Getenv(prefix + "TOKEN_HEADER"),
+		TokenTTL:         os.Getenv(prefix + "TOKEN_TTL"),
+		Header:           os.Getenv(prefix + "HEADER"),
+	}
+
+	if authPrefix, ok := os.LookupEnv(prefix + "PREFIX"); ok {
+		config.Prefix = &authPrefix
+	}
+
+	for _, headerIndex := range envIndexes(prefix+"LOGIN_HEADER_", "_KEY") {
+		key := os.Getenv(fmt.Sprintf("%sLOGIN_HEADER_%d_KEY", prefix, headerIndex))
+		if key == "" {
+			continue
+		}
+
+		config.LoginHeaders[key] = os.Getenv(fmt.Sprintf("%sLOGIN_HEADER_%d_VALUE", prefix, headerIndex))
+	}
+
+	return config
+}
+
+// tlsConfigFromEnvironment reads the TLS settings of a request.
+func tlsConfigFromEnvironment(prefix string) TLSConfig {
+	config := TLSConfig{
+		CAFile:     os.Getenv(prefix + "CA_FILE"),
+		CertFile:   os.Getenv(prefix + "CERT_FILE"),
+		KeyFile:    os.Getenv(prefix + "KEY_FILE"),
+		ServerName: os.Getenv(prefix + "SERVER_NAME"),
+		MinVersion: os.Getenv(prefix + "MIN_VERSION"),
+	}
+
+	for _, pin := range strings.Split(os.Getenv(prefix+"PINS"), ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			config.Pins = append(config.Pins, pin)
+		}
+	}
+
+	config.InsecureSkipVerify, _ = strconv.ParseBool(os.Getenv(prefix + "INSECURE_SKIP_VERIFY"))
+
+	return config
+}
+
+// mergeRequestConfigs adds the requests of the variables to those of the file, replacing file requests of the same name.
+func mergeRequestConfigs(file []RequestConfig, env []RequestConfig) []RequestConfig {
+	merged := append([]RequestConfig{}, file...)
+
+	for _, config := range env {
+		replaced := false
+
+		for i := range merged {
+			if merged[i].Name == config.Name {
+				log.WithField("http_request", config.Name).Info("HTTP request of the requests file is replaced by the environment")
+				merged[i] = config
+				replaced = true
+				break
+			}
+		}
+
+		if !replaced {
+			merged = append(merged, config)
+		}
+	}
+
+	return merged
+}
+
+// matcher compiles the success criteria.
+func (c ResponseConfig) matcher() (ResponseMatcher, error) {
+	var err error
+	matcher := ResponseMatcher{
+		JSONPath:  c.JSONPath,
+		JSONValue: c.JSONValue,
+	}
+
+	if matcher.Status, err = parseStatusCodes(c.Status); err != nil {
+		return matcher, fmt.Errorf("success status: %w", err)
+	}
+
+	patterns := []struct {
+		name    string
+		value   string
+		pattern **regexp.Regexp
+	}{
+		{"success body", c.Body, &matcher.Body},
+		{"retry-on", c.RetryOn, &matcher.RetryOn},
+		{"fail-on", c.FailOn, &matcher.FailOn},
+	}
+
+	for _, p := range patterns {
+		if p.value == "" {
+			continue
+		}
+		if *p.pattern, err = regexp.Compile(p.value); err != nil {
+			return matcher, fmt.Errorf("%s pattern: %w", p.name, err)
+		}
+	}
+
+	return matcher, nil
+}
+
+// secretOf returns the secret read from the file, if set, or else the value.
+func secretOf(value string, file string) (*secrets.Secret, error) {
+	if file == "" {
+		return secrets.New(value), nil
+	}
+
+	return secrets.FromFile(file)
+}
+
+// build turns the definition into a request, applying the defaults and parsing its templates and success criteria.
+// Out of bounds settings fall back to their defaults with a warning.
+func (c RequestConfig) build() (HttpRequest, error) {
+	rlog := log.WithField("http_request", c.Name)
+
+	c, err := c.withPreset()
+	if err != nil {
+		return HttpRequest{Name: c.Name}, err
+	}
+
+	password, err := secretOf(c.Password, c.PasswordFile)
+	if err != nil {
+		return HttpRequest{Name: c.Name}, fmt.Errorf("failed to read password of HTTP request %s: %w", c.Name, err)
+	}
+	token, err := secretOf(c.Token, c.TokenFile)
+	if err != nil {
+		return HttpRequest{Name: c.Name}, fmt.Errorf("failed to read token of HTTP request %s: %w", c.Name, err)
+	}
+
+	httpRequest := HttpRequest{
+		Name:       c.Name,
+		Url:        c.Url,
+		Method:     c.Method,
+		Body:       c.Body,
+		Username:   c.Username,
+		Password:   password,
+		BasicAuth:  c.BasicAuth && c.Username != "" && password.IsSet(),
+		Timeout:    defaultTimeout,
+		RetryCount: defaultRetryCount,
+		Onipv4:     true,
+		Onipv6:     false,
+		Headers:    c.Headers,
+		Hostname:   c.Hostname,
+		Token:      token,
+		DualStack:  c.DualStack,
+		Settle:     defaultSettle,
+	}
+
+	if httpRequest.Url == "" {
+		return httpRequest, fmt.Errorf("HTTP request %s has no URL", c.Name)
+	}
+	if httpRequest.Method == "" {
+		httpRequest.Method = "GET"
+	}
+	if httpRequest.Headers == nil {
+		httpRequest.Headers = make(map[string]string)
+	}
+
+	// 5 retries is around 30 seconds retry time, each additional retry is extra 30s
+	// 7 retries or about a minute and a half retry time seems like a reasonable default and 14 or 5 minutes seems like a reasonable max
+	if c.RetryCount != nil {
+		if *c.RetryCount < 0 || *c.RetryCount > maxRetryCount {
+			rlog.WithError(fmt.Errorf("value %d outside bounds [0, %d]", *c.RetryCount, maxRetryCount)).Warn(
+				fmt.Sprintf("Invalid retry count, using default value %d", fallbackRetry))
+			httpRequest.RetryCount = fallbackRetry
+		} else {
+			httpRequest.RetryCount = uint(*c.RetryCount)
+		}
+	}
+
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil || timeout < minTimeout || timeout > maxTimeout {
+			if err == nil {
+				err = fmt.Errorf("value %s outside bounds [%s, %s]", timeout, minTimeout, maxTimeout)
+			}
+			rlog.WithError(err).Warn(fmt.Sprintf("Failed to parse timeout, using default value %s", defaultTimeout))
+		} else {
+			httpRequest.Timeout = timeout
+		}
+	}
+
+	if c.Settle != "" {
+		settle, err := time.ParseDuration(c.Settle)
+		if err != nil || settle < 0 || settle > maxSettle {
+			if err == nil {
+				err = fmt.Errorf("value %s outside bounds [0s, %s]", settle, maxSettle)
+			}
+			rlog.WithError(err).Warn(fmt.Sprintf("Failed to parse settle window, using default value %s", defaultSettle))
+		} else {
+			httpRequest.Settle = settle
+		}
+	}
+
+	if c.OnIPv4 != nil {
+		httpRequest.Onipv4 = *c.OnIPv4
+	}
+	if c.OnIPv6 != nil {
+		httpRequest.Onipv6 = *c.OnIPv6
+	}
+	if httpRequest.Onipv6 && !httpRequest.DualStack && !c.separateFamilies {
+		httpRequest.Onipv4 = false
+	}
+
+	if httpRequest.Success, err = c.Success.matcher(); err != nil {
+		return httpRequest, fmt.Errorf("invalid response matchers of HTTP request %s: %w", c.Name, err)
+	}
+
+	if httpRequest.templates, err = parseTemplates(httpRequest); err != nil {
+		return httpRequest, fmt.Errorf("invalid templates of HTTP request %s: %w", c.Name, err)
+	}
+
+	if httpRequest.tls, err = c.TLS.build(); err != nil {
+		return httpRequest, fmt.Errorf("invalid TLS settings of HTTP request %s: %w", c.Name, err)
+	}
+	if c.TLS.InsecureSkipVerify {
+		rlog.Warn("TLS certificate verification is turned off, the request is open to interception")
+	}
+
+	if c.Auth != nil {
+		if httpRequest.auth, err = newTokenSource(*c.Auth); err != nil {
+			return httpRequest, fmt.Errorf("invalid auth of HTTP request %s: %w", c.Name, err)
+		}
+	}
+
+	// dual-stack requests are sent on changes of both families, unless turned off explicitly
+	if httpRequest.DualStack {
+		if c.OnIPv6 == nil {
+			httpRequest.Onipv6 = true
+		}
+		return httpRequest, nil
+	}
+
+	// a request using an address of one family is only executed on updates of that family, IPv4 has priority
+	if httpRequest.Onipv4 || httpRequest.Onipv6 {
+		texts := []string{httpRequest.Url, httpRequest.Body}
+		for _, headerValue := range httpRequest.Headers {
+			texts = append(texts, headerValue)
+		}
+		for i := range texts {
+			texts[i] = convertLegacyPlaceholders(texts[i])
+		}
+
+		if containsAny(texts, ".IPv4") {
+			httpRequest.Onipv4 = true
+			httpRequest.Onipv6 = false
+		} else if containsAny(texts, ".IPv6", ".Prefix") {
+			httpRequest.Onipv4 = false
+			httpRequest.Onipv6 = true
+		}
+	}
+
+	return httpRequest, nil
+}
@@ -0,0 +1,84 @@
+package http_requests
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadRequestConfigs(t *testing.T) {
+	retryCount := 3
+	want := []RequestConfig{{
+		Name:       "status-page",
+		Url:        "https://status.example.com/api/ip",
+		Method:     "POST",
+		Headers:    map[string]string{"X-Api-Key": "{{.Password}}"},
+		RetryCount: &retryCount,
+		Success:    ResponseConfig{Status: "200"},
+		TLS:        TLSConfig{Pins: []string{"sha256/AAAA"}},
+	}}
+
+	files := map[string]string{
+		"requests.json": `{"requests": [{"name": "status-page", "url": "https://status.example.com/api/ip", "method": "POST",
+			"headers": {"X-Api-Key": "{{.Password}}"}, "retryCount": 3, "success": {"status": "200"},
+			"tls": {"pins": ["sha256/AAAA"]}}]}`,
+		"requests.yml": `
+requests:
+  - name: status-page
+    url: https://status.example.com/api/ip
+    method: POST
+    headers:
+      X-Api-Key: "{{.Password}}"
+    retryCount: 3
+    success:
+      status: 200
+    tls:
+      pins: [sha256/AAAA]
+`,
+		"requests.toml": `
+[[requests]]
+name = "status-page"
+url = "https://status.example.com/api/ip"
+method = "POST"
+headers = { X-Api-Key = "{{.Password}}" }
+retryCount = 3
+success.status = "200"
+tls.pins = ["sha256/AAAA"]
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			configs, err := loadRequestConfigs(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(configs, want) {
+				t.Errorf("loaded %+v, want %+v", configs, want)
+			}
+		})
+	}
+
+	for name, content := range map[string]string{
+		"typo.yaml": "requests:\n  - name: x\n    retryCuont: 3\n",
+		"typo.toml": "[[requests]]\nname = \"x\"\n[requests.success]\nstatsu = \"200\"\n",
+		"name.yaml": "requests:\n  - url: https://example.com\n",
+	} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := loadRequestConfigs(path); err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("%s: error %v, want the file rejected", name, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package http_requests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// maxMatchedBody limits how much of a response body is read for the matchers
+const maxMatchedBody = 1 << 20
+
+// statusRange is an inclusive range of status codes
+type statusRange struct {
+	min int
+	max int
+}
+
+// defaultSuccessStatus is used if a request does not define its own success status codes
+var defaultSuccessStatus = []statusRange{{200, 299}}
+
+// ResponseMatcher decides if the response of a request counts as success, as a failure to retry or as a final failure.
+type ResponseMatcher struct {
+	// Status codes counting as success, defaults to 2xx
+	Status []statusRange
+	// Body has to match the response body, if set
+	Body *regexp.Regexp
+	// JSONPath selects a value of the JSON response that has to equal JSONValue, if set
+	JSONPath  string
+	JSONValue string
+	// RetryOn marks a response body as temporary failure, FailOn as final failure, both win over the success criteria
+	RetryOn *regexp.Regexp
+	FailOn  *regexp.Regexp
+}
+
+// parseStatusCodes parses a comma-separated list of status codes, ranges like 200-204 and classes like 2xx.
+func parseStatusCodes(list string) ([]statusRange, error) {
+	var ranges []statusRange
+
+	for _, value := range strings.Split(list, ",") {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+
+		if len(value) == 3 && strings.HasSuffix(value, "xx") && value[0] >= '1' && value[0] <= '5' {
+			class := int(value[0]-'0') * 100
+			ranges = append(ranges, statusRange{class, class + 99})
+			continue
+		}
+
+		bounds := strings.SplitN(value, "-", 2)
+
+		min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code %q", value)
+		}
+
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil || max < min {
+				return nil, fmt.Errorf("invalid status code range %q", value)
+			}
+		}
+
+		ranges = append(ranges, statusRange{min, max})
+	}
+
+	return ranges, nil
+}
+
+func (m *ResponseMatcher) matchesStatus(code int) bool {
+	ranges := m.Status
+	if len(ranges) == 0 {
+		ranges = defaultSuccessStatus
+	}
+
+	for _, r := range ranges {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+
+	return false
+}
+
+// finalError is returned for responses matching FailOn, the request must not be sent again for the same update.
+type finalError struct {
+	error
+}
+
+// check evaluates a response, returning if it should be retried and why it is not a success.
+func (m *ResponseMatcher) check(statusCode int, body []byte) (bool, error) {
+	if m.FailOn != nil && m.FailOn.Match(body) {
+		return false, finalError{fmt.Errorf("response body matches fail-on pattern %q", m.FailOn.String())}
+	}
+
+	if m.RetryOn != nil && m.RetryOn.Match(body) {
+		return true, fmt.Errorf("response body matches retry-on pattern %q", m.RetryOn.String())
+	}
+
+	if !m.matchesStatus(statusCode) {
+		err := fmt.Errorf("unexpected response status %d", statusCode)
+		// rate limits and server errors are temporary, just like retryablehttp considers them
+		retry := statusCode == http.StatusTooManyRequests || (statusCode >= 500 && statusCode != http.StatusNotImplemented)
+		return retry, err
+	}
+
+	if m.Body != nil && !m.Body.Match(body) {
+		return false, fmt.Errorf("response body does not match %q", m.Body.String())
+	}
+
+	if m.JSONPath != "" {
+		value, err := jsonPathValue(body, m.JSONPath)
+		if err != nil {
+			return false, err
+		}
+		if value != m.JSONValue {
+			return false, fmt.Errorf("response value of %s is %s instead of %s", m.JSONPath, value, m.JSONValue)
+		}
+	}
+
+	return false, nil
+}
+
+// checkRetry implements retryablehttp.CheckRetry. The response body is read for the matchers and replaced by a
+// buffered copy, so it can still be logged and returned.
+func (m *ResponseMatcher) checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if ctx.Err() != nil || err != nil || resp == nil {
+		return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMatchedBody))
+	_ = resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err != nil {
+		return true, fmt.Errorf("reading response body failed: %w", err)
+	}
+
+	return m.check(resp.StatusCode, body)
+}
+
+// jsonPathValue returns the value at the dot-separated path of the JSON document, i.e. "result.0.status". Strings
+// are returned as is, all other values in their JSON encoding.
+func jsonPathValue(body []byte, path string) (string, error) {
+	var value interface{}
+
+	if err := json.Unmarshal(body, &value); err != nil {
+		return "", fmt.Errorf("response is not valid JSON: %w", err)
+	}
+
+	for _, key := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(path, "$"), "."), ".") {
+		if key == "" {
+			continue
+		}
+
+		switch current := value.(type) {
+		case map[string]interface{}:
+			v, ok := current[key]
+			if !ok {
+				return "", fmt.Errorf("response has no value at %s", path)
+			}
+			value = v
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(current) {
+				return "", fmt.Errorf("response has no value at %s", path)
+			}
+			value = current[index]
+		default:
+			return "", fmt.Errorf("response has no value at %s", path)
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	encoded, err := json.Marshal(value)
+
+	return string(encoded), err
+}
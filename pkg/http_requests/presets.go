@@ -0,0 +1,205 @@
+package http_requests
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Families a preset is sent for
+const (
+	// presetDualStack sends a single dual-stack request with both addresses
+	presetDualStack = "dual"
+	// presetSeparate sends a request per family, IPv4 and IPv6 by default
+	presetSeparate = "separate"
+	// presetIPv4 only sends IPv4 updates
+	presetIPv4 = "ipv4"
+)
+
+// presetUserAgent identifies the service to providers requiring a user agent
+const presetUserAgent = "router-dyndns-helper"
+
+// dyndns2Response parses the return codes of the dyndns2 protocol, 911 and dnserr are temporary failures
+var dyndns2Response = ResponseConfig{
+	Body:    `^(good|nochg)`,
+	RetryOn: `^(911|dnserr)`,
+	FailOn:  `^(badauth|!donator|notfqdn|nohost|numhost|abuse|badagent|badsys|!yours)`,
+}
+
+// preset of a DynDNS provider, expanded into a request definition
+type preset struct {
+	url       string
+	families  string
+	basicAuth bool
+	headers   map[string]string
+	success   ResponseConfig
+	// required fields of the definition
+	requires []string
+	// credentials defaulting to other fields, i.e. the host name as user name
+	usernameFrom string
+	passwordFrom string
+}
+
+// presets by the name used in the PRESET variable or the preset field of the requests file
+var presets = map[string]preset{
+	"duckdns": {
+		url:      "https://www.duckdns.org/update?domains={{urlquery .Hostname}}&token={{urlquery .Token}}{{if .IPv4}}&ip={{.IPv4}}{{end}}{{if .IPv6}}&ipv6={{.IPv6}}{{end}}",
+		families: presetDualStack,
+		success:  ResponseConfig{Body: `^OK`, FailOn: `^KO`},
+		requires: []string{"hostname", "token"},
+	},
+	"dynv6": {
+		url:      "https://dynv6.com/api/update?hostname={{urlquery .Hostname}}&token={{urlquery .Token}}{{if .IPv4}}&ipv4={{.IPv4}}{{end}}{{if .IPv6}}&ipv6={{.IPv6}}{{end}}{{if .Prefix}}&ipv6prefix={{urlquery .Prefix}}{{end}}",
+		families: presetDualStack,
+		success:  ResponseConfig{Status: "2xx", Body: `^addresses (updated|unchanged)`},
+		requires: []string{"hostname", "token"},
+	},
+	"desec": {
+		url:          "https://update.dedyn.io/?hostname={{urlquery .Hostname}}&myipv4={{if .IPv4}}{{.IPv4}}{{else}}preserve{{end}}&myipv6={{if .IPv6}}{{.IPv6}}{{else}}preserve{{end}}",
+		families:     presetDualStack,
+		basicAuth:    true,
+		success:      ResponseConfig{Status: "2xx", Body: `^good`},
+		requires:     []string{"hostname", "token"},
+		usernameFrom: "hostname",
+		passwordFrom: "token",
+	},
+	"noip": {
+		url:       "https://dynupdate.no-ip.com/nic/update?hostname={{urlquery .Hostname}}&myip={{.IPv4}}{{if and .IPv4 .IPv6}},{{end}}{{.IPv6}}",
+		families:  presetDualStack,
+		basicAuth: true,
+		headers:   map[string]string{"User-Agent": presetUserAgent},
+		success:   dyndns2Response,
+		requires:  []string{"hostname", "username", "password"},
+	},
+	"freedns": {
+		url:      `https://{{if eq .Family "ipv6"}}v6.{{end}}sync.afraid.org/u/{{.Token}}/?ip={{.IP}}`,
+		families: presetSeparate,
+		success:  ResponseConfig{Body: `^(Updated|No IP change)`, FailOn: `^ERROR`},
+		requires: []string{"token"},
+	},
+	"he": {
+		url:          "https://dyn.dns.he.net/nic/update?hostname={{urlquery .Hostname}}&myip={{.IP}}",
+		families:     presetSeparate,
+		basicAuth:    true,
+		success:      dyndns2Response,
+		requires:     []string{"hostname", "token"},
+		usernameFrom: "hostname",
+		passwordFrom: "token",
+	},
+	"he-tunnel": {
+		url:          "https://ipv4.tunnelbroker.net/nic/update?hostname={{urlquery .Hostname}}&myip={{.IPv4}}",
+		families:     presetIPv4,
+		basicAuth:    true,
+		success:      dyndns2Response,
+		requires:     []string{"hostname", "username", "password"},
+		passwordFrom: "token",
+	},
+	"dynu": {
+		url:       "https://api.dynu.com/nic/update?hostname={{urlquery .Hostname}}&myip={{if .IPv4}}{{.IPv4}}{{else}}no{{end}}&myipv6={{if .IPv6}}{{.IPv6}}{{else}}no{{end}}",
+		families:  presetDualStack,
+		basicAuth: true,
+		headers:   map[string]string{"User-Agent": presetUserAgent},
+		success:   dyndns2Response,
+		requires:  []string{"hostname", "username", "password"},
+	},
+}
+
+// presetNames lists the available presets for error messages.
+func presetNames() string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+func (c RequestConfig) field(name string) string {
+	switch name {
+	case "hostname":
+		return c.Hostname
+	case "token":
+		return c.Token
+	case "username":
+		return c.Username
+	case "password":
+		return c.Password
+	}
+
+	return ""
+}
+
+// fileOf returns the file a secret field is read from, if any.
+func (c RequestConfig) fileOf(name string) string {
+	switch name {
+	case "token":
+		return c.TokenFile
+	case "password":
+		return c.PasswordFile
+	}
+
+	return ""
+}
+
+// withPreset expands the preset of the definition. Fields set in the definition win over those of the preset, the
+// success criteria of the preset are only used if the definition has none.
+func (c RequestConfig) withPreset() (RequestConfig, error) {
+	if c.Preset == "" {
+		return c, nil
+	}
+
+	p, ok := presets[strings.ToLower(c.Preset)]
+	if !ok {
+		return c, fmt.Errorf("unknown preset %q of HTTP request %s, available are %s", c.Preset, c.Name, presetNames())
+	}
+
+	if c.Username == "" && p.usernameFrom != "" {
+		c.Username = c.field(p.usernameFrom)
+	}
+	if c.Password == "" && c.PasswordFile == "" && p.passwordFrom != "" {
+		c.Password = c.field(p.passwordFrom)
+		c.PasswordFile = c.fileOf(p.passwordFrom)
+	}
+
+	for _, name := range p.requires {
+		if c.field(name) == "" && c.fileOf(name) == "" {
+			return c, fmt.Errorf("preset %s of HTTP request %s requires a %s", c.Preset, c.Name, name)
+		}
+	}
+
+	if c.Url == "" {
+		c.Url = p.url
+	}
+	if p.basicAuth {
+		c.BasicAuth = true
+	}
+	if c.Success == (ResponseConfig{}) {
+		c.Success = p.success
+	}
+
+	headers := make(map[string]string)
+	for key, value := range p.headers {
+		headers[key] = value
+	}
+	for key, value := range c.Headers {
+		headers[key] = value
+	}
+	c.Headers = headers
+
+	switch p.families {
+	case presetDualStack:
+		c.DualStack = true
+	case presetSeparate:
+		c.separateFamilies = true
+		on := true
+		if c.OnIPv4 == nil {
+			c.OnIPv4 = &on
+		}
+		if c.OnIPv6 == nil {
+			c.OnIPv6 = &on
+		}
+	}
+
+	return c, nil
+}
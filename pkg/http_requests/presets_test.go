@@ -0,0 +1,318 @@
+package http_requests
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+	log "github.com/sirupsen/logrus"
+)
+
+// standIn answers every request with the status and body and records the last request it received.
+type standIn struct {
+	server   *httptest.Server
+	status   int
+	body     string
+	uri      string
+	username string
+	password string
+	header   http.Header
+}
+
+func newStandIn(t *testing.T, status int, body string) *standIn {
+	s := &standIn{status: status, body: body}
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.uri = r.URL.RequestURI()
+		s.username, s.password, _ = r.BasicAuth()
+		s.header = r.Header
+		w.WriteHeader(s.status)
+		_, _ = w.Write([]byte(s.body))
+	}))
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+// pointAt replaces scheme and host of the preset URL with the stand-in, leaving path and query templates untouched.
+func (s *standIn) pointAt(t *testing.T, httpRequest HttpRequest) HttpRequest {
+	rest := strings.SplitN(strings.TrimPrefix(httpRequest.Url, "https://"), "/", 2)
+	if len(rest) != 2 {
+		t.Fatalf("unexpected preset URL %s", httpRequest.Url)
+	}
+
+	httpRequest.Url = s.server.URL + "/" + rest[1]
+	httpRequest.RetryCount = 0
+
+	var err error
+	if httpRequest.templates, err = parseTemplates(httpRequest); err != nil {
+		t.Fatal(err)
+	}
+
+	return httpRequest
+}
+
+func testLog() *log.Entry {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	return log.NewEntry(logger)
+}
+
+// withRequest adds the fields of the request to the data, just like the updater does.
+func withRequest(httpRequest HttpRequest, data TemplateData) TemplateData {
+	data.Hostname = httpRequest.Hostname
+	data.Username = httpRequest.Username
+	data.Password = httpRequest.Password.Value()
+	data.Token = httpRequest.Token.Value()
+
+	return data
+}
+
+func send(httpRequest HttpRequest, data TemplateData) ResponseResult {
+	return <-doRequest(httpRequest, withRequest(httpRequest, data), false, testLog())
+}
+
+var dualStackData = TemplateData{IP: "192.0.2.1", Family: "ipv4", IPv4: "192.0.2.1", IPv6: "2001:db8::1"}
+
+func TestPresets(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    RequestConfig
+		data      TemplateData
+		response  string
+		uri       string
+		username  string
+		password  string
+		dualStack bool
+		ipv4      bool
+		ipv6      bool
+	}{
+		{
+			name:      "duckdns",
+			config:    RequestConfig{Preset: "duckdns", Hostname: "home", Token: "t0k"},
+			data:      dualStackData,
+			response:  "OK",
+			uri:       "/update?domains=home&token=t0k&ip=192.0.2.1&ipv6=2001:db8::1",
+			dualStack: true, ipv4: true, ipv6: true,
+		},
+		{
+			name:      "dynv6",
+			config:    RequestConfig{Preset: "dynv6", Hostname: "home.dynv6.net", Token: "t0k"},
+			data:      TemplateData{IP: "2001:db8::1", Family: "ipv6", IPv6: "2001:db8::1", Prefix: "2001:db8::/56"},
+			response:  "addresses updated",
+			uri:       "/api/update?hostname=home.dynv6.net&token=t0k&ipv6=2001:db8::1&ipv6prefix=2001%3Adb8%3A%3A%2F56",
+			dualStack: true, ipv4: true, ipv6: true,
+		},
+		{
+			name:      "desec",
+			config:    RequestConfig{Preset: "desec", Hostname: "home.dedyn.io", Token: "t0k"},
+			data:      TemplateData{IP: "192.0.2.1", Family: "ipv4", IPv4: "192.0.2.1"},
+			response:  "good",
+			uri:       "/?hostname=home.dedyn.io&myipv4=192.0.2.1&myipv6=preserve",
+			username:  "home.dedyn.io",
+			password:  "t0k",
+			dualStack: true, ipv4: true, ipv6: true,
+		},
+		{
+			name:      "noip",
+			config:    RequestConfig{Preset: "noip", Hostname: "home.ddns.net", Username: "user", Password: "pass"},
+			data:      dualStackData,
+			response:  "good 192.0.2.1",
+			uri:       "/nic/update?hostname=home.ddns.net&myip=192.0.2.1,2001:db8::1",
+			username:  "user",
+			password:  "pass",
+			dualStack: true, ipv4: true, ipv6: true,
+		},
+		{
+			name:     "freedns",
+			config:   RequestConfig{Preset: "freedns", Token: "t0k"},
+			data:     TemplateData{IP: "192.0.2.1", Family: "ipv4", IPv4: "192.0.2.1"},
+			response: "Updated 1 host(s) home.mooo.com to 192.0.2.1 in 0.1 seconds",
+			uri:      "/u/t0k/?ip=192.0.2.1",
+			ipv4:     true, ipv6: true,
+		},
+		{
+			name:     "he",
+			config:   RequestConfig{Preset: "he", Hostname: "home.example.com", Token: "key"},
+			data:     TemplateData{IP: "2001:db8::1", Family: "ipv6", IPv6: "2001:db8::1"},
+			response: "nochg 2001:db8::1",
+			uri:      "/nic/update?hostname=home.example.com&myip=2001:db8::1",
+			username: "home.example.com",
+			password: "key",
+			ipv4:     true, ipv6: true,
+		},
+		{
+			name:     "he-tunnel",
+			config:   RequestConfig{Preset: "he-tunnel", Hostname: "123456", Username: "user", Token: "key"},
+			data:     TemplateData{IP: "192.0.2.1", Family: "ipv4", IPv4: "192.0.2.1"},
+			response: "good 192.0.2.1",
+			uri:      "/nic/update?hostname=123456&myip=192.0.2.1",
+			username: "user",
+			password: "key",
+			ipv4:     true,
+		},
+		{
+			name:      "dynu",
+			config:    RequestConfig{Preset: "dynu", Hostname: "home.dynu.net", Username: "user", Password: "pass"},
+			data:      TemplateData{IP: "192.0.2.1", Family: "ipv4", IPv4: "192.0.2.1"},
+			response:  "good",
+			uri:       "/nic/update?hostname=home.dynu.net&myip=192.0.2.1&myipv6=no",
+			username:  "user",
+			password:  "pass",
+			dualStack: true, ipv4: true, ipv6: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Name = test.name
+
+			httpRequest, err := test.config.build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if httpRequest.DualStack != test.dualStack || httpRequest.Onipv4 != test.ipv4 || httpRequest.Onipv6 != test.ipv6 {
+				t.Errorf("dual-stack %t, ipv4 %t, ipv6 %t, want %t, %t, %t", httpRequest.DualStack, httpRequest.Onipv4,
+					httpRequest.Onipv6, test.dualStack, test.ipv4, test.ipv6)
+			}
+
+			server := newStandIn(t, http.StatusOK, test.response)
+			result := send(server.pointAt(t, httpRequest), test.data)
+
+			if result.Error != nil {
+				t.Fatalf("request failed: %v", result.Error)
+			}
+
+			if server.uri != test.uri {
+				t.Errorf("requested %s, want %s", server.uri, test.uri)
+			}
+
+			if server.username != test.username || server.password != test.password {
+				t.Errorf("basic auth %s:%s, want %s:%s", server.username, server.password, test.username, test.password)
+			}
+		})
+	}
+}
+
+func TestPresetFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   RequestConfig
+		status   int
+		response string
+		// final failures match the fail-on pattern and are not retried
+		final bool
+	}{
+		{"duckdns KO", RequestConfig{Preset: "duckdns", Hostname: "home", Token: "t0k"}, http.StatusOK, "KO", true},
+		{"dynv6 bad token", RequestConfig{Preset: "dynv6", Hostname: "home.dynv6.net", Token: "t0k"}, http.StatusUnauthorized, "invalid authentication token", false},
+		{"desec bad auth", RequestConfig{Preset: "desec", Hostname: "home.dedyn.io", Token: "t0k"}, http.StatusUnauthorized, "badauth", false},
+		{"noip badauth", RequestConfig{Preset: "noip", Hostname: "home.ddns.net", Username: "user", Password: "pass"}, http.StatusOK, "badauth", true},
+		{"noip 911", RequestConfig{Preset: "noip", Hostname: "home.ddns.net", Username: "user", Password: "pass"}, http.StatusOK, "911", false},
+		{"freedns error", RequestConfig{Preset: "freedns", Token: "t0k"}, http.StatusOK, "ERROR: Unable to locate this record", true},
+		{"he nohost", RequestConfig{Preset: "he", Hostname: "home.example.com", Token: "key"}, http.StatusOK, "nohost", true},
+		{"he-tunnel abuse", RequestConfig{Preset: "he-tunnel", Hostname: "123456", Username: "user", Password: "key"}, http.StatusOK, "abuse", true},
+		{"dynu notfqdn", RequestConfig{Preset: "dynu", Hostname: "home.dynu.net", Username: "user", Password: "pass"}, http.StatusOK, "notfqdn", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Name = test.name
+
+			httpRequest, err := test.config.build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server := newStandIn(t, test.status, test.response)
+			result := send(server.pointAt(t, httpRequest), dualStackData)
+
+			if result.Error == nil {
+				t.Fatalf("response %d %q counted as success", test.status, test.response)
+			}
+
+			if string(result.Response) != test.response {
+				t.Errorf("logged response %q, want %q", result.Response, test.response)
+			}
+
+			if result.Final != test.final {
+				t.Errorf("final %t, want %t", result.Final, test.final)
+			}
+		})
+	}
+}
+
+func TestPresetValidation(t *testing.T) {
+	if _, err := (RequestConfig{Name: "x", Preset: "unknown"}).build(); err == nil {
+		t.Error("unknown preset accepted")
+	}
+
+	if _, err := (RequestConfig{Name: "x", Preset: "duckdns", Hostname: "home"}).build(); err == nil {
+		t.Error("preset without token accepted")
+	}
+}
+
+func TestPresetOverrides(t *testing.T) {
+	config := RequestConfig{
+		Name:     "x",
+		Preset:   "duckdns",
+		Hostname: "home",
+		Token:    "t0k",
+		Url:      "https://example.com/{{.Hostname}}",
+		Success:  ResponseConfig{Body: "^done"},
+	}
+
+	httpRequest, err := config.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if httpRequest.Url != config.Url {
+		t.Errorf("URL %s, want %s", httpRequest.Url, config.Url)
+	}
+
+	server := newStandIn(t, http.StatusOK, "OK")
+	if result := send(server.pointAt(t, httpRequest), dualStackData); result.Error == nil {
+		t.Error("success criteria of the preset used instead of those of the definition")
+	}
+}
+
+func TestPresetTokenRedacted(t *testing.T) {
+	httpRequest, err := (RequestConfig{Name: "x", Preset: "duckdns", Hostname: "home", Token: "s3cret"}).build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-doRequest(httpRequest, withRequest(httpRequest, dualStackData), true, testLog())
+
+	if strings.Contains(string(result.Response), "s3cret") || !strings.Contains(string(result.Response), "token="+url.QueryEscape(secrets.Redacted)) {
+		t.Errorf("token not redacted in the dry run log: %s", result.Response)
+	}
+}
+
+func TestPresetTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte("t0k\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	httpRequest, err := (RequestConfig{Name: "x", Preset: "desec", Hostname: "home.dedyn.io", TokenFile: path}).build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newStandIn(t, http.StatusOK, "good")
+	if result := send(server.pointAt(t, httpRequest), dualStackData); result.Error != nil {
+		t.Fatalf("request failed: %v", result.Error)
+	}
+
+	if server.password != "t0k" {
+		t.Errorf("basic auth password %q, want the token of the file", server.password)
+	}
+}
@@ -4,43 +4,142 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/http/httputil"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
 type ResponseResult struct {
-	RequestIndex   int
+	RequestName    string
 	ResponseStatus string
 	Response       []byte
 	Error          error
+	DryRun         bool
+	// Final failures are not retried, the response matched the fail-on pattern
+	Final bool
 }
 
 type RequestLogger struct {
 	log                   *log.Entry
-	httpRequestIndex      int
+	httpRequestName       string
 	httpRequestUrl        string
 	httpRequestBody       string
 	httpRequestUrlForLog  string
 	httpRequestBodyForLog string
+	// httpRequestHeadersForLog are the header values rendered with the credentials redacted
+	httpRequestHeadersForLog map[string]string
+	// httpRequestSecrets are replaced wherever they show up in logs
+	httpRequestSecrets []string
+}
+
+// redactedHeaders never have their values rendered into logs
+var redactedHeaders = map[string]struct{}{
+	"Authorization":       {},
+	"Proxy-Authorization": {},
+	"Cookie":              {},
+	"X-Api-Key":           {},
+	"X-Auth-Key":          {},
+	"X-Auth-Token":        {},
 }
 
 func (requestLogger RequestLogger) prepareMessageForLog(logMessage string) string {
 	logMessage = strings.ReplaceAll(logMessage, requestLogger.httpRequestUrl, requestLogger.httpRequestUrlForLog)
 	//logMessage = strings.ReplaceAll(logMessage, requestLogger.httpRequestBody, requestLogger.httpRequestBodyForLog) // not really useful in this context and might produce incorrect logs
-	return logMessage
+	return requestLogger.redactSecrets(logMessage)
 }
 
 func (requestLogger RequestLogger) prepareErrorForLog(logError error) error {
 	return fmt.Errorf(requestLogger.prepareMessageForLog(logError.Error()))
 }
 
+// describeRequest renders the final request (method, URL, headers and body) with credentials redacted.
+func (requestLogger RequestLogger) describeRequest(request *retryablehttp.Request) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("%s %s\n", request.Method, requestLogger.httpRequestUrlForLog))
+
+	headerKeys := make([]string, 0, len(request.Header))
+	for headerKey := range request.Header {
+		headerKeys = append(headerKeys, headerKey)
+	}
+	sort.Strings(headerKeys)
+
+	for _, headerKey := range headerKeys {
+		for _, headerValue := range request.Header[headerKey] {
+			if _, ok := redactedHeaders[http.CanonicalHeaderKey(headerKey)]; ok {
+				headerValue = secrets.Redacted
+			} else if headerValueForLog, ok := requestLogger.headerForLog(headerKey); ok {
+				headerValue = headerValueForLog
+			} else {
+				headerValue = requestLogger.redactSecrets(headerValue)
+			}
+			sb.WriteString(fmt.Sprintf("%s: %s\n", headerKey, headerValue))
+		}
+	}
+
+	sb.WriteString(fmt.Sprintf("\n%s", requestLogger.httpRequestBodyForLog))
+
+	return sb.String()
+}
+
+// secretsOf lists the credentials of the data that must not show up in logs.
+func secretsOf(data TemplateData) []string {
+	var secrets []string
+
+	for _, secret := range []string{data.Password, data.Token, data.AuthToken} {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets
+}
+
+func (requestLogger RequestLogger) redactSecrets(text string) string {
+	for _, secret := range requestLogger.httpRequestSecrets {
+		text = strings.ReplaceAll(text, secret, secrets.Redacted)
+	}
+
+	return text
+}
+
+// redactDump redacts the values of the redacted headers and any secret in a request dump.
+func (requestLogger RequestLogger) redactDump(dump string) string {
+	lines := strings.Split(dump, "\r\n")
+
+	for i, line := range lines {
+		// the headers end with the first empty line
+		if line == "" {
+			break
+		}
+
+		if parts := strings.SplitN(line, ":", 2); len(parts) == 2 {
+			if _, ok := redactedHeaders[http.CanonicalHeaderKey(parts[0])]; ok {
+				lines[i] = parts[0] + ": " + secrets.Redacted
+			}
+		}
+	}
+
+	return requestLogger.redactSecrets(strings.Join(lines, "\r\n"))
+}
+
+func (requestLogger RequestLogger) headerForLog(headerKey string) (string, bool) {
+	for key, value := range requestLogger.httpRequestHeadersForLog {
+		if http.CanonicalHeaderKey(key) == http.CanonicalHeaderKey(headerKey) {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
 func (requestLogger RequestLogger) Printf(message string, args ...interface{}) {
 	if requestLogger.log == nil {
 		return
@@ -60,7 +159,7 @@ func (requestLogger RequestLogger) LogRequest(logger retryablehttp.Logger, httpR
 		requestLogger.log.WithError(err).Error("Dumping request for log failed")
 		return
 	}
-	dumpString := string(dumpBytes)
+	dumpString := requestLogger.redactDump(string(dumpBytes))
 	requestLogger.log.Trace(dumpString)
 }
 
@@ -75,99 +174,136 @@ func (requestLogger RequestLogger) LogResponse(logger retryablehttp.Logger, http
 		requestLogger.log.WithError(err).Error("Dumping response for log failed")
 		return
 	}
-	dumpString := string(dumpBytes)
+	dumpString := requestLogger.redactSecrets(string(dumpBytes))
 	requestLogger.log.Trace(dumpString)
 }
 
-func doRequest(httpRequest HttpRequest, requestIndex int, ip *net.IP, log *log.Entry) chan ResponseResult {
+func doRequest(httpRequest HttpRequest, data TemplateData, dryRun bool, log *log.Entry) chan ResponseResult {
 	responseResult := make(chan ResponseResult)
 
 	if !httpRequest.Onipv4 && !httpRequest.Onipv6 {
 		return nil
 	}
-	if ip.To4() != nil && !httpRequest.Onipv4 {
+	if data.Family == "ipv4" && !httpRequest.Onipv4 {
 		return nil
 	}
-	if ip.To4() == nil && !httpRequest.Onipv6 {
+	if data.Family == "ipv6" && !httpRequest.Onipv6 {
 		return nil
 	}
 
-	if ip.To4() != nil {
-		for _, ip4AddrPlaceholder := range ip4AddrPlaceholders {
-			httpRequest.Url = strings.ReplaceAll(httpRequest.Url, ip4AddrPlaceholder, ip.String())
-			httpRequest.Body = strings.ReplaceAll(httpRequest.Body, ip4AddrPlaceholder, ip.String())
+	go func() {
+		result, unauthorized := sendRequest(httpRequest, data, dryRun, log)
+
+		// a cached token might have been revoked before it expired, acquire a new one and try once more
+		if unauthorized {
+			log.WithField("http_request", httpRequest.Name).Warn("HTTP request was rejected with the cached token, acquiring a new one")
+			httpRequest.auth.Invalidate()
+			result, _ = sendRequest(httpRequest, data, dryRun, log)
 		}
-	} else {
-		for _, ip6AddrPlaceholder := range ip6AddrPlaceholders {
-			httpRequest.Url = strings.ReplaceAll(httpRequest.Url, ip6AddrPlaceholder, ip.String())
-			httpRequest.Body = strings.ReplaceAll(httpRequest.Body, ip6AddrPlaceholder, ip.String())
+
+		responseResult <- result
+	}()
+
+	return responseResult
+}
+
+// sendRequest acquires the token if needed, renders and sends the request. It tells if the request carried a token
+// that was rejected with 401.
+func sendRequest(httpRequest HttpRequest, data TemplateData, dryRun bool, log *log.Entry) (ResponseResult, bool) {
+	if httpRequest.auth != nil {
+		if dryRun {
+			data.AuthToken = secrets.Redacted
+		} else {
+			token, err := httpRequest.auth.Token(data, &http.Client{Timeout: httpRequest.Timeout, Transport: tlsTransport(httpRequest.tls)})
+			if err != nil {
+				return ResponseResult{httpRequest.Name, "", nil, fmt.Errorf("acquiring token failed: %w", err), false, false}, false
+			}
+			data.AuthToken = token
 		}
 	}
-	httpRequestUrlForLog := httpRequest.Url
-	httpRequestBodyForLog := httpRequest.Body
-	for _, usernamePlaceholder := range usernamePlaceholders {
-		httpRequest.Url = strings.ReplaceAll(httpRequest.Url, usernamePlaceholder, httpRequest.Username)
-		httpRequest.Body = strings.ReplaceAll(httpRequest.Body, usernamePlaceholder, httpRequest.Username)
+
+	rendered, err := httpRequest.templates.render(data)
+	if err != nil {
+		return ResponseResult{httpRequest.Name, "", nil, fmt.Errorf("rendering request failed: %w", err), false, false}, false
 	}
-	for _, passwordPlaceholder := range passwordPlaceholders {
-		httpRequest.Url = strings.ReplaceAll(httpRequest.Url, passwordPlaceholder, httpRequest.Password)
-		httpRequest.Body = strings.ReplaceAll(httpRequest.Body, passwordPlaceholder, httpRequest.Password)
+	// rendered again with the credentials redacted, any error was already caught above
+	renderedForLog, _ := httpRequest.templates.render(data.redacted())
+
+	log.WithField("http_request", httpRequest.Name).Info(fmt.Sprintf("HTTP request: %s %s [%s]", httpRequest.Method, renderedForLog.Url, renderedForLog.Body))
+	requestLogger := RequestLogger{
+		log:                      log.WithFields(logrus.Fields{"submodule": "retryablehttp", "http_request": httpRequest.Name}),
+		httpRequestName:          httpRequest.Name,
+		httpRequestUrl:           rendered.Url,
+		httpRequestBody:          rendered.Body,
+		httpRequestUrlForLog:     renderedForLog.Url,
+		httpRequestBodyForLog:    renderedForLog.Body,
+		httpRequestHeadersForLog: renderedForLog.Headers,
+		httpRequestSecrets:       secretsOf(data),
 	}
 
-	log.WithField("http_request_index", requestIndex).Info(fmt.Sprintf("HTTP request: %s %s [%s]", httpRequest.Method, httpRequestUrlForLog, httpRequestBodyForLog))
-	requestLogger := &RequestLogger{
-		log:                   log.WithFields(logrus.Fields{"submodule": "retryablehttp", "http_request_index": requestIndex}),
-		httpRequestIndex:      requestIndex,
-		httpRequestUrl:        httpRequest.Url,
-		httpRequestBody:       httpRequest.Body,
-		httpRequestUrlForLog:  httpRequestUrlForLog,
-		httpRequestBodyForLog: httpRequestBodyForLog,
+	request, err := retryablehttp.NewRequest(httpRequest.Method, rendered.Url, bytes.NewBufferString(rendered.Body))
+
+	if err != nil {
+		return ResponseResult{httpRequest.Name, "", nil, requestLogger.prepareErrorForLog(err), false, false}, false
 	}
 
-	go func(httpRequest HttpRequest, requestLogger RequestLogger, responseResult chan ResponseResult) {
-		request, err := retryablehttp.NewRequest(httpRequest.Method, httpRequest.Url, bytes.NewBufferString(httpRequest.Body))
+	if password := httpRequest.Password.Value(); httpRequest.BasicAuth && httpRequest.Username != "" && password != "" {
+		request.SetBasicAuth(httpRequest.Username, password)
+	}
 
-		if err != nil {
-			responseResult <- ResponseResult{requestIndex, "", nil, requestLogger.prepareErrorForLog(err)}
-			return
-		}
+	for requestHeaderKey, requestHeaderValue := range rendered.Headers {
+		request.Header.Set(requestHeaderKey, requestHeaderValue)
+	}
 
-		if httpRequest.BasicAuth && httpRequest.Username != "" && httpRequest.Password != "" {
-			request.SetBasicAuth(httpRequest.Username, httpRequest.Password)
-		}
+	if httpRequest.auth != nil {
+		request.Header.Set(httpRequest.auth.header, httpRequest.auth.prefix+data.AuthToken)
+	}
 
-		for requestHeaderKey, requestHeaderValue := range httpRequest.Headers {
-			request.Header.Set(requestHeaderKey, requestHeaderValue)
-		}
+	if dryRun {
+		return ResponseResult{httpRequest.Name, "", []byte(requestLogger.describeRequest(request)), nil, true, false}, false
+	}
 
-		client := retryablehttp.NewClient()
-		client.Logger = requestLogger
-		client.RequestLogHook = requestLogger.LogRequest
-		client.ResponseLogHook = requestLogger.LogResponse
-		client.RetryWaitMax = time.Second * 30
-		client.RetryMax = int(httpRequest.RetryCount)
-		client.HTTPClient.Timeout = httpRequest.Timeout
+	client := retryablehttp.NewClient()
+	client.Logger = requestLogger
+	client.RequestLogHook = requestLogger.LogRequest
+	client.ResponseLogHook = requestLogger.LogResponse
+	client.RetryWaitMax = time.Second * 30
+	client.RetryMax = int(httpRequest.RetryCount)
+	client.HTTPClient.Timeout = httpRequest.Timeout
 
-		response, err := client.Do(request)
+	if transport := tlsTransport(httpRequest.tls); transport != nil {
+		client.HTTPClient.Transport = transport
+	}
+	if httpRequest.tls != nil && httpRequest.tls.InsecureSkipVerify {
+		log.WithField("http_request", httpRequest.Name).Warn("TLS certificate verification is turned off for this request")
+	}
 
-		if err != nil {
-			var responseStatus string
-			if response != nil {
-				responseStatus = response.Status
-			}
-			responseResult <- ResponseResult{requestIndex, responseStatus, nil, requestLogger.prepareErrorForLog(err)}
-			return
-		}
+	client.CheckRetry = httpRequest.Success.checkRetry
+	// keep the response of a failed request, so its status and body can be logged
+	client.ErrorHandler = func(response *http.Response, err error, numTries int) (*http.Response, error) {
+		return response, err
+	}
 
-		body, err := ioutil.ReadAll(response.Body)
+	response, err := client.Do(request)
 
-		if err != nil {
-			responseResult <- ResponseResult{requestIndex, response.Status, nil, requestLogger.prepareErrorForLog(err)}
-			return
+	var responseStatus string
+	var body []byte
+	var unauthorized bool
+	if response != nil {
+		responseStatus = response.Status
+		unauthorized = httpRequest.auth != nil && response.StatusCode == http.StatusUnauthorized
+		var readErr error
+		body, readErr = ioutil.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if err == nil {
+			err = readErr
 		}
+	}
 
-		responseResult <- ResponseResult{requestIndex, response.Status, body, nil}
-	}(httpRequest, *requestLogger, responseResult)
+	if err != nil {
+		_, final := err.(finalError)
+		return ResponseResult{httpRequest.Name, responseStatus, body, requestLogger.prepareErrorForLog(err), false, final}, unauthorized
+	}
 
-	return responseResult
+	return ResponseResult{httpRequest.Name, responseStatus, body, nil, false, false}, false
 }
@@ -0,0 +1,184 @@
+package http_requests
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+)
+
+// TemplateData is passed to the URL, body and header templates of a request.
+type TemplateData struct {
+	// IP is the address of the update, Family either "ipv4" or "ipv6"
+	IP     string
+	Family string
+	// IPv4 and IPv6 are the current addresses, the family not being updated holds the last known address, if any
+	IPv4 string
+	IPv6 string
+	// Prefix is the last IPv6 prefix reported, PreviousIP the address the update replaces
+	Prefix     string
+	PreviousIP string
+	Hostname   string
+	Timestamp  time.Time
+	Username   string
+	Password   string
+	Token      string
+	// AuthToken is the bearer token acquired by the auth of the request, if any
+	AuthToken string
+}
+
+// redacted returns a copy of the data with the credentials replaced, for rendering into logs.
+func (d TemplateData) redacted() TemplateData {
+	if d.Username != "" {
+		d.Username = secrets.Redacted
+	}
+	if d.Password != "" {
+		d.Password = secrets.Redacted
+	}
+	if d.Token != "" {
+		d.Token = secrets.Redacted
+	}
+	if d.AuthToken != "" {
+		d.AuthToken = secrets.Redacted
+	}
+
+	return d
+}
+
+// templateFuncs are available in every template in addition to the builtins like urlquery
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"base64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"hmac": func(key string, message string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(message))
+		return hex.EncodeToString(mac.Sum(nil))
+	},
+	"sha256": func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+}
+
+// legacyPlaceholders maps the placeholders of the former <placeholder> syntax to the template actions replacing them
+var legacyPlaceholders = []struct {
+	placeholders []string
+	action       string
+}{
+	{ip4AddrPlaceholders[:], "{{.IPv4}}"},
+	{ip6AddrPlaceholders[:], "{{.IPv6}}"},
+	{usernamePlaceholders[:], "{{.Username}}"},
+	{passwordPlaceholders[:], "{{.Password}}"},
+}
+
+// convertLegacyPlaceholders rewrites the former placeholders like <ipaddr> into template actions.
+func convertLegacyPlaceholders(text string) string {
+	for _, legacy := range legacyPlaceholders {
+		for _, placeholder := range legacy.placeholders {
+			text = strings.ReplaceAll(text, placeholder, legacy.action)
+		}
+	}
+
+	return text
+}
+
+// containsAny tells if any of the texts contains any of the needles.
+func containsAny(texts []string, needles ...string) bool {
+	for _, text := range texts {
+		for _, needle := range needles {
+			if strings.Contains(text, needle) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type requestTemplates struct {
+	url     *template.Template
+	body    *template.Template
+	headers map[string]*template.Template
+}
+
+type renderedRequest struct {
+	Url     string
+	Body    string
+	Headers map[string]string
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Parse(convertLegacyPlaceholders(text))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+
+	return t, nil
+}
+
+// parseTemplates parses the URL, body and header values of the request, converting the former placeholders.
+func parseTemplates(httpRequest HttpRequest) (*requestTemplates, error) {
+	var err error
+	templates := &requestTemplates{headers: make(map[string]*template.Template)}
+
+	if templates.url, err = parseTemplate("url", httpRequest.Url); err != nil {
+		return nil, err
+	}
+
+	if templates.body, err = parseTemplate("body", httpRequest.Body); err != nil {
+		return nil, err
+	}
+
+	for key, value := range httpRequest.Headers {
+		if templates.headers[key], err = parseTemplate("header "+key, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return templates, nil
+}
+
+func executeTemplate(t *template.Template, data TemplateData) (string, error) {
+	var buf bytes.Buffer
+
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func (t *requestTemplates) render(data TemplateData) (renderedRequest, error) {
+	var err error
+	rendered := renderedRequest{Headers: make(map[string]string)}
+
+	if rendered.Url, err = executeTemplate(t.url, data); err != nil {
+		return rendered, err
+	}
+
+	if rendered.Body, err = executeTemplate(t.body, data); err != nil {
+		return rendered, err
+	}
+
+	for key, header := range t.headers {
+		if rendered.Headers[key], err = executeTemplate(header, data); err != nil {
+			return rendered, err
+		}
+	}
+
+	return rendered, nil
+}
@@ -0,0 +1,142 @@
+package http_requests
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// TLSConfig defines the TLS settings of a request, unset fields keep the defaults of Go.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the CAs trusted instead of the system roots
+	CAFile string `json:"caFile"`
+	// CertFile and KeyFile are the PEM client certificate and its key, for endpoints requiring mutual TLS
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// ServerName is verified instead of the host of the URL
+	ServerName string `json:"serverName"`
+	// Pins are base64 SHA-256 digests of the subject public key info, one of the certificates has to match
+	Pins []string `json:"pins"`
+	// MinVersion is the lowest accepted TLS version, i.e. "1.2" or "1.3"
+	MinVersion string `json:"minVersion"`
+	// InsecureSkipVerify turns off the verification of the certificate, logged with a warning on every request
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// isZero tells if no setting differs from the defaults.
+func (c TLSConfig) isZero() bool {
+	return c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" && c.ServerName == "" && len(c.Pins) == 0 &&
+		c.MinVersion == "" && !c.InsecureSkipVerify
+}
+
+// build loads the files and returns the config of the client, nil if the defaults apply.
+func (c TLSConfig) build() (*tls.Config, error) {
+	if c.isZero() {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(c.MinVersion), "tls")]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q, one of 1.0, 1.1, 1.2 or 1.3", c.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle failed: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s contains no certificate", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("client certificate requires both a certificate and a key file")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate failed: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if len(c.Pins) > 0 {
+		pins := make(map[string]struct{})
+		for _, pin := range c.Pins {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+			if digest, err := base64.StdEncoding.DecodeString(pin); err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q, expecting a base64 SHA-256 digest", pin)
+			}
+			pins[pin] = struct{}{}
+		}
+
+		config.VerifyConnection = verifyPins(pins, c.InsecureSkipVerify)
+	}
+
+	return config, nil
+}
+
+// verifyPins accepts a connection if one of the certificates of a verified chain matches a pin. The certificates sent
+// by the server do not count as such, as a server with any trusted certificate can send along a copy of a pinned CA.
+// Without verification of the chain only the leaf counts.
+func verifyPins(pins map[string]struct{}, leafOnly bool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		var chains [][]*x509.Certificate
+
+		if leafOnly {
+			if len(state.PeerCertificates) > 0 {
+				chains = [][]*x509.Certificate{state.PeerCertificates[:1]}
+			}
+		} else {
+			chains = state.VerifiedChains
+		}
+
+		for _, chain := range chains {
+			for _, certificate := range chain {
+				digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+				if _, ok := pins[base64.StdEncoding.EncodeToString(digest[:])]; ok {
+					return nil
+				}
+			}
+		}
+
+		return errors.New("no certificate of the server matches a pin")
+	}
+}
+
+// tlsTransport returns a transport using the config, nil if the defaults apply.
+func tlsTransport(config *tls.Config) http.RoundTripper {
+	if config == nil {
+		return nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config.Clone()
+
+	return transport
+}
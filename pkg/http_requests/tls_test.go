@@ -0,0 +1,248 @@
+package http_requests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate creates a self-signed certificate for dyndns.internal and 127.0.0.1, usable by server and client,
+// and writes it along with its key into dir.
+func testCertificate(t *testing.T, dir string) (tls.Certificate, *x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dyndns.internal"},
+		DNSNames:              []string{"dyndns.internal"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pair, certificate, certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	pair, certificate, certFile, keyFile := testCertificate(t, t.TempDir())
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(certificate)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MaxVersion:   tls.VersionTLS12,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(digest[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	mutual := TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile}
+
+	tests := []struct {
+		name string
+		tls  TLSConfig
+		ok   bool
+	}{
+		{"system roots", TLSConfig{}, false},
+		{"CA bundle without client certificate", TLSConfig{CAFile: certFile}, false},
+		{"mutual TLS", mutual, true},
+		{"server name", TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "dyndns.internal"}, true},
+		{"wrong server name", TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "example.com"}, false},
+		{"pin", TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, Pins: []string{otherPin, "sha256/" + pin}}, true},
+		{"wrong pin", TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, Pins: []string{otherPin}}, false},
+		{"insecure with pin", TLSConfig{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true, Pins: []string{pin}}, true},
+		{"minimum version above server", TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			retryCount := 0
+			httpRequest, err := RequestConfig{Name: "x", Url: server.URL + "/?ip={{.IPv4}}", RetryCount: &retryCount, TLS: test.tls}.build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := send(httpRequest, authData)
+
+			if test.ok && result.Error != nil {
+				t.Errorf("request failed: %v", result.Error)
+			}
+			if !test.ok && result.Error == nil {
+				t.Error("request succeeded")
+			}
+		})
+	}
+}
+
+func TestTLSValidation(t *testing.T) {
+	for _, config := range []TLSConfig{
+		{CAFile: "/nonexistent/ca.pem"},
+		{CertFile: "/nonexistent/cert.pem"},
+		{MinVersion: "1.4"},
+		{Pins: []string{"not a digest"}},
+	} {
+		if _, err := (RequestConfig{Name: "x", Url: "https://example.com", TLS: config}).build(); err == nil {
+			t.Errorf("invalid TLS settings %+v accepted", config)
+		}
+	}
+}
+
+// testIssue creates a certificate signed by the parent, a CA if leaf is false, or a self-signed one without parent.
+func testIssue(t *testing.T, name string, leaf bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  !leaf,
+		BasicConstraintsValid: true,
+	}
+
+	if leaf {
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, key
+}
+
+func TestTLSPinsOnlyMatchTheVerifiedChain(t *testing.T) {
+	trustedCA, trustedKey := testIssue(t, "trusted CA", false, nil, nil)
+	pinnedCA, _ := testIssue(t, "pinned CA", false, nil, nil)
+	leaf, leafKey := testIssue(t, "127.0.0.1", true, trustedCA, trustedKey)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: trustedCA.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the leaf is trusted, the copy of the pinned CA sent along is not part of its chain
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leaf.Raw, pinnedCA.Raw},
+		PrivateKey:  leafKey,
+	}}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	pinOf := func(certificate *x509.Certificate) string {
+		digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		return base64.StdEncoding.EncodeToString(digest[:])
+	}
+
+	tests := []struct {
+		name string
+		tls  TLSConfig
+		ok   bool
+	}{
+		{"pinned CA sent along", TLSConfig{CAFile: caFile, Pins: []string{pinOf(pinnedCA)}}, false},
+		{"pinned CA of the chain", TLSConfig{CAFile: caFile, Pins: []string{pinOf(trustedCA)}}, true},
+		{"pinned leaf", TLSConfig{CAFile: caFile, Pins: []string{pinOf(leaf)}}, true},
+		{"insecure with pinned CA sent along", TLSConfig{InsecureSkipVerify: true, Pins: []string{pinOf(pinnedCA)}}, false},
+		{"insecure with pinned leaf", TLSConfig{InsecureSkipVerify: true, Pins: []string{pinOf(leaf)}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			retryCount := 0
+			httpRequest, err := RequestConfig{Name: "x", Url: server.URL + "/?ip={{.IPv4}}", RetryCount: &retryCount, TLS: test.tls}.build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := send(httpRequest, authData)
+
+			if test.ok && result.Error != nil {
+				t.Errorf("request failed: %v", result.Error)
+			}
+			if !test.ok && result.Error == nil {
+				t.Error("request succeeded")
+			}
+		})
+	}
+}
@@ -1,14 +1,18 @@
 package http_requests
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/history"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,18 +22,39 @@ var ip6AddrPlaceholders = [...]string{"<ip6addr>", "<ip6>", "<ipv6>", "<ipv6addr
 var usernamePlaceholders = [...]string{"<user>", "<uname>", "<username>"}
 var passwordPlaceholders = [...]string{"<pass>", "<passwd>", "<password>"}
 
+// ProviderName identifies the updater in the history and the outbox
+const ProviderName = "http_requests"
+
 type HttpRequest struct {
-	Url        string
-	Method     string
-	Body       string
-	Username   string
-	Password   string
+	// Name identifies the request in logs, history and outbox
+	Name     string
+	Url      string
+	Method   string
+	Body     string
+	Username string
+	// Password is read again whenever its file changes, just like Token
+	Password   *secrets.Secret
 	BasicAuth  bool
 	Timeout    time.Duration
 	RetryCount uint
 	Onipv4     bool
 	Onipv6     bool
 	Headers    map[string]string
+	// Hostname is passed to the templates, i.e. the name to update at a DynDNS provider
+	Hostname string
+	// Token is passed to the templates, i.e. the update token of a DynDNS provider
+	Token *secrets.Secret
+	// Success decides which responses count as success
+	Success ResponseMatcher
+	// DualStack requests are sent once per change of either family, after waiting for the Settle window
+	DualStack bool
+	Settle    time.Duration
+
+	templates *requestTemplates
+	// auth acquires the bearer token, shared by all copies of the request
+	auth *tokenSource
+	// tls holds the TLS settings, nil if the defaults apply
+	tls *tls.Config
 }
 
 type Updater struct {
@@ -37,119 +62,157 @@ type Updater struct {
 
 	isInit bool
 
-	In chan *net.IP
+	// last known addresses, passed to the templates along with the update
+	mu     sync.Mutex
+	ipv4   net.IP
+	ipv6   net.IP
+	prefix *net.IPNet
+
+	// latest update per dual-stack request waiting for its settle window
+	pendingMu sync.Mutex
+	pending   map[string]*events.IPUpdate
+
+	In chan *events.IPUpdate
 
 	Requests []HttpRequest
+
+	// DryRun renders the requests into the log instead of sending them
+	DryRun bool
+
+	// History journals the outcome of every request, if set
+	History *history.Journal
+
+	// Outbox stores failed requests for a later retry, if set
+	Outbox *outbox.Outbox
 }
 
 func NewUpdater() *Updater {
 	return &Updater{
-		log:    log.WithField("module", "http_requests"),
-		isInit: false,
-		In:     make(chan *net.IP, 10),
+		log:     log.WithField("module", "http_requests"),
+		isInit:  false,
+		pending: make(map[string]*events.IPUpdate),
+		In:      make(chan *events.IPUpdate, 10),
 	}
 }
 
+// Remember sets an address known from before the start, along with the prefix of an IPv6 address, so the templates
+// see both families from the first update.
+func (u *Updater) Remember(ip net.IP, prefix *net.IPNet) {
+	if ip == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if ip.To4() != nil {
+		u.ipv4 = ip
+	} else {
+		u.ipv6 = ip
+		u.prefix = prefix
+	}
+}
+
+// apply keeps the address and prefix of the update as the last known ones.
+func (u *Updater) apply(update *events.IPUpdate) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if update.IP.To4() != nil {
+		u.ipv4 = update.IP
+	} else {
+		u.ipv6 = update.IP
+		u.prefix = update.Prefix
+	}
+}
+
+// current returns the update with the last known address of its family, a newer address received since the update
+// failed takes precedence.
+func (u *Updater) current(update *events.IPUpdate) *events.IPUpdate {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	known, prefix := u.ipv4, update.Prefix
+	if update.IP.To4() == nil {
+		known, prefix = u.ipv6, u.prefix
+	}
+
+	if known == nil || known.Equal(update.IP) {
+		return update
+	}
+
+	return &events.IPUpdate{IP: known, Previous: update.Previous, Prefix: prefix, Source: update.Source}
+}
+
+// templateData builds the data passed to the templates of the request for the update.
+func (u *Updater) templateData(httpRequest HttpRequest, update *events.IPUpdate) TemplateData {
+	u.mu.Lock()
+	ipv4, ipv6, prefix := u.ipv4, u.ipv6, u.prefix
+	u.mu.Unlock()
+
+	if update.IP.To4() != nil {
+		ipv4 = update.IP
+	} else {
+		ipv6 = update.IP
+		prefix = update.Prefix
+	}
+
+	data := TemplateData{
+		IP:        update.IP.String(),
+		Family:    update.Family(),
+		Hostname:  httpRequest.Hostname,
+		Timestamp: time.Now().UTC(),
+		Username:  httpRequest.Username,
+		Password:  httpRequest.Password.Value(),
+		Token:     httpRequest.Token.Value(),
+	}
+
+	if ipv4 != nil {
+		data.IPv4 = ipv4.String()
+	}
+	if ipv6 != nil {
+		data.IPv6 = ipv6.String()
+	}
+	if prefix != nil {
+		data.Prefix = prefix.String()
+	}
+	if update.Previous != nil {
+		data.PreviousIP = update.Previous.String()
+	}
+
+	return data
+}
+
+// InitFromEnvironment reads the requests of the file set by HTTP_REQUESTS_FILE and of the HTTP_REQUEST_n_* variables.
+// Invalid requests are skipped.
 func (u *Updater) InitFromEnvironment() error {
-	//requestIndex = 1
-	//for {
-	// allows up to 9 custom requests, could go with infinite loop stopping when url is empty but it would be harder to modify existing configuration, this way we allow skipping indexes
-	for requestIndex := 1; requestIndex < 10; requestIndex++ {
-		// read from HTTP_REQUEST_1_*, HTTP_REQUEST_2_* ... HTTP_REQUEST_9_*, skipping when empty request URL
-		httpRequestUrl := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_URL", requestIndex))
-		if httpRequestUrl == "" {
-			//break
-			continue
-		}
-		httpRequestMethod := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_METHOD", requestIndex))
-		if httpRequestMethod == "" {
-			httpRequestMethod = "GET"
-		}
-		httpRequestBody := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_BODY", requestIndex))
-		httpRequestUsername := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_USERNAME", requestIndex))
-		httpRequestPassword := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_PASSWORD", requestIndex))
-		httpRequestBasicAuthStr := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_BASIC_AUTH", requestIndex))
-		httpRequestBasicAuth, err := strconv.ParseBool(httpRequestBasicAuthStr)
-		if err != nil {
-			httpRequestBasicAuth = false
-		}
-		if httpRequestBasicAuth && (httpRequestUsername == "" || httpRequestPassword == "") {
-			httpRequestBasicAuth = false
-		}
-		httpRequestRetryCountStr := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_RETRY_COUNT", requestIndex))
-		// 5 retries is around 30 seconds retry time, each additional retry is extra 30s
-		// 7 retries or about a minute and a half retry time seems like a reasonable default and 14 or 5 minutes seems like a reasonable max
-		if httpRequestRetryCountStr == "" {
-			httpRequestRetryCountStr = "7"
-		}
-		httpRequestRetryCount, err := strconv.ParseUint(httpRequestRetryCountStr, 10, 32)
-		if err != nil || httpRequestRetryCount > 14 {
-			if err == nil {
-				err = fmt.Errorf("value %d outside bounds [0, 14]", httpRequestRetryCount)
-			}
-			log.WithError(err).Warn(fmt.Sprintf("Failed to parse HTTP_REQUEST_%d_RETRY_COUNT, using default value 6", requestIndex))
-			httpRequestRetryCount = 6
-		}
-		httpRequestTimeoutStr := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_TIMEOUT", requestIndex))
-		if httpRequestTimeoutStr == "" {
-			httpRequestTimeoutStr = "5s"
-		}
-		httpRequestTimeout, err := time.ParseDuration(httpRequestTimeoutStr)
-		if err != nil || httpRequestTimeout < time.Duration(1)*time.Second || httpRequestTimeout > time.Duration(60)*time.Second {
-			if err == nil {
-				err = fmt.Errorf("value %s outside bounds [1s, 60s]", httpRequestTimeout)
-			}
-			log.WithError(err).Warn(fmt.Sprintf("Failed to parse HTTP_REQUEST_%d_TIMEOUT, using default value 5s", requestIndex))
-			httpRequestTimeout = time.Duration(5) * time.Second
-		}
-		httpRequestOnIpV4Str := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_ONIPV4", requestIndex))
-		httpRequestOnIpV4, err := strconv.ParseBool(httpRequestOnIpV4Str)
-		if err != nil {
-			httpRequestOnIpV4 = true
-		}
-		httpRequestOnIpV6Str := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_ONIPV6", requestIndex))
-		httpRequestOnIpV6, err := strconv.ParseBool(httpRequestOnIpV6Str)
-		if err != nil {
-			httpRequestOnIpV6 = false
-		}
-		if httpRequestOnIpV6 {
-			httpRequestOnIpV4 = false
-		}
-		if httpRequestOnIpV4 || httpRequestOnIpV6 {
-			httpRequestContainsIp4 := false
-			for _, ip4AddrPlaceholder := range ip4AddrPlaceholders {
-				httpRequestContainsIp4 = strings.Contains(httpRequestUrl, ip4AddrPlaceholder) || strings.Contains(httpRequestBody, ip4AddrPlaceholder)
-			}
-			httpRequestContainsIp6 := false
-			for _, ip6AddrPlaceholder := range ip6AddrPlaceholders {
-				httpRequestContainsIp6 = strings.Contains(httpRequestUrl, ip6AddrPlaceholder) || strings.Contains(httpRequestBody, ip6AddrPlaceholder)
-			}
-			if httpRequestContainsIp4 {
-				httpRequestOnIpV4 = true
-				httpRequestOnIpV6 = false
-			} else if httpRequestContainsIp6 {
-				httpRequestOnIpV4 = false
-				httpRequestOnIpV6 = true
-			}
+	var configs []RequestConfig
+
+	if path := os.Getenv("HTTP_REQUESTS_FILE"); path != "" {
+		var err error
+		if configs, err = loadRequestConfigs(path); err != nil {
+			return err
 		}
+	}
 
-		httpRequestHeaders := make(map[string]string)
-		for requestHeaderIndex := 1; requestHeaderIndex < 10; requestHeaderIndex++ {
-			// read from HTTP_REQUEST_1_HEADER_1_*, HTTP_REQUEST_1_HEADER_1_* ... HTTP_REQUEST_1_HEADER_1_*, skipping when empty header key
-			httpRequestHeaderKey := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_HEADER_%d_KEY", requestIndex, requestHeaderIndex))
-			if httpRequestHeaderKey == "" {
-				//break
-				continue
-			}
-			httpRequestHeaderValue := os.Getenv(fmt.Sprintf("HTTP_REQUEST_%d_HEADER_%d_VALUE", requestIndex, requestHeaderIndex))
-			httpRequestHeaders[httpRequestHeaderKey] = httpRequestHeaderValue
+	configs = mergeRequestConfigs(configs, requestConfigsFromEnvironment())
+
+	names := make(map[string]bool)
+
+	for _, config := range configs {
+		if names[config.Name] {
+			u.log.WithField("http_request", config.Name).Error("Duplicate HTTP request name, skipping request")
+			continue
 		}
 
-		httpRequest := HttpRequest{httpRequestUrl, httpRequestMethod, httpRequestBody, httpRequestUsername, httpRequestPassword, httpRequestBasicAuth, httpRequestTimeout, uint(httpRequestRetryCount), httpRequestOnIpV4, httpRequestOnIpV6, httpRequestHeaders}
+		httpRequest, err := config.build()
+		if err != nil {
+			u.log.WithError(err).Error("Invalid HTTP request, skipping request")
+			continue
+		}
 
+		names[config.Name] = true
 		u.Requests = append(u.Requests, httpRequest)
-
-		//index++
 	}
 
 	u.isInit = true
@@ -176,40 +239,140 @@ func (u *Updater) shouldProcessUpdates() bool {
 func (u *Updater) spawnWorker() {
 	for {
 		select {
-		case ip := <-u.In:
+		case update := <-u.In:
 			if !u.shouldProcessUpdates() {
 				continue
 			}
 
-			u.log.WithField("ip", ip).Info("Received update request, executing all HTTP requests")
+			u.log.WithField("ip", update.IP).Info("Received update request, executing all HTTP requests")
+
+			u.apply(update)
 
 			wg := sync.WaitGroup{}
 
-			for i, httpRequest := range u.Requests {
-				responseResult := doRequest(httpRequest, i+1, ip, u.log)
-				if responseResult == nil {
+			for _, httpRequest := range u.Requests {
+				if httpRequest.DualStack {
+					u.scheduleDualStack(httpRequest, update)
 					continue
 				}
 				wg.Add(1)
-				go func(responseResult chan ResponseResult) {
+				go func(httpRequest HttpRequest) {
 					defer wg.Done()
-					requestResponseResult := <-responseResult
-					if requestResponseResult.Error != nil {
-						errorMessage := "HTTP request failed"
-						if requestResponseResult.ResponseStatus != "" {
-							errorMessage = fmt.Sprintf("%s [%s] %s", errorMessage, requestResponseResult.ResponseStatus, string(requestResponseResult.Response))
-						}
-						u.log.WithField("http_request_index", requestResponseResult.RequestIndex).
-							WithError(requestResponseResult.Error).
-							Error(errorMessage)
-					} else {
-						u.log.WithField("http_request_index", requestResponseResult.RequestIndex).
-							Info(fmt.Sprintf("HTTP request result: [%s] %s", requestResponseResult.ResponseStatus, string(requestResponseResult.Response)))
-					}
-				}(responseResult)
+					u.execute(httpRequest, update)
+				}(httpRequest)
 			}
 			wg.Wait()
 			log.Debug("HTTP requests done")
 		}
 	}
 }
+
+// execute sends the request for the update, storing it in the outbox if it fails.
+func (u *Updater) execute(httpRequest HttpRequest, update *events.IPUpdate) {
+	responseResult := doRequest(httpRequest, u.templateData(httpRequest, update), u.DryRun, u.log)
+	if responseResult == nil {
+		return
+	}
+
+	requestResponseResult := <-responseResult
+	u.logResponseResult(requestResponseResult, update.IP)
+	if requestResponseResult.DryRun {
+		return
+	}
+
+	target := requestResponseResult.RequestName
+	if httpRequest.DualStack {
+		// the request carried the addresses of both families, so it supersedes the pending retries of both and a
+		// single retry stands for it, sending the addresses known at retry time
+		u.Outbox.CompleteTarget(ProviderName, target)
+		if requestResponseResult.Error != nil && !requestResponseResult.Final {
+			u.Outbox.Enqueue(ProviderName, target, update, requestResponseResult.Error)
+		}
+	} else if requestResponseResult.Error != nil && !requestResponseResult.Final {
+		u.Outbox.Enqueue(ProviderName, target, update, requestResponseResult.Error)
+	} else {
+		// a final failure supersedes pending retries just like a success, none of them can succeed anymore
+		u.Outbox.Complete(ProviderName, target, update.IP)
+	}
+}
+
+// scheduleDualStack queues the update for a dual-stack request. The request is sent once the settle window after the
+// first queued change has passed, with the addresses of both families known by then, so changes of IPv4 and IPv6
+// arriving close together end up in a single request.
+func (u *Updater) scheduleDualStack(httpRequest HttpRequest, update *events.IPUpdate) {
+	u.pendingMu.Lock()
+	defer u.pendingMu.Unlock()
+
+	_, waiting := u.pending[httpRequest.Name]
+	u.pending[httpRequest.Name] = update
+
+	if waiting {
+		return
+	}
+
+	u.log.WithField("http_request", httpRequest.Name).Debug(fmt.Sprintf("Sending dual-stack HTTP request in %s", httpRequest.Settle))
+
+	time.AfterFunc(httpRequest.Settle, func() {
+		u.pendingMu.Lock()
+		update := u.pending[httpRequest.Name]
+		delete(u.pending, httpRequest.Name)
+		u.pendingMu.Unlock()
+
+		u.execute(httpRequest, update)
+	})
+}
+
+func (u *Updater) logResponseResult(requestResponseResult ResponseResult, ip net.IP) {
+	rlog := u.log.WithField("http_request", requestResponseResult.RequestName)
+
+	if requestResponseResult.DryRun {
+		rlog.Info(fmt.Sprintf("Dry run, would send HTTP request:\n%s", string(requestResponseResult.Response)))
+	} else if requestResponseResult.Error != nil {
+		errorMessage := "HTTP request failed"
+		if requestResponseResult.Final {
+			errorMessage = "HTTP request failed finally, not retrying"
+		}
+		if requestResponseResult.ResponseStatus != "" {
+			errorMessage = fmt.Sprintf("%s [%s] %s", errorMessage, requestResponseResult.ResponseStatus, string(requestResponseResult.Response))
+		}
+		rlog.WithError(requestResponseResult.Error).Error(errorMessage)
+	} else {
+		rlog.Info(fmt.Sprintf("HTTP request result: [%s] %s", requestResponseResult.ResponseStatus, string(requestResponseResult.Response)))
+	}
+
+	u.History.RecordUpdate(ProviderName, requestResponseResult.RequestName, ip, requestResponseResult.DryRun, requestResponseResult.Error)
+}
+
+// Retry sends the request of an operation stored in the outbox again.
+func (u *Updater) Retry(op *outbox.Operation) error {
+	if !u.shouldProcessUpdates() {
+		return errors.New("HTTP requests updater is not initialized")
+	}
+
+	var httpRequest *HttpRequest
+	for i := range u.Requests {
+		if u.Requests[i].Name == op.Target {
+			httpRequest = &u.Requests[i]
+			break
+		}
+	}
+	if httpRequest == nil {
+		return fmt.Errorf("no HTTP request configured for %s", op.Target)
+	}
+
+	update := u.current(op.Update())
+
+	responseResult := doRequest(*httpRequest, u.templateData(*httpRequest, update), u.DryRun, u.log)
+	if responseResult == nil {
+		return fmt.Errorf("HTTP request %s is not executed on %s updates", op.Target, op.Family)
+	}
+
+	requestResponseResult := <-responseResult
+	u.logResponseResult(requestResponseResult, update.IP)
+
+	if requestResponseResult.Final {
+		return outbox.Permanent(requestResponseResult.Error)
+	}
+
+	return requestResponseResult.Error
+}
@@ -0,0 +1,66 @@
+package http_requests
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+)
+
+func TestDualStackOutbox(t *testing.T) {
+	httpRequest, err := RequestConfig{Name: "noip", Preset: "noip", Hostname: "home.ddns.net", Username: "user", Password: "pass"}.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newStandIn(t, http.StatusOK, "911")
+	httpRequest = server.pointAt(t, httpRequest)
+
+	u := NewUpdater()
+	u.log = testLog()
+	u.isInit = true
+	u.Requests = []HttpRequest{httpRequest}
+	u.Outbox = outbox.NewOutbox(filepath.Join(t.TempDir(), "outbox.json"))
+
+	stored := func() []*outbox.Operation {
+		ops, err := u.Outbox.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ops
+	}
+
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		update := &events.IPUpdate{IP: net.ParseIP(ip)}
+		u.apply(update)
+		u.execute(httpRequest, update)
+	}
+
+	if ops := stored(); len(ops) != 1 || ops[0].Address != "2001:db8::1" {
+		t.Fatalf("outbox holds %d operations, want a single one for the last combined request", len(ops))
+	}
+
+	// a retry sends the addresses of both families known by now
+	u.apply(&events.IPUpdate{IP: net.ParseIP("192.0.2.2")})
+	server.body = "good"
+
+	if err := u.Retry(stored()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/nic/update?hostname=home.ddns.net&myip=192.0.2.2,2001:db8::1"; server.uri != want {
+		t.Errorf("retry sent %s, want %s", server.uri, want)
+	}
+
+	// a failure of one family followed by a success of the other leaves nothing to retry
+	server.body = "911"
+	u.execute(httpRequest, &events.IPUpdate{IP: net.ParseIP("192.0.2.2")})
+	server.body = "good"
+	u.execute(httpRequest, &events.IPUpdate{IP: net.ParseIP("2001:db8::2")})
+
+	if ops := stored(); len(ops) != 0 {
+		t.Errorf("outbox holds %d operations after the combined request succeeded", len(ops))
+	}
+}
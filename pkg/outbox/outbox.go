@@ -0,0 +1,474 @@
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	log "github.com/sirupsen/logrus"
+)
+
+// Operation states
+const (
+	StatePending = "pending"
+	StateDead    = "dead"
+)
+
+// Operation is a failed provider update waiting to be retried.
+type Operation struct {
+	Id       string `json:"id"`
+	Provider string `json:"provider"`
+	Target   string `json:"target"`
+	Family   string `json:"family"`
+
+	Address  string `json:"address"`
+	Previous string `json:"previous,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	Source   string `json:"source,omitempty"`
+
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// Update restores the update the operation was created from.
+func (op *Operation) Update() *events.IPUpdate {
+	update := &events.IPUpdate{
+		IP:       net.ParseIP(op.Address),
+		Previous: net.ParseIP(op.Previous),
+		Source:   op.Source,
+	}
+
+	if op.Prefix != "" {
+		_, update.Prefix, _ = net.ParseCIDR(op.Prefix)
+	}
+
+	return update
+}
+
+// Handler retries a single operation of a provider, returning an error if it failed again.
+type Handler func(op *Operation) error
+
+// permanentError marks a failure that further retries cannot fix.
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// Permanent wraps the error of a handler, so the operation becomes a dead letter right away instead of being retried.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return permanentError{err}
+}
+
+// Outbox persists failed provider updates in a JSON file and retries them with exponential backoff until they
+// succeed, get superseded by a newer update or run out of attempts and become dead letters.
+// The file is re-read on every access, so changes done through the CLI are picked up by a running service.
+// All methods used by the updaters are safe to call on a nil outbox.
+type Outbox struct {
+	log *log.Entry
+
+	mu       sync.Mutex
+	path     string
+	handlers map[string]Handler
+
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	Interval    time.Duration
+}
+
+func NewOutbox(path string) *Outbox {
+	return &Outbox{
+		log:         log.WithField("module", "outbox"),
+		path:        path,
+		handlers:    make(map[string]Handler),
+		MaxAttempts: 10,
+		MinBackoff:  30 * time.Second,
+		MaxBackoff:  time.Hour,
+		Interval:    10 * time.Second,
+	}
+}
+
+// Register sets the retry handler of a provider.
+func (o *Outbox) Register(provider string, handler Handler) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.handlers[provider] = handler
+}
+
+// Enqueue stores a failed update, replacing any pending operation of the same provider, target and family.
+func (o *Outbox) Enqueue(provider string, target string, update *events.IPUpdate, err error) {
+	if o == nil {
+		return
+	}
+
+	now := time.Now()
+	op := &Operation{
+		Id:          newId(),
+		Provider:    provider,
+		Target:      target,
+		Family:      update.Family(),
+		Address:     update.IP.String(),
+		Source:      update.Source,
+		State:       StatePending,
+		Attempts:    1,
+		CreatedAt:   now,
+		NextAttempt: now.Add(o.backoff(1)),
+	}
+
+	if update.Previous != nil {
+		op.Previous = update.Previous.String()
+	}
+
+	if update.Prefix != nil {
+		op.Prefix = update.Prefix.String()
+	}
+
+	if err != nil {
+		op.LastError = err.Error()
+	}
+
+	err = o.modify(func(ops []*Operation) []*Operation {
+		return append(removeMatching(ops, provider, target, op.Family), op)
+	})
+
+	if err != nil {
+		o.log.WithError(err).Error("Failed to store operation, it will not be retried")
+		return
+	}
+
+	o.log.WithFields(log.Fields{"id": op.Id, "provider": provider, "target": target}).
+		Info(fmt.Sprintf("Stored failed update, retrying at %s", op.NextAttempt.Format("2006-01-02 15:04:05")))
+}
+
+// Complete drops operations superseded by a successful update of the same provider, target and family.
+func (o *Outbox) Complete(provider string, target string, ip net.IP) {
+	if o == nil {
+		return
+	}
+
+	family := events.Family(ip)
+
+	err := o.modify(func(ops []*Operation) []*Operation {
+		return removeMatching(ops, provider, target, family)
+	})
+
+	if err != nil {
+		o.log.WithError(err).Error("Failed to update outbox")
+	}
+}
+
+// CompleteTarget drops the operations of all families of the provider and target, for targets updating both families
+// at once.
+func (o *Outbox) CompleteTarget(provider string, target string) {
+	if o == nil {
+		return
+	}
+
+	err := o.modify(func(ops []*Operation) []*Operation {
+		kept := ops[:0]
+
+		for _, op := range ops {
+			if op.Provider != provider || op.Target != target {
+				kept = append(kept, op)
+			}
+		}
+
+		return kept
+	})
+
+	if err != nil {
+		o.log.WithError(err).Error("Failed to update outbox")
+	}
+}
+
+// List returns all stored operations ordered by their next attempt.
+func (o *Outbox) List() ([]*Operation, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ops, err := o.load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].NextAttempt.Before(ops[j].NextAttempt)
+	})
+
+	return ops, nil
+}
+
+// Retry makes the operation with the given id due right away, reviving it with a fresh attempt budget if it
+// is a dead letter. Returns the number of operations scheduled, an empty id schedules all of them.
+func (o *Outbox) Retry(id string) (int, error) {
+	scheduled := 0
+
+	err := o.modify(func(ops []*Operation) []*Operation {
+		for _, op := range ops {
+			if id != "" && op.Id != id {
+				continue
+			}
+
+			if op.State == StateDead {
+				op.Attempts = 0
+			}
+
+			op.State = StatePending
+			op.NextAttempt = time.Now()
+			scheduled++
+		}
+
+		return ops
+	})
+
+	if err == nil && id != "" && scheduled == 0 {
+		err = fmt.Errorf("operation %s not found", id)
+	}
+
+	return scheduled, err
+}
+
+func (o *Outbox) StartWorker() {
+	if o == nil {
+		return
+	}
+
+	go o.spawnWorker()
+}
+
+func (o *Outbox) spawnWorker() {
+	ticker := time.NewTicker(o.Interval)
+
+	for {
+		o.processDue()
+
+		select {
+		case <-ticker.C:
+		}
+	}
+}
+
+// processDue runs the handlers of all due pending operations one after another.
+func (o *Outbox) processDue() {
+	o.mu.Lock()
+	ops, err := o.load()
+	o.mu.Unlock()
+
+	if err != nil {
+		o.log.WithError(err).Error("Failed to load outbox")
+		return
+	}
+
+	now := time.Now()
+
+	for _, op := range ops {
+		if op.State != StatePending || op.NextAttempt.After(now) {
+			continue
+		}
+
+		o.mu.Lock()
+		handler, ok := o.handlers[op.Provider]
+		current, err := o.pending(op.Id)
+		o.mu.Unlock()
+
+		if err != nil {
+			o.log.WithError(err).Error("Failed to load outbox")
+			return
+		}
+
+		// a worker might have completed or replaced the operation with a newer address since the snapshot was taken,
+		// retrying it then would push the old address over the new one
+		if !ok || current == nil {
+			continue
+		}
+		op = current
+
+		olog := o.log.WithFields(log.Fields{"id": op.Id, "provider": op.Provider, "target": op.Target})
+		olog.WithField("attempt", op.Attempts+1).Info("Retrying failed update")
+
+		handlerErr := handler(op)
+
+		err = o.modify(func(ops []*Operation) []*Operation {
+			for i, stored := range ops {
+				// the operation might have been superseded or removed in the meantime
+				if stored.Id != op.Id {
+					continue
+				}
+
+				if handlerErr == nil {
+					olog.Info("Retry succeeded")
+					return append(ops[:i], ops[i+1:]...)
+				}
+
+				stored.Attempts++
+				stored.LastError = handlerErr.Error()
+
+				if _, permanent := handlerErr.(permanentError); permanent {
+					stored.State = StateDead
+					olog.WithError(handlerErr).Error("Retry failed permanently, moving update to dead letters")
+				} else if stored.Attempts >= o.MaxAttempts {
+					stored.State = StateDead
+					olog.WithError(handlerErr).Error("Retry failed, giving up and moving update to dead letters")
+				} else {
+					stored.NextAttempt = time.Now().Add(o.backoff(stored.Attempts))
+					olog.WithError(handlerErr).Warn(fmt.Sprintf("Retry failed, next attempt at %s", stored.NextAttempt.Format("2006-01-02 15:04:05")))
+				}
+			}
+
+			return ops
+		})
+
+		if err != nil {
+			o.log.WithError(err).Error("Failed to update outbox")
+		}
+	}
+}
+
+// pending returns the stored operation with the given id if it is still pending, nil otherwise. The caller holds mu.
+func (o *Outbox) pending(id string) (*Operation, error) {
+	ops, err := o.load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range ops {
+		if op.Id == id && op.State == StatePending {
+			return op, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// backoff returns the delay after the given number of failed attempts, doubling from MinBackoff up to MaxBackoff.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.MinBackoff
+
+	for i := 1; i < attempts && delay < o.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > o.MaxBackoff {
+		delay = o.MaxBackoff
+	}
+
+	return delay
+}
+
+func (o *Outbox) modify(change func(ops []*Operation) []*Operation) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ops, err := o.load()
+
+	if err != nil {
+		return err
+	}
+
+	return o.save(change(ops))
+}
+
+func (o *Outbox) load() ([]*Operation, error) {
+	data, err := ioutil.ReadFile(o.path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ops []*Operation
+
+	if len(data) == 0 {
+		return ops, nil
+	}
+
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, fmt.Errorf("%s: %w", o.path, err)
+	}
+
+	return ops, nil
+}
+
+func (o *Outbox) save(ops []*Operation) error {
+	if ops == nil {
+		ops = []*Operation{}
+	}
+
+	data, err := json.MarshalIndent(ops, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(o.path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(o.path), filepath.Base(o.path)+".*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), o.path)
+}
+
+func removeMatching(ops []*Operation, provider string, target string, family string) []*Operation {
+	kept := ops[:0]
+
+	for _, op := range ops {
+		if op.Provider == provider && op.Target == target && op.Family == family {
+			continue
+		}
+
+		kept = append(kept, op)
+	}
+
+	return kept
+}
+
+func newId() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
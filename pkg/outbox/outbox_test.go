@@ -0,0 +1,239 @@
+package outbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	log "github.com/sirupsen/logrus"
+)
+
+func newTestOutbox(t *testing.T) *Outbox {
+	logger := log.New()
+	logger.Out = ioutil.Discard
+
+	o := NewOutbox(filepath.Join(t.TempDir(), "outbox.json"))
+	o.log = log.NewEntry(logger)
+
+	return o
+}
+
+func update(ip string) *events.IPUpdate {
+	return &events.IPUpdate{IP: net.ParseIP(ip), Source: events.SourcePoll}
+}
+
+func list(t *testing.T, o *Outbox) []*Operation {
+	ops, err := o.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ops
+}
+
+func TestEnqueueReplacesPendingOperation(t *testing.T) {
+	o := newTestOutbox(t)
+
+	o.Enqueue("dyndns2", "home", update("192.0.2.1"), errors.New("timeout"))
+	o.Enqueue("dyndns2", "home", update("2001:db8::1"), errors.New("timeout"))
+	o.Enqueue("dyndns2", "office", update("192.0.2.1"), errors.New("timeout"))
+	o.Enqueue("dyndns2", "home", update("192.0.2.2"), errors.New("refused"))
+
+	ops := list(t, o)
+	if len(ops) != 3 {
+		t.Fatalf("stored %d operations, want 3", len(ops))
+	}
+
+	for _, op := range ops {
+		if op.Target == "home" && op.Family == "ipv4" && (op.Address != "192.0.2.2" || op.LastError != "refused") {
+			t.Errorf("home ipv4 operation is %s (%s), want the replacement", op.Address, op.LastError)
+		}
+
+		if op.State != StatePending || op.Attempts != 1 {
+			t.Errorf("%s %s is %s after %d attempts, want pending after 1", op.Target, op.Family, op.State, op.Attempts)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	o := newTestOutbox(t)
+
+	o.Enqueue("dyndns2", "home", update("192.0.2.1"), nil)
+	o.Enqueue("dyndns2", "home", update("2001:db8::1"), nil)
+	o.Enqueue("rfc2136", "home", update("192.0.2.1"), nil)
+	o.Enqueue("hooks", "script", update("192.0.2.1"), nil)
+	o.Enqueue("hooks", "script", update("2001:db8::1"), nil)
+
+	// only the family of the successful update is done
+	o.Complete("dyndns2", "home", net.ParseIP("192.0.2.9"))
+	o.CompleteTarget("hooks", "script")
+
+	ops := list(t, o)
+	if len(ops) != 2 {
+		t.Fatalf("kept %d operations, want 2", len(ops))
+	}
+
+	for _, op := range ops {
+		if op.Provider == "hooks" || (op.Provider == "dyndns2" && op.Family == "ipv4") {
+			t.Errorf("%s %s %s was not completed", op.Provider, op.Target, op.Family)
+		}
+	}
+}
+
+func TestProcessDue(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		state    string
+		kept     bool
+	}{
+		{"success", nil, 1, "", false},
+		{"failure", errors.New("timeout"), 2, StatePending, true},
+		{"permanent", Permanent(errors.New("badauth")), 2, StateDead, true},
+		{"exhausted", errors.New("timeout"), 3, StateDead, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := newTestOutbox(t)
+			o.MinBackoff = 0
+
+			var retried []*events.IPUpdate
+			o.Register("dyndns2", func(op *Operation) error {
+				retried = append(retried, op.Update())
+				return test.err
+			})
+
+			o.Enqueue("dyndns2", "home", &events.IPUpdate{IP: net.ParseIP("192.0.2.2"), Previous: net.ParseIP("192.0.2.1"), Source: events.SourcePush}, nil)
+
+			if test.name == "exhausted" {
+				o.MaxAttempts = 3
+				o.processDue()
+			}
+			o.processDue()
+
+			if len(retried) == 0 || !retried[0].IP.Equal(net.ParseIP("192.0.2.2")) || !retried[0].Previous.Equal(net.ParseIP("192.0.2.1")) || retried[0].Source != events.SourcePush {
+				t.Errorf("retried %+v, want the stored update", retried)
+			}
+
+			ops := list(t, o)
+			if kept := len(ops) == 1; kept != test.kept || len(ops) > 1 {
+				t.Fatalf("kept %d operations, want the operation kept: %v", len(ops), test.kept)
+			}
+
+			if test.kept && (ops[0].State != test.state || ops[0].Attempts != test.attempts || ops[0].LastError != test.err.Error()) {
+				t.Errorf("operation is %s after %d attempts with %q, want %s after %d", ops[0].State, ops[0].Attempts, ops[0].LastError, test.state, test.attempts)
+			}
+
+			// dead letters are not retried anymore
+			calls := len(retried)
+			o.processDue()
+			if test.state == StateDead && len(retried) != calls {
+				t.Errorf("dead letter was retried")
+			}
+		})
+	}
+}
+
+func TestProcessDueSkipsNotDue(t *testing.T) {
+	o := newTestOutbox(t)
+
+	retried := 0
+	o.Register("dyndns2", func(op *Operation) error {
+		retried++
+		return nil
+	})
+
+	o.Enqueue("dyndns2", "home", update("192.0.2.1"), nil)
+	o.processDue()
+
+	if retried != 0 || len(list(t, o)) != 1 {
+		t.Errorf("operation was retried before its next attempt")
+	}
+
+	if _, err := o.Retry(""); err != nil {
+		t.Fatal(err)
+	}
+	o.processDue()
+
+	if retried != 1 || len(list(t, o)) != 0 {
+		t.Errorf("operation was not retried after being scheduled")
+	}
+}
+
+func TestProcessDueSkipsSupersededOperations(t *testing.T) {
+	o := newTestOutbox(t)
+	o.MinBackoff = 0
+
+	var retried []string
+	o.Register("dyndns2", func(op *Operation) error {
+		retried = append(retried, op.Target+" "+op.Address)
+
+		// a worker handles newer updates while the first retry runs
+		if op.Target == "first" {
+			o.Enqueue("dyndns2", "second", update("192.0.2.2"), errors.New("timeout"))
+			o.Complete("dyndns2", "third", net.ParseIP("192.0.2.2"))
+		}
+
+		return errors.New("timeout")
+	})
+
+	o.Enqueue("dyndns2", "first", update("192.0.2.1"), nil)
+	o.Enqueue("dyndns2", "second", update("192.0.2.1"), nil)
+	o.Enqueue("dyndns2", "third", update("192.0.2.1"), nil)
+
+	o.processDue()
+
+	if len(retried) != 1 || retried[0] != "first 192.0.2.1" {
+		t.Errorf("retried %v, want only the first operation", retried)
+	}
+
+	ops := list(t, o)
+	if len(ops) != 2 {
+		t.Fatalf("kept %d operations, want 2", len(ops))
+	}
+
+	for _, op := range ops {
+		if op.Target == "second" && (op.Address != "192.0.2.2" || op.Attempts != 1) {
+			t.Errorf("second operation is %s after %d attempts, want the newer update untouched", op.Address, op.Attempts)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	o := NewOutbox("")
+	o.MinBackoff = 30 * time.Second
+	o.MaxBackoff = 5 * time.Minute
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := o.backoff(test.attempts); got != test.want {
+			t.Errorf("backoff after %d attempts is %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestNilOutbox(t *testing.T) {
+	var o *Outbox
+
+	o.Register("dyndns2", nil)
+	o.Enqueue("dyndns2", "home", update("192.0.2.1"), nil)
+	o.Complete("dyndns2", "home", net.ParseIP("192.0.2.1"))
+	o.CompleteTarget("dyndns2", "home")
+	o.StartWorker()
+}
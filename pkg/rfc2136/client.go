@@ -0,0 +1,292 @@
+package rfc2136
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+)
+
+// maxUDPSize is the largest message sent over UDP without EDNS, larger ones go straight to TCP
+const maxUDPSize = 512
+
+// Zone is a zone on its primary server along with the records updated and the TSIG key signing the updates.
+type Zone struct {
+	Name string
+	// Server is the primary as host:port
+	Server string
+	// Zone and Records are fully qualified names, the records are inside the zone
+	Zone    string
+	Records []string
+	TTL     uint32
+	// KeyName, KeyAlgorithm and KeySecret (base64) sign the messages, unsigned if KeyName is empty
+	KeyName      string
+	KeyAlgorithm string
+	KeySecret    *secrets.Secret
+	Timeout      time.Duration
+	Onipv4       bool
+	Onipv6       bool
+}
+
+// key returns the TSIG key, nil if updates are sent unsigned. The secret is decoded on every call, so a rotated
+// secret file is used right away.
+func (z *Zone) key() (*Key, error) {
+	if z.KeyName == "" {
+		return nil, nil
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(z.KeySecret.Value()))
+	if err != nil || len(secret) == 0 {
+		return nil, errors.New("TSIG secret is not valid base64")
+	}
+
+	return &Key{Name: fqdn(z.KeyName), Algorithm: z.KeyAlgorithm, Secret: secret}, nil
+}
+
+func recordType(ip net.IP) uint16 {
+	if ip.To4() != nil {
+		return typeA
+	}
+
+	return typeAAAA
+}
+
+func recordData(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+
+	return ip.To16()
+}
+
+// updateMessage replaces the address records of the family of the address, each by deleting the RRset and adding the
+// new record, RFC 2136 section 2.5.
+func (z *Zone) updateMessage(ip net.IP) *message {
+	m := &message{
+		Opcode:    opcodeUpdate,
+		Questions: []question{{Name: z.Zone, Type: typeSOA, Class: classIN}},
+	}
+
+	rrType := recordType(ip)
+
+	for _, name := range z.Records {
+		m.Authority = append(m.Authority,
+			record{Name: name, Type: rrType, Class: classANY},
+			record{Name: name, Type: rrType, Class: classIN, TTL: z.TTL, Data: recordData(ip)},
+		)
+	}
+
+	return m
+}
+
+// Describe renders the update for logs.
+func (z *Zone) Describe(ip net.IP) string {
+	rrType := "A"
+	if recordType(ip) == typeAAAA {
+		rrType = "AAAA"
+	}
+
+	var changes []string
+	for _, name := range z.Records {
+		changes = append(changes, fmt.Sprintf("delete %s %s, add %s %d %s %s", name, rrType, name, z.TTL, rrType, ip))
+	}
+
+	return strings.Join(changes, "; ")
+}
+
+// Update sends the update of the records to the primary.
+func (z *Zone) Update(ip net.IP) error {
+	response, err := z.exchange(z.updateMessage(ip))
+	if err != nil {
+		return err
+	}
+
+	if response.Rcode != 0 {
+		return fmt.Errorf("update was answered with %s", rcodeName(response.Rcode))
+	}
+
+	return nil
+}
+
+// Verify queries the primary for the records and returns the serial of the zone, failing if a record does not hold
+// the address.
+func (z *Zone) Verify(ip net.IP) (uint32, error) {
+	response, err := z.query(z.Zone, typeSOA)
+	if err != nil {
+		return 0, fmt.Errorf("SOA query failed: %w", err)
+	}
+
+	var serial uint32
+	for _, answer := range response.Answers {
+		if answer.Type == typeSOA && fqdn(answer.Name) == fqdn(z.Zone) {
+			if serial, err = soaSerial(answer.Data); err != nil {
+				return 0, fmt.Errorf("invalid SOA record: %w", err)
+			}
+		}
+	}
+
+	if serial == 0 {
+		return 0, fmt.Errorf("primary is not authoritative for zone %s", z.Zone)
+	}
+
+	for _, name := range z.Records {
+		response, err := z.query(name, recordType(ip))
+		if err != nil {
+			return serial, fmt.Errorf("query of %s failed: %w", name, err)
+		}
+
+		found := false
+		for _, answer := range response.Answers {
+			if answer.Type == recordType(ip) && fqdn(answer.Name) == name && net.IP(answer.Data).Equal(ip) {
+				found = true
+			}
+		}
+
+		if !found {
+			return serial, fmt.Errorf("record %s does not hold %s after the update", name, ip)
+		}
+	}
+
+	return serial, nil
+}
+
+func (z *Zone) query(name string, rrType uint16) (*message, error) {
+	response, err := z.exchange(&message{Opcode: opcodeQuery, Questions: []question{{Name: name, Type: rrType, Class: classIN}}})
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Rcode != 0 {
+		return nil, fmt.Errorf("query was answered with %s", rcodeName(response.Rcode))
+	}
+
+	return response, nil
+}
+
+// exchange signs and sends the message over UDP, falling back to TCP if the response is truncated, UDP fails or the
+// message is too large. The response has to carry a valid signature if the request does.
+func (z *Zone) exchange(m *message) (*message, error) {
+	key, err := z.key()
+	if err != nil {
+		return nil, err
+	}
+
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	m.ID = binary.BigEndian.Uint16(id[:])
+
+	request, err := m.pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var requestMAC []byte
+	if key != nil {
+		if request, requestMAC, err = key.sign(request, nil, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	var raw []byte
+	var udpErr error
+
+	if len(request) <= maxUDPSize {
+		raw, udpErr = z.sendUDP(request, m.ID)
+		if udpErr == nil && raw[2]&0x02 != 0 {
+			udpErr = errors.New("response is truncated")
+		}
+	}
+
+	if raw == nil || udpErr != nil {
+		if raw, err = z.sendTCP(request, m.ID); err != nil {
+			if udpErr != nil {
+				return nil, fmt.Errorf("%v over UDP, %w over TCP", udpErr, err)
+			}
+			return nil, err
+		}
+	}
+
+	response, err := unpack(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+
+	if !response.Response || response.Opcode != m.Opcode {
+		return nil, errors.New("invalid response: not an answer to the request")
+	}
+
+	if key != nil {
+		if _, err := key.verify(raw, response, requestMAC, time.Now()); err != nil {
+			return nil, fmt.Errorf("response failed TSIG verification: %w", err)
+		}
+	}
+
+	return response, nil
+}
+
+func (z *Zone) sendUDP(request []byte, id uint16) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", z.Server, z.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(z.Timeout))
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+
+	// responses with another ID are dropped, they are late answers or spoofed
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n >= headerLength && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (z *Zone) sendTCP(request []byte, id uint16) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", z.Server, z.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(z.Timeout))
+
+	if _, err := conn.Write(append(appendUint16(nil, uint16(len(request))), request...)); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	if len(response) < headerLength || binary.BigEndian.Uint16(response) != id {
+		return nil, errors.New("response does not match the request")
+	}
+
+	return response, nil
+}
@@ -0,0 +1,397 @@
+package rfc2136
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+)
+
+// standIn is an authoritative server for a single zone on UDP and TCP of the same port, applying updates to its
+// records and answering queries, all signed with its key if it has one.
+type standIn struct {
+	t    *testing.T
+	zone string
+	key  *Key
+	addr string
+
+	// truncateUDP answers every UDP message truncated, dropUpdates acknowledges updates without applying them
+	truncateUDP bool
+	dropUpdates bool
+
+	mu          sync.Mutex
+	records     map[string][][]byte
+	serial      uint32
+	udpRequests int
+	tcpRequests int
+}
+
+func newStandIn(t *testing.T, zone string, key *Key) *standIn {
+	s := &standIn{t: t, zone: fqdn(zone), key: key, records: map[string][][]byte{}, serial: 2024010100}
+
+	var udp net.PacketConn
+	var tcp net.Listener
+
+	// the kernel picks the TCP port, which may be taken for UDP, so try a few times
+	for attempt := 0; udp == nil; attempt++ {
+		var err error
+		if tcp, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if udp, err = net.ListenPacket("udp", tcp.Addr().String()); err != nil {
+			tcp.Close()
+			if attempt == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	s.addr = tcp.Addr().String()
+
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	go s.serveUDP(udp)
+	go s.serveTCP(tcp)
+
+	return s
+}
+
+func (s *standIn) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.udpRequests++
+		s.mu.Unlock()
+
+		if response := s.handle(buf[:n], true); response != nil {
+			_, _ = conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *standIn) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			request := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.tcpRequests++
+			s.mu.Unlock()
+
+			if response := s.handle(request, false); response != nil {
+				_, _ = conn.Write(append(appendUint16(nil, uint16(len(response))), response...))
+			}
+		}()
+	}
+}
+
+func (s *standIn) handle(raw []byte, udp bool) []byte {
+	m, err := unpack(raw)
+	if err != nil {
+		s.t.Errorf("stand-in received an invalid message: %v", err)
+		return nil
+	}
+
+	response := &message{ID: m.ID, Response: true, Opcode: m.Opcode, Authoritative: true, Questions: m.Questions}
+
+	var requestMAC []byte
+	if s.key != nil {
+		if requestMAC, err = s.key.verify(raw, m, nil, time.Now()); err != nil {
+			return s.badSignature(response, m)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case udp && s.truncateUDP:
+		response.Truncated = true
+	case len(m.Questions) != 1:
+		response.Rcode = 1
+	case m.Opcode == opcodeUpdate:
+		response.Rcode = s.update(m)
+	case m.Opcode == opcodeQuery:
+		response.Answers, response.Rcode = s.query(m.Questions[0])
+	default:
+		response.Rcode = 4
+	}
+
+	packed, err := response.pack()
+	if err != nil {
+		s.t.Errorf("stand-in failed to pack the response: %v", err)
+		return nil
+	}
+
+	if s.key != nil {
+		if packed, _, err = s.key.sign(packed, requestMAC, time.Now()); err != nil {
+			s.t.Errorf("stand-in failed to sign the response: %v", err)
+			return nil
+		}
+	}
+
+	return packed
+}
+
+// badSignature answers NOTAUTH with an unsigned TSIG record carrying BADSIG, RFC 8945 section 5.2.
+func (s *standIn) badSignature(response *message, m *message) []byte {
+	response.Rcode = 9
+
+	if m.tsigOffset != 0 {
+		request := m.Additional[len(m.Additional)-1]
+		t, _ := unpackTSIG(request.Data)
+		t.MAC = nil
+		t.Error = 16
+		response.Additional = []record{{Name: request.Name, Type: typeTSIG, Class: classANY, Data: t.pack()}}
+	}
+
+	packed, _ := response.pack()
+
+	return packed
+}
+
+func (s *standIn) update(m *message) int {
+	if m.Questions[0].Type != typeSOA || fqdn(m.Questions[0].Name) != s.zone {
+		return 10
+	}
+
+	if s.dropUpdates {
+		return 0
+	}
+
+	for _, r := range m.Authority {
+		key := fmt.Sprintf("%s/%d", r.Name, r.Type)
+		switch r.Class {
+		case classANY:
+			delete(s.records, key)
+		case classIN:
+			s.records[key] = append(s.records[key], append([]byte(nil), r.Data...))
+		}
+	}
+
+	s.serial++
+
+	return 0
+}
+
+func (s *standIn) query(q question) ([]record, int) {
+	if q.Type == typeSOA && fqdn(q.Name) == s.zone {
+		data, _ := appendName(nil, "ns1."+s.zone)
+		data, _ = appendName(data, "hostmaster."+s.zone)
+		data = appendUint32(data, s.serial)
+		for _, v := range []uint32{3600, 600, 86400, 300} {
+			data = appendUint32(data, v)
+		}
+		return []record{{Name: s.zone, Type: typeSOA, Class: classIN, TTL: 300, Data: data}}, 0
+	}
+
+	var answers []record
+	for _, data := range s.records[fmt.Sprintf("%s/%d", fqdn(q.Name), q.Type)] {
+		answers = append(answers, record{Name: fqdn(q.Name), Type: q.Type, Class: classIN, TTL: 300, Data: data})
+	}
+
+	return answers, 0
+}
+
+// set changes the behaviour of the running stand-in.
+func (s *standIn) set(truncateUDP bool, dropUpdates bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.truncateUDP = truncateUDP
+	s.dropUpdates = dropUpdates
+}
+
+// stats returns the serial of the zone and the requests received over UDP and TCP.
+func (s *standIn) stats() (uint32, int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.serial, s.udpRequests, s.tcpRequests
+}
+
+func (s *standIn) addresses(name string, rrType uint16) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var addresses []string
+	for _, data := range s.records[fmt.Sprintf("%s/%d", fqdn(name), rrType)] {
+		addresses = append(addresses, net.IP(data).String())
+	}
+
+	return addresses
+}
+
+func testZone(s *standIn, algorithm string, secret string) *Zone {
+	zone := &Zone{
+		Name:    "test",
+		Server:  s.addr,
+		Zone:    s.zone,
+		Records: []string{"home." + s.zone, "vpn." + s.zone},
+		TTL:     60,
+		Timeout: 2 * time.Second,
+		Onipv4:  true,
+		Onipv6:  true,
+	}
+
+	if algorithm != "" {
+		zone.KeyName = "update-key"
+		zone.KeyAlgorithm = algorithm
+		zone.KeySecret = secrets.New(base64.StdEncoding.EncodeToString([]byte(secret)))
+	}
+
+	return zone
+}
+
+func TestUpdate(t *testing.T) {
+	for _, algorithm := range []string{HmacSHA256, HmacSHA512} {
+		t.Run(algorithm, func(t *testing.T) {
+			s := newStandIn(t, "example.internal", &Key{Name: "update-key.", Algorithm: algorithm, Secret: []byte("shared secret")})
+			zone := testZone(s, algorithm, "shared secret")
+
+			for _, ip := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"} {
+				if err := zone.Update(net.ParseIP(ip)); err != nil {
+					t.Fatalf("update to %s: %v", ip, err)
+				}
+
+				serial, err := zone.Verify(net.ParseIP(ip))
+				if err != nil {
+					t.Fatalf("verify of %s: %v", ip, err)
+				}
+
+				if want, _, _ := s.stats(); serial != want {
+					t.Errorf("serial %d, want %d", serial, want)
+				}
+			}
+
+			for _, name := range zone.Records {
+				if got := s.addresses(name, typeA); len(got) != 1 || got[0] != "192.0.2.2" {
+					t.Errorf("A records of %s are %v, want the RRset replaced by 192.0.2.2", name, got)
+				}
+				if got := s.addresses(name, typeAAAA); len(got) != 1 || got[0] != "2001:db8::1" {
+					t.Errorf("AAAA records of %s are %v, want 2001:db8::1", name, got)
+				}
+			}
+
+			if _, _, tcpRequests := s.stats(); tcpRequests != 0 {
+				t.Errorf("%d requests over TCP, want all over UDP", tcpRequests)
+			}
+		})
+	}
+}
+
+func TestUpdateFallsBackToTCP(t *testing.T) {
+	s := newStandIn(t, "example.internal", &Key{Name: "update-key.", Algorithm: HmacSHA256, Secret: []byte("shared secret")})
+	s.set(true, false)
+	zone := testZone(s, HmacSHA256, "shared secret")
+
+	if err := zone.Update(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := zone.Verify(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, udpRequests, tcpRequests := s.stats(); udpRequests == 0 || tcpRequests != udpRequests {
+		t.Errorf("%d requests over UDP and %d over TCP, want every truncated answer retried over TCP", udpRequests, tcpRequests)
+	}
+}
+
+func TestUpdateWithWrongKey(t *testing.T) {
+	s := newStandIn(t, "example.internal", &Key{Name: "update-key.", Algorithm: HmacSHA256, Secret: []byte("shared secret")})
+	zone := testZone(s, HmacSHA256, "wrong secret")
+
+	err := zone.Update(net.ParseIP("192.0.2.1"))
+	if err == nil || !strings.Contains(err.Error(), "BADSIG") {
+		t.Errorf("error %v, want BADSIG", err)
+	}
+
+	if got := s.addresses("home.example.internal", typeA); len(got) != 0 {
+		t.Errorf("records %v changed by an update with the wrong key", got)
+	}
+
+	// unsigned updates are refused by a server requiring a key
+	if err := testZone(s, "", "").Update(net.ParseIP("192.0.2.1")); err == nil {
+		t.Error("unsigned update accepted")
+	}
+}
+
+func TestUpdateUnsigned(t *testing.T) {
+	s := newStandIn(t, "example.internal", nil)
+	zone := testZone(s, "", "")
+
+	if err := zone.Update(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := zone.Verify(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyFailsIfNotApplied(t *testing.T) {
+	s := newStandIn(t, "example.internal", &Key{Name: "update-key.", Algorithm: HmacSHA512, Secret: []byte("shared secret")})
+	s.set(false, true)
+	zone := testZone(s, HmacSHA512, "shared secret")
+
+	if err := zone.Update(net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := zone.Verify(net.ParseIP("192.0.2.1")); err == nil || !strings.Contains(err.Error(), "does not hold") {
+		t.Errorf("error %v, want the missing record reported", err)
+	}
+}
+
+func TestRecordName(t *testing.T) {
+	for name, want := range map[string]string{
+		"@":                          "example.internal.",
+		"home":                       "home.example.internal.",
+		"Home.Example.Internal":      "home.example.internal.",
+		"vpn.home.example.internal.": "vpn.home.example.internal.",
+		"example.internal":           "example.internal.",
+		"example.com.":               "",
+	} {
+		got, err := recordName(name, "example.internal.")
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s resolved to %s, want it rejected as outside of the zone", name, got)
+			}
+			continue
+		}
+
+		if err != nil || got != want {
+			t.Errorf("%s resolved to %s, %v, want %s", name, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package rfc2136
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Record types, classes and opcodes used by the client
+const (
+	typeA    uint16 = 1
+	typeSOA  uint16 = 6
+	typeAAAA uint16 = 28
+	typeTSIG uint16 = 250
+
+	classIN  uint16 = 1
+	classANY uint16 = 255
+
+	opcodeQuery  = 0
+	opcodeUpdate = 5
+)
+
+const headerLength = 12
+
+var errShortMessage = errors.New("message too short")
+
+// rcodeNames are the response codes of RFC 1035, RFC 2136 and RFC 8945
+var rcodeNames = map[int]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+	16: "BADSIG",
+	17: "BADKEY",
+	18: "BADTIME",
+}
+
+func rcodeName(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+type question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// record is a resource record, Data holds the RDATA with any compressed names expanded.
+type record struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// message is a DNS message. In UPDATE messages the sections are zone, prerequisite, update and additional.
+type message struct {
+	ID            uint16
+	Response      bool
+	Opcode        int
+	Authoritative bool
+	Truncated     bool
+	Rcode         int
+	Questions     []question
+	Answers       []record
+	Authority     []record
+	Additional    []record
+
+	// tsigOffset is the start of a trailing TSIG record in the unpacked message, zero if there is none
+	tsigOffset int
+}
+
+// fqdn returns the name in lower case with a trailing dot.
+func fqdn(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	return name
+}
+
+// appendName appends the name in uncompressed wire format.
+func appendName(b []byte, name string) ([]byte, error) {
+	name = fqdn(name)
+
+	if name != "." {
+		for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid label in name %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+
+	return append(b, 0), nil
+}
+
+// readName reads a possibly compressed name at the offset, returning it and the offset behind it.
+func readName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errShortMessage
+		}
+
+		length := int(msg[offset])
+
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return fqdn(strings.Join(labels, ".")), end, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(msg) {
+				return "", 0, errShortMessage
+			}
+			if jumps++; jumps > 64 {
+				return "", 0, errors.New("compression loop in name")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+		case length&0xC0 != 0:
+			return "", 0, fmt.Errorf("unsupported label type 0x%x", length&0xC0)
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errShortMessage
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+func (m *message) flags() uint16 {
+	flags := uint16(m.Opcode&0xF)<<11 | uint16(m.Rcode&0xF)
+	if m.Response {
+		flags |= 1 << 15
+	}
+	if m.Authoritative {
+		flags |= 1 << 10
+	}
+	if m.Truncated {
+		flags |= 1 << 9
+	}
+
+	return flags
+}
+
+// pack encodes the message without name compression.
+func (m *message) pack() ([]byte, error) {
+	b := make([]byte, headerLength, 512)
+
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	binary.BigEndian.PutUint16(b[2:], m.flags())
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.Authority)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Additional)))
+
+	var err error
+
+	for _, q := range m.Questions {
+		if b, err = appendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.Type)
+		b = appendUint16(b, q.Class)
+	}
+
+	for _, section := range [][]record{m.Answers, m.Authority, m.Additional} {
+		for _, r := range section {
+			if b, err = appendRecord(b, r); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return b, nil
+}
+
+func appendRecord(b []byte, r record) ([]byte, error) {
+	b, err := appendName(b, r.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	b = appendUint16(b, r.Type)
+	b = appendUint16(b, r.Class)
+	b = appendUint32(b, r.TTL)
+	b = appendUint16(b, uint16(len(r.Data)))
+
+	return append(b, r.Data...), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// unpack decodes a message, remembering where a trailing TSIG record starts.
+func unpack(msg []byte) (*message, error) {
+	if len(msg) < headerLength {
+		return nil, errShortMessage
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:])
+	m := &message{
+		ID:            binary.BigEndian.Uint16(msg),
+		Response:      flags&(1<<15) != 0,
+		Opcode:        int(flags>>11) & 0xF,
+		Authoritative: flags&(1<<10) != 0,
+		Truncated:     flags&(1<<9) != 0,
+		Rcode:         int(flags & 0xF),
+	}
+
+	offset := headerLength
+
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		name, next, err := readName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, errShortMessage
+		}
+		m.Questions = append(m.Questions, question{name, binary.BigEndian.Uint16(msg[next:]), binary.BigEndian.Uint16(msg[next+2:])})
+		offset = next + 4
+	}
+
+	sections := []*[]record{&m.Answers, &m.Authority, &m.Additional}
+
+	for i, section := range sections {
+		for j := 0; j < int(binary.BigEndian.Uint16(msg[6+2*i:])); j++ {
+			start := offset
+
+			r, next, err := readRecord(msg, offset)
+			if err != nil {
+				return nil, err
+			}
+
+			if r.Type == typeTSIG {
+				if section != &m.Additional || next != len(msg) {
+					return nil, errors.New("TSIG record is not the last record")
+				}
+				m.tsigOffset = start
+			}
+
+			*section = append(*section, r)
+			offset = next
+		}
+	}
+
+	return m, nil
+}
+
+func readRecord(msg []byte, offset int) (record, int, error) {
+	name, offset, err := readName(msg, offset)
+	if err != nil {
+		return record{}, 0, err
+	}
+
+	if offset+10 > len(msg) {
+		return record{}, 0, errShortMessage
+	}
+
+	r := record{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(msg[offset:]),
+		Class: binary.BigEndian.Uint16(msg[offset+2:]),
+		TTL:   binary.BigEndian.Uint32(msg[offset+4:]),
+	}
+
+	length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+	offset += 10
+
+	if offset+length > len(msg) {
+		return record{}, 0, errShortMessage
+	}
+
+	r.Data = msg[offset : offset+length]
+
+	// the names of SOA records may be compressed, expand them so the data stands on its own
+	if r.Type == typeSOA && length > 0 {
+		if r.Data, err = expandSOA(msg, offset, offset+length); err != nil {
+			return record{}, 0, err
+		}
+	}
+
+	return r, offset + length, nil
+}
+
+func expandSOA(msg []byte, offset int, end int) ([]byte, error) {
+	mname, offset, err := readName(msg, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	rname, offset, err := readName(msg, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset+20 != end {
+		return nil, errors.New("invalid SOA record")
+	}
+
+	data, _ := appendName(nil, mname)
+	data, _ = appendName(data, rname)
+
+	return append(data, msg[offset:end]...), nil
+}
+
+// soaSerial returns the serial of SOA data as expanded by unpack.
+func soaSerial(data []byte) (uint32, error) {
+	_, offset, err := readName(data, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, offset, err = readName(data, offset); err != nil {
+		return 0, err
+	}
+
+	if offset+20 > len(data) {
+		return 0, errShortMessage
+	}
+
+	return binary.BigEndian.Uint32(data[offset:]), nil
+}
@@ -0,0 +1,220 @@
+package rfc2136
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// Supported TSIG algorithms, RFC 8945
+const (
+	HmacSHA256 = "hmac-sha256."
+	HmacSHA512 = "hmac-sha512."
+)
+
+// tsigFudge is the accepted clock skew between client and server
+const tsigFudge = 300
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	HmacSHA256: sha256.New,
+	HmacSHA512: sha512.New,
+}
+
+// Key signs messages with TSIG, the secret is the decoded key as found base64 encoded in the server config.
+type Key struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+// tsig is the RDATA of a TSIG record.
+type tsig struct {
+	Algorithm  string
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      uint16
+	Other      []byte
+}
+
+// Algorithm returns the canonical name of an algorithm like "hmac-sha256", ok is false if it is not supported.
+func Algorithm(name string) (string, bool) {
+	name = fqdn(strings.TrimSpace(name))
+	_, ok := tsigAlgorithms[name]
+
+	return name, ok
+}
+
+func (t tsig) pack() []byte {
+	b, _ := appendName(nil, t.Algorithm)
+	b = appendUint48(b, t.TimeSigned)
+	b = appendUint16(b, t.Fudge)
+	b = appendUint16(b, uint16(len(t.MAC)))
+	b = append(b, t.MAC...)
+	b = appendUint16(b, t.OriginalID)
+	b = appendUint16(b, t.Error)
+	b = appendUint16(b, uint16(len(t.Other)))
+
+	return append(b, t.Other...)
+}
+
+func unpackTSIG(data []byte) (tsig, error) {
+	var t tsig
+
+	algorithm, offset, err := readName(data, 0)
+	if err != nil {
+		return t, err
+	}
+	t.Algorithm = algorithm
+
+	if offset+10 > len(data) {
+		return t, errShortMessage
+	}
+
+	t.TimeSigned = uint64(binary.BigEndian.Uint16(data[offset:]))<<32 | uint64(binary.BigEndian.Uint32(data[offset+2:]))
+	t.Fudge = binary.BigEndian.Uint16(data[offset+6:])
+	macSize := int(binary.BigEndian.Uint16(data[offset+8:]))
+	offset += 10
+
+	if offset+macSize+6 > len(data) {
+		return t, errShortMessage
+	}
+
+	t.MAC = data[offset : offset+macSize]
+	offset += macSize
+
+	t.OriginalID = binary.BigEndian.Uint16(data[offset:])
+	t.Error = binary.BigEndian.Uint16(data[offset+2:])
+	otherLength := int(binary.BigEndian.Uint16(data[offset+4:]))
+	offset += 6
+
+	if offset+otherLength != len(data) {
+		return t, errors.New("invalid TSIG record")
+	}
+
+	t.Other = data[offset:]
+
+	return t, nil
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	return append(b, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// mac computes the MAC of a packed message without TSIG record. Responses include the MAC of their request.
+func (k *Key) mac(msg []byte, requestMAC []byte, t tsig) ([]byte, error) {
+	newHash, ok := tsigAlgorithms[fqdn(k.Algorithm)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %s", k.Algorithm)
+	}
+
+	h := hmac.New(newHash, k.Secret)
+
+	if requestMAC != nil {
+		h.Write(appendUint16(nil, uint16(len(requestMAC))))
+		h.Write(requestMAC)
+	}
+
+	h.Write(msg)
+
+	// the variables of the TSIG record, names in canonical form
+	variables, err := appendName(nil, k.Name)
+	if err != nil {
+		return nil, err
+	}
+	variables = appendUint16(variables, classANY)
+	variables = appendUint32(variables, 0)
+	variables, _ = appendName(variables, fqdn(k.Algorithm))
+	variables = appendUint48(variables, t.TimeSigned)
+	variables = appendUint16(variables, t.Fudge)
+	variables = appendUint16(variables, t.Error)
+	variables = appendUint16(variables, uint16(len(t.Other)))
+	variables = append(variables, t.Other...)
+
+	h.Write(variables)
+
+	return h.Sum(nil), nil
+}
+
+// sign appends a TSIG record to the packed message and returns the signed message along with its MAC.
+func (k *Key) sign(msg []byte, requestMAC []byte, now time.Time) ([]byte, []byte, error) {
+	if len(msg) < headerLength {
+		return nil, nil, errShortMessage
+	}
+
+	t := tsig{
+		Algorithm:  fqdn(k.Algorithm),
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      tsigFudge,
+		OriginalID: binary.BigEndian.Uint16(msg),
+	}
+
+	var err error
+	if t.MAC, err = k.mac(msg, requestMAC, t); err != nil {
+		return nil, nil, err
+	}
+
+	signed := append([]byte(nil), msg...)
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+
+	if signed, err = appendRecord(signed, record{Name: k.Name, Type: typeTSIG, Class: classANY, Data: t.pack()}); err != nil {
+		return nil, nil, err
+	}
+
+	return signed, t.MAC, nil
+}
+
+// verify checks the TSIG record of an unpacked message, requestMAC is the MAC of the request a response answers. It
+// returns the MAC of the message.
+func (k *Key) verify(msg []byte, m *message, requestMAC []byte, now time.Time) ([]byte, error) {
+	if m.tsigOffset == 0 {
+		return nil, errors.New("message is not signed")
+	}
+
+	r := m.Additional[len(m.Additional)-1]
+
+	t, err := unpackTSIG(r.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if fqdn(r.Name) != fqdn(k.Name) {
+		return nil, fmt.Errorf("message is signed with key %s", r.Name)
+	}
+
+	if t.Algorithm != fqdn(k.Algorithm) {
+		return nil, fmt.Errorf("message is signed with algorithm %s", t.Algorithm)
+	}
+
+	if t.Error != 0 {
+		return nil, fmt.Errorf("TSIG error %s", rcodeName(int(t.Error)))
+	}
+
+	// the MAC covers the message as it was before the TSIG record was added
+	unsigned := append([]byte(nil), msg[:m.tsigOffset]...)
+	binary.BigEndian.PutUint16(unsigned, t.OriginalID)
+	binary.BigEndian.PutUint16(unsigned[10:], binary.BigEndian.Uint16(unsigned[10:])-1)
+
+	expected, err := k.mac(unsigned, requestMAC, t)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(expected, t.MAC) {
+		return nil, errors.New("TSIG signature does not match")
+	}
+
+	signed := int64(t.TimeSigned)
+	if skew := now.Unix() - signed; skew > int64(t.Fudge) || -skew > int64(t.Fudge) {
+		return nil, fmt.Errorf("TSIG time %s is outside the fudge of %ds", time.Unix(signed, 0).UTC().Format(time.RFC3339), t.Fudge)
+	}
+
+	return t.MAC, nil
+}
@@ -0,0 +1,100 @@
+package rfc2136
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// The expected values were computed independently of this package from the layout of RFC 8945 section 4.3.3, with
+// the hmac module of Python and cross-checked with "openssl dgst -mac HMAC" over the same digest input.
+const (
+	katSecret  = "c2hhcmVkIHNlY3JldCBvZiB0aGUga2F0IHRlc3Q="
+	katTime    = 1700000000
+	katMessage = "123428000001000000020000076578616d706c6508696e7465726e616c000006000104686f6d65076578616d706c6508696e74" +
+		"65726e616c00000100ff00000000000004686f6d65076578616d706c6508696e7465726e616c00000100010000003c0004c0000201"
+)
+
+var tsigKnownAnswers = []struct {
+	algorithm string
+	mac       string
+	// record is the TSIG record appended to the message
+	record string
+}{
+	{
+		HmacSHA256,
+		"4fae0ac3d80f7e4211816b1c2e40934f29361cf7bff89359f930934730f5fe2f",
+		"0a7570646174652d6b65790000fa00ff00000000003d0b686d61632d7368613235360000006553f100012c0020" +
+			"4fae0ac3d80f7e4211816b1c2e40934f29361cf7bff89359f930934730f5fe2f123400000000",
+	},
+	{
+		HmacSHA512,
+		"09ef989f065059611c0ff68fd18d7be500c8c4961c081c91cb5799dea4b10b41" +
+			"48e47e6ca20b6d4e965b4cd3a47df79a58aaf1fa82743f454efecceca8cceb8d",
+		"0a7570646174652d6b65790000fa00ff00000000005d0b686d61632d7368613531320000006553f100012c0040" +
+			"09ef989f065059611c0ff68fd18d7be500c8c4961c081c91cb5799dea4b10b41" +
+			"48e47e6ca20b6d4e965b4cd3a47df79a58aaf1fa82743f454efecceca8cceb8d123400000000",
+	},
+}
+
+func TestTSIGKnownAnswer(t *testing.T) {
+	// the update replaces the A records of home.example.internal by 192.0.2.1
+	m := &message{
+		ID:        0x1234,
+		Opcode:    opcodeUpdate,
+		Questions: []question{{Name: "example.internal.", Type: typeSOA, Class: classIN}},
+		Authority: []record{
+			{Name: "home.example.internal.", Type: typeA, Class: classANY},
+			{Name: "home.example.internal.", Type: typeA, Class: classIN, TTL: 60, Data: []byte{192, 0, 2, 1}},
+		},
+	}
+
+	msg, err := m.pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hex.EncodeToString(msg) != katMessage {
+		t.Fatalf("packed message %x, want %s", msg, katMessage)
+	}
+
+	secret, _ := base64.StdEncoding.DecodeString(katSecret)
+	now := time.Unix(katTime, 0)
+
+	for _, test := range tsigKnownAnswers {
+		t.Run(test.algorithm, func(t *testing.T) {
+			key := &Key{Name: "update-key.", Algorithm: test.algorithm, Secret: secret}
+
+			signed, mac, err := key.sign(msg, nil, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if hex.EncodeToString(mac) != test.mac {
+				t.Errorf("MAC %x, want %s", mac, test.mac)
+			}
+
+			want, _ := hex.DecodeString(katMessage + test.record)
+			want[11] = 1
+
+			if !bytes.Equal(signed, want) {
+				t.Errorf("signed message %x, want %x", signed, want)
+			}
+
+			unpacked, err := unpack(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := key.verify(want, unpacked, nil, now); err != nil {
+				t.Errorf("verify of the known answer: %v", err)
+			}
+
+			if _, err := key.verify(want, unpacked, nil, now.Add((tsigFudge+1)*time.Second)); err == nil {
+				t.Error("verify accepted a message outside of the fudge")
+			}
+		})
+	}
+}
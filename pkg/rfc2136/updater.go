@@ -0,0 +1,320 @@
+package rfc2136
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/events"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/history"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/outbox"
+	"github.com/adrianrudnik/fritzbox-cloudflare-dyndns/pkg/secrets"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProviderName identifies the updater in the history and the outbox
+const ProviderName = "rfc2136"
+
+// Defaults of the zone settings
+const (
+	defaultTTL     = 300
+	maxTTL         = 86400
+	defaultTimeout = 10 * time.Second
+)
+
+type Updater struct {
+	log *log.Entry
+
+	isInit bool
+
+	In chan *events.IPUpdate
+
+	Zones []*Zone
+
+	// DryRun logs the updates instead of sending them
+	DryRun bool
+
+	// History journals the outcome of every record, if set
+	History *history.Journal
+
+	// Outbox stores failed updates for a later retry, if set
+	Outbox *outbox.Outbox
+
+	latest events.Latest
+}
+
+func NewUpdater() *Updater {
+	return &Updater{
+		log:    log.WithField("module", "rfc2136"),
+		isInit: false,
+		In:     make(chan *events.IPUpdate, 10),
+	}
+}
+
+func (u *Updater) InitFromEnvironment() error {
+	// allows up to 9 zones, same as the dyndns2 accounts, indexes can be skipped
+	for zoneIndex := 1; zoneIndex < 10; zoneIndex++ {
+		// read from RFC2136_1_*, RFC2136_2_* ... RFC2136_9_*, skipping when empty server
+		prefix := fmt.Sprintf("RFC2136_%d_", zoneIndex)
+
+		server := os.Getenv(prefix + "SERVER")
+		if server == "" {
+			continue
+		}
+
+		zone, err := zoneFromEnvironment(prefix, server)
+		if err != nil {
+			log.WithError(err).Warn(fmt.Sprintf("Invalid %s* settings, skipping zone", prefix))
+			continue
+		}
+
+		if zone.Name == "" {
+			zone.Name = strconv.Itoa(zoneIndex)
+		}
+
+		if zone.KeyName == "" {
+			log.Warn(fmt.Sprintf("No %sKEY_NAME set, updates of zone %s are sent unsigned", prefix, zone.Zone))
+		}
+
+		u.Zones = append(u.Zones, zone)
+	}
+
+	u.isInit = true
+
+	return nil
+}
+
+func zoneFromEnvironment(prefix string, server string) (*Zone, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+
+	zoneName := os.Getenv(prefix + "ZONE")
+	if zoneName == "" {
+		return nil, fmt.Errorf("no %sZONE set", prefix)
+	}
+	zoneName = fqdn(zoneName)
+
+	var records []string
+	for _, name := range strings.Split(os.Getenv(prefix+"RECORDS"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		record, err := recordName(name, zoneName)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no %sRECORDS set", prefix)
+	}
+
+	ttl := defaultTTL
+	if value := os.Getenv(prefix + "TTL"); value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 || v > maxTTL {
+			if err == nil {
+				err = fmt.Errorf("value %d outside bounds [0, %d]", v, maxTTL)
+			}
+			log.WithError(err).Warn(fmt.Sprintf("Failed to parse %sTTL, using default value %d", prefix, defaultTTL))
+		} else {
+			ttl = v
+		}
+	}
+
+	timeout := defaultTimeout
+	if value := os.Getenv(prefix + "TIMEOUT"); value != "" {
+		v, err := time.ParseDuration(value)
+		if err != nil || v < time.Second || v > time.Minute {
+			if err == nil {
+				err = fmt.Errorf("value %s outside bounds [1s, 1m]", v)
+			}
+			log.WithError(err).Warn(fmt.Sprintf("Failed to parse %sTIMEOUT, using default value %s", prefix, defaultTimeout))
+		} else {
+			timeout = v
+		}
+	}
+
+	onIpV4, err := strconv.ParseBool(os.Getenv(prefix + "ONIPV4"))
+	if err != nil {
+		onIpV4 = true
+	}
+	onIpV6, err := strconv.ParseBool(os.Getenv(prefix + "ONIPV6"))
+	if err != nil {
+		onIpV6 = true
+	}
+
+	zone := &Zone{
+		Name:    os.Getenv(prefix + "NAME"),
+		Server:  server,
+		Zone:    zoneName,
+		Records: records,
+		TTL:     uint32(ttl),
+		KeyName: os.Getenv(prefix + "KEY_NAME"),
+		Timeout: timeout,
+		Onipv4:  onIpV4,
+		Onipv6:  onIpV6,
+	}
+
+	if zone.KeyName != "" {
+		algorithm := os.Getenv(prefix + "KEY_ALGORITHM")
+		if algorithm == "" {
+			algorithm = HmacSHA256
+		}
+
+		var ok bool
+		if zone.KeyAlgorithm, ok = Algorithm(algorithm); !ok {
+			return nil, fmt.Errorf("unsupported %sKEY_ALGORITHM %s, either hmac-sha256 or hmac-sha512", prefix, algorithm)
+		}
+
+		if zone.KeySecret, err = secrets.FromEnv(prefix + "KEY_SECRET"); err != nil {
+			return nil, err
+		}
+
+		if _, err := zone.key(); err != nil {
+			return nil, fmt.Errorf("%sKEY_SECRET: %w", prefix, err)
+		}
+	}
+
+	return zone, nil
+}
+
+// recordName returns the fully qualified name of a record, names not ending in the zone are relative to it. "@" is
+// the zone itself.
+func recordName(name string, zone string) (string, error) {
+	switch {
+	case name == "@":
+		return zone, nil
+	case strings.HasSuffix(name, "."):
+		name = fqdn(name)
+	case fqdn(name) == zone || strings.HasSuffix(fqdn(name), "."+zone):
+		name = fqdn(name)
+	default:
+		name = fqdn(name + "." + zone)
+	}
+
+	if name != zone && !strings.HasSuffix(name, "."+zone) {
+		return "", fmt.Errorf("record %s is outside of zone %s", name, zone)
+	}
+
+	return name, nil
+}
+
+func (u *Updater) StartWorker() {
+	go u.spawnWorker()
+}
+
+func (u *Updater) shouldProcessUpdates() bool {
+	if !u.isInit {
+		return false
+	}
+
+	if len(u.Zones) == 0 {
+		return false
+	}
+
+	return true
+}
+
+func (u *Updater) spawnWorker() {
+	for {
+		select {
+		case update := <-u.In:
+			if !u.shouldProcessUpdates() {
+				continue
+			}
+
+			u.latest.Remember(update)
+			u.log.WithField("ip", update.IP).Info("Received update request, updating all RFC 2136 zones")
+
+			wg := sync.WaitGroup{}
+
+			for _, zone := range u.Zones {
+				if !zone.sendsFamily(update) {
+					continue
+				}
+				wg.Add(1)
+				go func(zone *Zone) {
+					defer wg.Done()
+					err := u.updateZone(zone, update)
+					if u.DryRun {
+						return
+					}
+					if err != nil {
+						u.Outbox.Enqueue(ProviderName, zone.Name, update, err)
+					} else {
+						u.Outbox.Complete(ProviderName, zone.Name, update.IP)
+					}
+				}(zone)
+			}
+			wg.Wait()
+			u.log.Debug("RFC 2136 updates done")
+		}
+	}
+}
+
+func (z *Zone) sendsFamily(update *events.IPUpdate) bool {
+	if update.IP.To4() != nil {
+		return z.Onipv4
+	}
+
+	return z.Onipv6
+}
+
+// updateZone sends the update of all records of the zone and verifies it by querying the primary.
+func (u *Updater) updateZone(zone *Zone, update *events.IPUpdate) error {
+	zlog := u.log.WithField("zone", zone.Zone).WithField("server", zone.Server).WithField("ip", update.IP)
+
+	if u.DryRun {
+		zlog.Info(fmt.Sprintf("Dry run, would send RFC 2136 update: %s", zone.Describe(update.IP)))
+		for _, record := range zone.Records {
+			u.History.RecordUpdate(ProviderName, record, update.IP, true, nil)
+		}
+		return nil
+	}
+
+	err := zone.Update(update.IP)
+
+	var serial uint32
+	if err == nil {
+		serial, err = zone.Verify(update.IP)
+	}
+
+	if err != nil {
+		zlog.WithError(err).Error("RFC 2136 update failed")
+		for _, record := range zone.Records {
+			u.History.RecordUpdate(ProviderName, record, update.IP, false, err)
+		}
+		return err
+	}
+
+	zlog.WithField("serial", serial).Info(fmt.Sprintf("RFC 2136 update applied: %s", zone.Describe(update.IP)))
+	for _, record := range zone.Records {
+		u.History.RecordUpdate(ProviderName, record, update.IP, false, nil)
+	}
+
+	return nil
+}
+
+// Retry sends the update of an operation stored in the outbox again.
+func (u *Updater) Retry(op *outbox.Operation) error {
+	if !u.shouldProcessUpdates() {
+		return errors.New("RFC 2136 updater is not initialized")
+	}
+
+	for _, zone := range u.Zones {
+		if zone.Name == op.Target {
+			// a newer address received since the failure takes precedence
+			return u.updateZone(zone, u.latest.Current(op.Update()))
+		}
+	}
+
+	return fmt.Errorf("no RFC 2136 zone configured for %s", op.Target)
+}
@@ -0,0 +1,118 @@
+package secrets
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Redacted replaces secret values in logs
+const Redacted = "[redacted]"
+
+// minRedactedLength keeps very short values out of the registry, replacing them would garble every log line
+const minRedactedLength = 4
+
+var registry = struct {
+	sync.RWMutex
+	// static are the values registered for the whole run
+	static map[string]struct{}
+	// owned are the current values of owners replacing their value over time, i.e. secret files and tokens
+	owned    map[interface{}]string
+	replacer *strings.Replacer
+}{
+	static:   make(map[string]struct{}),
+	owned:    make(map[interface{}]string),
+	replacer: strings.NewReplacer(),
+}
+
+// Register adds a value, along with its URL encoded form, to the values replaced by Redact for the whole run.
+func Register(value string) {
+	if len(value) < minRedactedLength {
+		return
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, known := registry.static[value]; known {
+		return
+	}
+
+	registry.static[value] = struct{}{}
+	rebuildLocked()
+}
+
+// RegisterAs is Register for a value that the owner replaces over time, its previous value is no longer redacted.
+// The owner has to be comparable, usually a pointer.
+func RegisterAs(owner interface{}, value string) {
+	if len(value) < minRedactedLength {
+		value = ""
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.owned[owner] == value {
+		return
+	}
+
+	if value == "" {
+		delete(registry.owned, owner)
+	} else {
+		registry.owned[owner] = value
+	}
+	rebuildLocked()
+}
+
+// rebuildLocked builds the replacer of the registered values, the registry has to be locked for writing.
+func rebuildLocked() {
+	set := make(map[string]struct{}, 2*(len(registry.static)+len(registry.owned)))
+	for v := range registry.static {
+		set[v] = struct{}{}
+		set[url.QueryEscape(v)] = struct{}{}
+	}
+	for _, v := range registry.owned {
+		set[v] = struct{}{}
+		set[url.QueryEscape(v)] = struct{}{}
+	}
+
+	// longer values first, so a value containing another one is replaced as a whole
+	values := make([]string, 0, len(set))
+	for v := range set {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, Redacted)
+	}
+
+	registry.replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact replaces all registered values in the text.
+func Redact(text string) string {
+	registry.RLock()
+	replacer := registry.replacer
+	registry.RUnlock()
+
+	return replacer.Replace(text)
+}
+
+// Formatter redacts the registered values from everything the wrapped formatter renders, including fields and errors.
+type Formatter struct {
+	log.Formatter
+}
+
+func (f *Formatter) Format(entry *log.Entry) ([]byte, error) {
+	b, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(Redact(string(b))), nil
+}
@@ -0,0 +1,133 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Secret is a credential given directly or read from a file, i.e. a Docker or Kubernetes secret mount. Files are read
+// again once they change, so rotated credentials are picked up without a restart. The current value is registered for
+// redaction, see Redact.
+type Secret struct {
+	path string
+
+	mu      sync.Mutex
+	value   string
+	modTime time.Time
+	size    int64
+}
+
+// New returns a secret with a fixed value.
+func New(value string) *Secret {
+	Register(value)
+
+	return &Secret{value: value}
+}
+
+// FromFile returns a secret read from the file, trailing line breaks are dropped.
+func FromFile(path string) (*Secret, error) {
+	s := &Secret{path: path}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// FromEnv returns the secret of the file named by the variable name + "_FILE", or else the value of the variable name.
+func FromEnv(name string) (*Secret, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		s, err := FromFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+
+		return s, nil
+	}
+
+	return New(os.Getenv(name)), nil
+}
+
+// Getenv is FromEnv for settings without error handling of their own, a file that cannot be read is logged and
+// results in an empty secret.
+func Getenv(name string) *Secret {
+	s, err := FromEnv(name)
+	if err != nil {
+		log.WithField("module", "secrets").WithError(err).Error("Failed to read secret, leaving it empty")
+		return New("")
+	}
+
+	return s
+}
+
+// IsSetInEnv tells if the variable name or its "_FILE" variant is set.
+func IsSetInEnv(name string) bool {
+	return os.Getenv(name) != "" || os.Getenv(name+"_FILE") != ""
+}
+
+// Value returns the current value, reading the file again if it changed. If the file cannot be read anymore, the
+// last value is kept. A nil secret is empty.
+func (s *Secret) Value() string {
+	if s == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path != "" {
+		if err := s.reload(); err != nil {
+			log.WithField("module", "secrets").WithField("file", s.path).WithError(err).
+				Warn("Failed to read secret file again, keeping the previous value")
+		}
+	}
+
+	return s.value
+}
+
+// IsSet tells if the secret has a value.
+func (s *Secret) IsSet() bool {
+	return s.Value() != ""
+}
+
+// String keeps the value out of formatted output.
+func (s *Secret) String() string {
+	return Redacted
+}
+
+// reload reads the file if its modification time or size changed since the last read.
+func (s *Secret) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	if !s.modTime.IsZero() && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	if !s.modTime.IsZero() {
+		log.WithField("module", "secrets").WithField("file", s.path).Info("Secret file changed, using its new value")
+	}
+
+	s.value = strings.TrimRight(string(content), "\r\n")
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+
+	// the previous value was rotated out, only the current one is kept redacted
+	RegisterAs(s, s.value)
+
+	return nil
+}
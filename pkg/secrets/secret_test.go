@@ -0,0 +1,131 @@
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func writeFile(t *testing.T, path string, content string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFromFileReadsChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	now := time.Now()
+
+	writeFile(t, path, "first-secret\n", now.Add(-time.Minute))
+
+	s, err := FromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Value() != "first-secret" {
+		t.Errorf("value %q, want first-secret", s.Value())
+	}
+
+	writeFile(t, path, "second-secret\n", now)
+
+	if s.Value() != "second-secret" {
+		t.Errorf("value %q after the change, want second-secret", s.Value())
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Value() != "second-secret" {
+		t.Errorf("value %q after the removal, want the previous value", s.Value())
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	writeFile(t, path, "from-file", time.Now())
+
+	t.Setenv("SECRETS_TEST", "from-env")
+
+	if s, err := FromEnv("SECRETS_TEST"); err != nil || s.Value() != "from-env" {
+		t.Errorf("value %q, %v, want from-env", s.Value(), err)
+	}
+
+	t.Setenv("SECRETS_TEST_FILE", path)
+
+	if s, err := FromEnv("SECRETS_TEST"); err != nil || s.Value() != "from-file" {
+		t.Errorf("value %q, %v, want the file to win", s.Value(), err)
+	}
+
+	t.Setenv("SECRETS_TEST_FILE", path+".missing")
+
+	if _, err := FromEnv("SECRETS_TEST"); err == nil {
+		t.Error("missing file accepted")
+	}
+}
+
+func TestFormatterRedacts(t *testing.T) {
+	New("p@ss word")
+	New("abc")
+
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Formatter = &Formatter{Formatter: &log.TextFormatter{DisableTimestamp: true}}
+
+	logger.WithField("url", "https://example.com/?password=p%40ss+word").WithError(os.ErrPermission).
+		Error("login with p@ss word failed, abc")
+
+	logged := out.String()
+
+	if strings.Contains(logged, "p@ss word") || strings.Contains(logged, "p%40ss+word") {
+		t.Errorf("secret logged: %s", logged)
+	}
+
+	if !strings.Contains(logged, "abc") {
+		t.Errorf("value shorter than %d characters redacted: %s", minRedactedLength, logged)
+	}
+
+	if formatted := fmt.Sprintf("%v", New("another-secret")); formatted != Redacted {
+		t.Errorf("secret formatted as %s", formatted)
+	}
+}
+
+func TestRotatedValueIsReplaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	now := time.Now()
+
+	writeFile(t, path, "rotated-old\n", now.Add(-time.Minute))
+
+	s, err := FromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, path, "rotated-new\n", now)
+	s.Value()
+
+	if redacted := Redact("rotated-old rotated-new"); redacted != "rotated-old "+Redacted {
+		t.Errorf("redacted to %q, want only the current value replaced", redacted)
+	}
+
+	// a static value stays redacted, even if an owner drops the same value
+	Register("static-value")
+	RegisterAs(t, "static-value")
+	RegisterAs(t, "")
+
+	if redacted := Redact("static-value"); redacted != Redacted {
+		t.Errorf("redacted to %q, want the static value kept", redacted)
+	}
+}
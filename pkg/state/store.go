@@ -0,0 +1,193 @@
+package state
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store keeps the last known address per family and the suspended hosts of providers, persisted to a JSON file so
+// they survive restarts. Without a path everything is only kept in memory.
+type Store struct {
+	mu   sync.Mutex
+	path string
+
+	Addresses map[string]string `json:"addresses"`
+	// Prefix is the last IPv6 prefix reported along with the IPv6 address
+	Prefix      string                `json:"prefix,omitempty"`
+	Suspensions map[string]Suspension `json:"suspensions,omitempty"`
+
+	// Salt keys the fingerprints, created randomly once per state file
+	Salt string `json:"salt,omitempty"`
+}
+
+// Suspension is a host a provider stopped updating after a fatal response, until its config changes.
+type Suspension struct {
+	// Fingerprint of the config the host was suspended with
+	Fingerprint string    `json:"fingerprint"`
+	Reason      string    `json:"reason"`
+	Since       time.Time `json:"since"`
+}
+
+// NewStore loads the store from path, a missing file results in an empty store.
+func NewStore(path string) (*Store, error) {
+	s := &Store{
+		path:        path,
+		Addresses:   make(map[string]string),
+		Suspensions: make(map[string]Suspension),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return s, err
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return s, err
+	}
+
+	if s.Addresses == nil {
+		s.Addresses = make(map[string]string)
+	}
+
+	if s.Suspensions == nil {
+		s.Suspensions = make(map[string]Suspension)
+	}
+
+	return s, nil
+}
+
+// LastAddress returns the last known address of the family, nil if there is none.
+func (s *Store) LastAddress(family string) net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return net.ParseIP(s.Addresses[family])
+}
+
+// LastPrefix returns the last known IPv6 prefix, nil if there is none.
+func (s *Store) LastPrefix() *net.IPNet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, prefix, err := net.ParseCIDR(s.Prefix)
+	if err != nil {
+		return nil
+	}
+
+	return prefix
+}
+
+// SetLastAddress remembers the address of the family and persists the store. The prefix is kept along with an IPv6
+// address, nil clears it.
+func (s *Store) SetLastAddress(family string, ip net.IP, prefix *net.IPNet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Addresses[family] = ip.String()
+
+	if ip.To4() == nil {
+		s.Prefix = ""
+		if prefix != nil {
+			s.Prefix = prefix.String()
+		}
+	}
+
+	return s.save()
+}
+
+// Suspension returns the suspension stored under the key, if any.
+func (s *Store) Suspension(key string) (Suspension, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	suspension, ok := s.Suspensions[key]
+
+	return suspension, ok
+}
+
+// Suspend stores the suspension under the key and persists the store.
+func (s *Store) Suspend(key string, suspension Suspension) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Suspensions[key] = suspension
+
+	return s.save()
+}
+
+// Resume removes the suspension stored under the key and persists the store.
+func (s *Store) Resume(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Suspensions[key]; !ok {
+		return nil
+	}
+
+	delete(s.Suspensions, key)
+
+	return s.save()
+}
+
+// Fingerprint returns a keyed hash of the values, so a config can be recognized later without storing its secrets.
+// The salt is created on first use and persisted along with the next change of the store.
+func (s *Store) Fingerprint(values ...string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Salt == "" {
+		salt := make([]byte, 32)
+		_, _ = rand.Read(salt)
+		s.Salt = hex.EncodeToString(salt)
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.Salt))
+	for _, value := range values {
+		mac.Write([]byte(value))
+		mac.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// save writes the store to its file, the caller has to hold the lock.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}